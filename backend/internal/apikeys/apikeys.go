@@ -0,0 +1,382 @@
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+
+	"viddl.me/backend/internal/jobs"
+)
+
+// Scopes a key can be granted.
+const (
+	ScopeInfo     = "info"
+	ScopeDownload = "download"
+	ScopeAudio    = "audio"
+	ScopeBatch    = "batch" // whole carousels and playlists in one request
+	ScopeAdmin    = "admin"
+)
+
+var validScopes = map[string]bool{
+	ScopeInfo: true, ScopeDownload: true, ScopeAudio: true, ScopeBatch: true, ScopeAdmin: true,
+}
+
+// ValidScope reports whether scope is one keys can be granted.
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+var (
+	ErrRateLimited   = errors.New("API key rate limit exceeded, please try again later")
+	ErrTooConcurrent = errors.New("too many concurrent requests for this API key")
+	ErrQuotaExceeded = errors.New("monthly quota of this API key is used up")
+)
+
+// contextKey is where the authenticated key is stored in the gin context.
+const contextKey = "api_key"
+
+// TokenPrefix starts the names bearer token subjects are counted under.
+const TokenPrefix = "oidc:"
+
+// Key is one API client. Only the SHA-256 of the secret is configured.
+type Key struct {
+	Name          string   `json:"name"`
+	Hash          string   `json:"hash"` // hex SHA-256 of the key
+	Scopes        []string `json:"scopes"`
+	RatePerMinute float64  `json:"rate_per_minute,omitempty"` // 0 for unlimited
+	Burst         int      `json:"burst,omitempty"`
+	MaxConcurrent int      `json:"max_concurrent,omitempty"` // 0 for unlimited
+	MonthlyJobs   int      `json:"monthly_jobs,omitempty"`   // 0 for unlimited
+	MonthlyBytes  int64    `json:"monthly_bytes,omitempty"`  // 0 for unlimited
+}
+
+func (k *Key) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyUsage is a key's configuration with its current usage, as reported to
+// admins.
+type KeyUsage struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	Month         string   `json:"month"`
+	Jobs          int      `json:"jobs"`
+	Bytes         int64    `json:"bytes"`
+	MonthlyJobs   int      `json:"monthly_jobs"`
+	MonthlyBytes  int64    `json:"monthly_bytes"`
+	Active        int      `json:"active"`
+	MaxConcurrent int      `json:"max_concurrent"`
+}
+
+// Store looks up keys by hash and enforces their limits. Usage counters are
+// kept in the job store so quotas survive restarts.
+type Store struct {
+	keys  map[string]*Key // by hash
+	usage *jobs.Store
+	now   func() time.Time
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	active   map[string]int
+	// Limits of bearer token subjects
+	tokens Key
+	// Limiters of bearer token subjects, dropped once they have refilled
+	// as there is no telling how many subjects an IdP issues
+	subjects map[string]*rate.Limiter
+	swept    time.Time
+}
+
+func NewStore(keys []*Key, usage *jobs.Store) *Store {
+	s := &Store{
+		usage:    usage,
+		now:      time.Now,
+		limiters: make(map[string]*rate.Limiter),
+		active:   make(map[string]int),
+		subjects: make(map[string]*rate.Limiter),
+	}
+	s.SetKeys(keys)
+	return s
+}
+
+// SetKeys replaces the configured keys. Keys with unchanged rate limits
+// keep their limiters, so reloading doesn't refill them.
+func (s *Store) SetKeys(keys []*Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byHash := make(map[string]*Key, len(keys))
+	limiters := make(map[string]*rate.Limiter)
+	for _, k := range keys {
+		byHash[k.Hash] = k
+		l := newLimiter(k)
+		if old := s.limiters[k.Name]; old != nil && l != nil && old.Limit() == l.Limit() && old.Burst() == l.Burst() {
+			l = old
+		}
+		if l != nil {
+			limiters[k.Name] = l
+		}
+	}
+	s.keys, s.limiters = byHash, limiters
+}
+
+// newLimiter returns k's rate limiter, or nil if its rate is unlimited.
+func newLimiter(k *Key) *rate.Limiter {
+	if k.RatePerMinute <= 0 {
+		return nil
+	}
+	burst := k.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(k.RatePerMinute/60), burst)
+}
+
+// limiter returns the rate limiter of k, creating a token subject's on
+// first use.
+func (s *Store) limiter(k *Key) *rate.Limiter {
+	if !strings.HasPrefix(k.Name, TokenPrefix) {
+		return s.limiters[k.Name]
+	}
+	l := s.subjects[k.Name]
+	if l == nil {
+		if l = newLimiter(k); l != nil {
+			s.subjects[k.Name] = l
+		}
+	}
+	return l
+}
+
+// sweepSubjects drops, at most once a minute, the limiters of idle token
+// subjects that have refilled. Those are no different from new ones.
+func (s *Store) sweepSubjects() {
+	now := s.now()
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for name, l := range s.subjects {
+		if s.active[name] == 0 && l.TokensAt(now) >= float64(l.Burst()) {
+			delete(s.subjects, name)
+		}
+	}
+}
+
+// SetTokenLimits sets the limits every bearer token subject is held to, 0
+// for unlimited. Subjects seen before switch to them right away.
+func (s *Store) SetTokenLimits(ratePerMinute float64, burst, maxConcurrent int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = Key{RatePerMinute: ratePerMinute, Burst: burst, MaxConcurrent: maxConcurrent}
+	for name, l := range s.subjects {
+		next := newLimiter(&s.tokens)
+		if next == nil {
+			delete(s.subjects, name)
+			continue
+		}
+		l.SetLimit(next.Limit())
+		l.SetBurst(next.Burst())
+	}
+}
+
+// Token returns the key of a bearer token's subject, held to the token
+// limits and counted under TokenPrefix and subject like a configured key.
+func (s *Store) Token(subject string, scopes []string) *Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.tokens
+	k.Name, k.Scopes = TokenPrefix+subject, scopes
+	return &k
+}
+
+// Load reads keys from a JSON file, if path is set, and adds the legacy
+// single API_KEY as "default" with every scope except admin.
+func Load(path, legacyKey string) ([]*Key, error) {
+	var keys []*Key
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading API keys: %w", err)
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("parsing API keys: %w", err)
+		}
+	}
+	if legacyKey != "" {
+		keys = append(keys, &Key{
+			Name:   "default",
+			Hash:   Hash(legacyKey),
+			Scopes: []string{ScopeInfo, ScopeDownload, ScopeAudio, ScopeBatch},
+		})
+	}
+
+	names := make(map[string]bool)
+	for _, k := range keys {
+		k.Hash = strings.ToLower(strings.TrimPrefix(k.Hash, "sha256:"))
+		if k.Name == "" || names[k.Name] {
+			return nil, fmt.Errorf("API key names must be set and unique, got %q", k.Name)
+		}
+		names[k.Name] = true
+		if len(k.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("API key %q: hash must be a hex SHA-256", k.Name)
+		}
+		for _, scope := range k.Scopes {
+			if !validScopes[scope] {
+				return nil, fmt.Errorf("API key %q: unknown scope %q", k.Name, scope)
+			}
+		}
+	}
+	slog.Info("Loaded API keys", "count", len(keys))
+	return keys, nil
+}
+
+// Hash returns the hex SHA-256 of a raw key, as used in the keys file.
+func Hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Len returns the number of configured keys.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// Lookup returns the key matching the raw secret.
+func (s *Store) Lookup(raw string) (*Key, bool) {
+	if raw == "" {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[Hash(raw)]
+	return k, ok
+}
+
+// Acquire admits one request for k against its rate, concurrency and
+// monthly quotas. release must be called when the request is done.
+func (s *Store) Acquire(k *Key) (func(), error) {
+	if k.MonthlyJobs > 0 || k.MonthlyBytes > 0 {
+		u, err := s.usage.Usage(k.Name, s.month())
+		if err != nil {
+			slog.Error("Failed to read API key usage", "api_key", k.Name, "error", err)
+		} else if (k.MonthlyJobs > 0 && u.Jobs >= k.MonthlyJobs) || (k.MonthlyBytes > 0 && u.Bytes >= k.MonthlyBytes) {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweepSubjects()
+	if l := s.limiter(k); l != nil && !l.Allow() {
+		return nil, ErrRateLimited
+	}
+	if k.MaxConcurrent > 0 && s.active[k.Name] >= k.MaxConcurrent {
+		return nil, ErrTooConcurrent
+	}
+	s.active[k.Name]++
+
+	released := false
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if released {
+			return
+		}
+		released = true
+		if s.active[k.Name]--; s.active[k.Name] <= 0 {
+			delete(s.active, k.Name)
+		}
+	}, nil
+}
+
+// Record adds a finished job's usage to the key's monthly counters.
+func (s *Store) Record(k *Key, jobs int, bytes int64) {
+	if err := s.usage.AddUsage(k.Name, s.month(), jobs, bytes); err != nil {
+		slog.Error("Failed to record API key usage", "api_key", k.Name, "error", err)
+	}
+}
+
+// Usage reports every key's usage in the current month, and that of bearer
+// token subjects that used something or are active.
+func (s *Store) Usage() ([]KeyUsage, error) {
+	month := s.month()
+	used, err := s.usage.MonthUsage(month)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	tokens := make(map[string]bool)
+	for name := range used {
+		tokens[name] = true
+	}
+	for name := range s.active {
+		tokens[name] = true
+	}
+	for name := range tokens {
+		if strings.HasPrefix(name, TokenPrefix) {
+			k := s.tokens
+			k.Name = name
+			keys = append(keys, &k)
+		}
+	}
+
+	list := make([]KeyUsage, 0, len(keys))
+	for _, k := range keys {
+		u, active := used[k.Name], s.active[k.Name]
+		list = append(list, KeyUsage{
+			Name:          k.Name,
+			Scopes:        k.Scopes,
+			Month:         month,
+			Jobs:          u.Jobs,
+			Bytes:         u.Bytes,
+			MonthlyJobs:   k.MonthlyJobs,
+			MonthlyBytes:  k.MonthlyBytes,
+			Active:        active,
+			MaxConcurrent: k.MaxConcurrent,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *Store) month() string {
+	return s.now().UTC().Format("2006-01")
+}
+
+// FromContext returns the key the request was authenticated with, if any.
+func FromContext(c *gin.Context) *Key {
+	if v, ok := c.Get(contextKey); ok {
+		if k, ok := v.(*Key); ok {
+			return k
+		}
+	}
+	return nil
+}
+
+// SetContext marks the request as authenticated with k.
+func SetContext(c *gin.Context, k *Key) {
+	c.Set(contextKey, k)
+}
@@ -0,0 +1,161 @@
+package apikeys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/jobs"
+)
+
+func TestLoad(t *testing.T) {
+	hash := Hash("secret")
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "valid", file: `[{"name": "a", "hash": "sha256:` + hash + `", "scopes": ["info", "admin"]}]`},
+		{name: "duplicate name", file: `[{"name": "default", "hash": "` + hash + `"}]`, wantErr: true},
+		{name: "bad hash", file: `[{"name": "a", "hash": "secret"}]`, wantErr: true},
+		{name: "unknown scope", file: `[{"name": "a", "hash": "` + hash + `", "scopes": ["delete"]}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := Load(path, "legacy")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			s := NewStore(keys, nil)
+			if k, ok := s.Lookup("secret"); !ok || k.Name != "a" || !k.Allows(ScopeAdmin) {
+				t.Errorf("Lookup(secret) = %+v, %v", k, ok)
+			}
+			if k, ok := s.Lookup("legacy"); !ok || k.Allows(ScopeAdmin) || !k.Allows(ScopeAudio) {
+				t.Errorf("Lookup(legacy) = %+v, %v", k, ok)
+			}
+			if _, ok := s.Lookup("wrong"); ok {
+				t.Error("Lookup(wrong) found a key")
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	usage, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer usage.Close()
+
+	limited := &Key{Name: "limited", Hash: Hash("l"), RatePerMinute: 60, Burst: 2, MaxConcurrent: 1}
+	quota := &Key{Name: "quota", Hash: Hash("q"), MonthlyJobs: 2}
+	s := NewStore([]*Key{limited, quota}, usage)
+	s.now = func() time.Time { return time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC) }
+
+	release, err := s.Acquire(limited)
+	if err != nil {
+		t.Fatalf("first Acquire() error = %v", err)
+	}
+	if _, err := s.Acquire(limited); !errors.Is(err, ErrTooConcurrent) {
+		t.Errorf("concurrent Acquire() error = %v, want ErrTooConcurrent", err)
+	}
+	release()
+	release()
+	if _, err := s.Acquire(limited); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Acquire() over burst error = %v, want ErrRateLimited", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		release, err := s.Acquire(quota)
+		if err != nil {
+			t.Fatalf("Acquire() within quota error = %v", err)
+		}
+		s.Record(quota, 1, 100)
+		release()
+	}
+	if _, err := s.Acquire(quota); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Acquire() past quota error = %v, want ErrQuotaExceeded", err)
+	}
+
+	list, err := s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[1].Name != "quota" || list[1].Jobs != 2 || list[1].Bytes != 200 || list[1].Month != "2026-10" {
+		t.Errorf("Usage() = %+v", list)
+	}
+
+	// Quotas reset with the month
+	s.now = func() time.Time { return time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC) }
+	if _, err := s.Acquire(quota); err != nil {
+		t.Errorf("Acquire() in new month error = %v", err)
+	}
+
+	// Token subjects are held to the token limits and reported once they
+	// used something
+	s.SetTokenLimits(60, 5, 1)
+	token := s.Token("svc-archiver", []string{ScopeInfo})
+	release, err = s.Acquire(token)
+	if err != nil {
+		t.Fatalf("token Acquire() error = %v", err)
+	}
+	if _, err := s.Acquire(s.Token("svc-archiver", nil)); !errors.Is(err, ErrTooConcurrent) {
+		t.Errorf("concurrent token Acquire() error = %v, want ErrTooConcurrent", err)
+	}
+	s.Record(token, 1, 10)
+	release()
+	list, err = s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[1].Name != "oidc:svc-archiver" || list[1].Jobs != 1 || list[1].MaxConcurrent != 1 {
+		t.Errorf("Usage() = %+v, want the token subject listed", list)
+	}
+
+	// Idle subjects' limiters are dropped once refilled
+	s.now = func() time.Time { return time.Now().Add(time.Hour) }
+	s.swept = time.Time{}
+	s.Acquire(limited)
+	if len(s.subjects) != 0 {
+		t.Errorf("subjects = %v after an idle hour, want none", s.subjects)
+	}
+}
+
+func TestSetKeys(t *testing.T) {
+	usage, err := jobs.Open(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer usage.Close()
+
+	old := &Key{Name: "old", Hash: Hash("o"), RatePerMinute: 60, Burst: 1}
+	s := NewStore([]*Key{old}, usage)
+	if _, err := s.Acquire(old); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload revokes keys and keeps the state of those that stay
+	s.SetKeys([]*Key{{Name: "old", Hash: Hash("o"), RatePerMinute: 60, Burst: 1}, {Name: "new", Hash: Hash("n")}})
+	if _, ok := s.Lookup("n"); !ok {
+		t.Error("Lookup() of an added key failed")
+	}
+	if _, err := s.Acquire(old); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Acquire() of a kept key error = %v, want its limiter kept", err)
+	}
+	s.SetKeys(nil)
+	if _, ok := s.Lookup("o"); ok || s.Len() != 0 {
+		t.Error("Lookup() of a removed key succeeded")
+	}
+}
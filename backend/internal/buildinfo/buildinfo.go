@@ -0,0 +1,59 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at link time:
+//
+//	go build -ldflags "-X viddl.me/backend/internal/buildinfo.Version=v1.4.0 \
+//		-X viddl.me/backend/internal/buildinfo.Commit=$(git rev-parse HEAD) \
+//		-X viddl.me/backend/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version = "dev"
+	Commit  string
+	Date    string
+)
+
+// started is when the process started, for uptime.
+var started = time.Now()
+
+// Info describes the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// Get returns the build info set at link time. Commit and date fall back to
+// the VCS stamp go build records when the binary is built from a checkout.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			case s.Key == "vcs.modified" && Commit == "":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// Uptime returns how long the process has been running.
+func Uptime() time.Duration {
+	return time.Since(started)
+}
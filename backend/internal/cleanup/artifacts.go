@@ -0,0 +1,32 @@
+package cleanup
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Sessions work in "<TmpDir>/<32 hex session ID>/", finished downloads
+	// are stored as "<session ID>_<title>.<ext>"
+	sessionDir    = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	sessionPrefix = regexp.MustCompile(`^([0-9a-f]{32})_`)
+	// Per-format streams yt-dlp merges afterwards, e.g. "title.f137.mp4"
+	formatIntermediate = regexp.MustCompile(`\.f\d+(-\d+)?\.\w+$`)
+)
+
+// parseArtifact returns the download session a file belongs to, if any, and
+// whether it is an unfinished or intermediate file rather than a result:
+// yt-dlp's .part/.ytdl files and fragments, per-format streams awaiting a
+// merge and ffmpeg's .temp files.
+func parseArtifact(name string) (sessionID string, partial bool) {
+	if m := sessionPrefix.FindStringSubmatch(name); m != nil {
+		sessionID = m[1]
+	}
+
+	partial = strings.HasSuffix(name, ".part") ||
+		strings.HasSuffix(name, ".ytdl") ||
+		strings.Contains(name, ".part-Frag") ||
+		strings.Contains(name, ".temp.") ||
+		formatIntermediate.MatchString(name)
+	return sessionID, partial
+}
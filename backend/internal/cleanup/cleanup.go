@@ -1,87 +1,273 @@
 package cleanup
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"viddl.me/backend/internal/disk"
+	"viddl.me/backend/internal/metrics"
+	"viddl.me/backend/internal/storage"
 )
 
+// pressureInterval is how often disk space is checked between sweeps.
+const pressureInterval = 30 * time.Second
+
+// SweepResult counts what one or more sweeps did.
+type SweepResult struct {
+	FilesRemoved    int   `json:"files_removed"`
+	PartialsRemoved int   `json:"partials_removed"`
+	SessionsRemoved int   `json:"sessions_removed"`
+	BytesFreed      int64 `json:"bytes_freed"`
+	SkippedActive   int   `json:"skipped_active"`
+	Errors          int   `json:"errors"`
+}
+
+func (r *SweepResult) add(o SweepResult) {
+	r.FilesRemoved += o.FilesRemoved
+	r.PartialsRemoved += o.PartialsRemoved
+	r.SessionsRemoved += o.SessionsRemoved
+	r.BytesFreed += o.BytesFreed
+	r.SkippedActive += o.SkippedActive
+	r.Errors += o.Errors
+}
+
+// Stats describes the cleaner's sweeps since it was created.
+type Stats struct {
+	Sweeps    int         `json:"sweeps"`
+	LastSweep time.Time   `json:"last_sweep"`
+	Last      SweepResult `json:"last"`
+	Total     SweepResult `json:"total"`
+}
+
 type Cleaner struct {
-	tmpDir   string
-	interval time.Duration
-	maxAge   time.Duration
+	store     storage.Storage
+	scheduler *Scheduler
+	interval  time.Duration
+	maxAge    time.Duration
+	shortfall func() int64
+	workDir   string
+	active    func(sessionID string) bool
+
+	sweepMu sync.Mutex
+	statsMu sync.Mutex
+	stats   Stats
+
+	runMu sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
 }
 
-func New(tmpDir string, interval, maxAge time.Duration) *Cleaner {
+// New returns a cleaner that deletes files older than maxAge. Files of jobs
+// the scheduler still holds are left for it to remove at expiry.
+func New(store storage.Storage, scheduler *Scheduler, interval, maxAge time.Duration) *Cleaner {
 	return &Cleaner{
-		tmpDir:   tmpDir,
-		interval: interval,
-		maxAge:   maxAge,
+		store:     store,
+		scheduler: scheduler,
+		interval:  interval,
+		maxAge:    maxAge,
 	}
 }
 
+// EvictUnderPressure makes the cleaner evict the oldest finished files
+// whenever shortfall reports that more disk space is needed. Only useful
+// when the store holds its files on the local disk.
+func (c *Cleaner) EvictUnderPressure(shortfall func() int64) {
+	c.shortfall = shortfall
+}
+
+// TrackSessions tells the cleaner which download sessions are running. Their
+// files are never touched, while session directories in workDir and
+// partial files of finished sessions are removed right away instead of
+// waiting for maxAge.
+func (c *Cleaner) TrackSessions(workDir string, active func(sessionID string) bool) {
+	c.workDir = workDir
+	c.active = active
+}
+
+// Start sweeps once and then keeps sweeping every interval until Stop. A
+// stopped cleaner can be started again.
 func (c *Cleaner) Start() {
-	c.cleanOnce()
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	c.Sweep()
+
+	go c.run(c.stop, c.done)
+}
+
+// Stop ends periodic sweeps and waits for a running sweep to finish.
+func (c *Cleaner) Stop() {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop, c.done = nil, nil
+}
+
+func (c *Cleaner) run(stop, done chan struct{}) {
+	defer close(done)
 
 	ticker := time.NewTicker(c.interval)
-	go func() {
-		for range ticker.C {
-			c.cleanOnce()
+	defer ticker.Stop()
+
+	var pressure <-chan time.Time
+	if c.shortfall != nil && c.scheduler != nil {
+		t := time.NewTicker(pressureInterval)
+		defer t.Stop()
+		pressure = t.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+		case <-pressure:
+			c.relievePressure()
+		case <-stop:
+			return
 		}
-	}()
+	}
 }
 
-func (c *Cleaner) cleanOnce() {
-	files, err := os.ReadDir(c.tmpDir)
-	if err != nil {
-		log.Printf("ERROR: Error reading tmp directory: %v", err)
+func (c *Cleaner) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+func (c *Cleaner) relievePressure() {
+	need := c.shortfall()
+	if need <= 0 {
 		return
 	}
+	freed := c.scheduler.Evict(need)
+	slog.Warn("Disk pressure, evicted finished files", "needed_bytes", need, "freed_bytes", freed)
+}
+
+// Sweep removes leftover partial files of finished sessions and files older
+// than maxAge, and reports what it did.
+func (c *Cleaner) Sweep() SweepResult {
+	c.sweepMu.Lock()
+	defer c.sweepMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+
+	var result SweepResult
+	if c.workDir != "" && c.active != nil {
+		c.sweepSessionDirs(&result)
+	}
+
+	objects, err := c.store.ListOlderThan(ctx, 0)
+	if err != nil {
+		slog.Error("Failed to list stored files", "error", err)
+		result.Errors++
+		c.record(result)
+		return result
+	}
 
 	now := time.Now()
-	cleanedCount := 0
-	var totalSize int64
+	for _, obj := range objects {
+		age := now.Sub(obj.ModTime)
+		sessionID, partial := parseArtifact(obj.Key)
 
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), ".") {
+		switch {
+		case c.scheduler != nil && c.scheduler.Active(obj.Key):
+			continue
+		case sessionID != "" && c.active != nil && c.active(sessionID):
+			result.SkippedActive++
+			continue
+		case partial && sessionID != "" && c.active != nil:
+			// The session is over, nothing will finish this file
+		case age < c.maxAge:
 			continue
 		}
 
-		filePath := filepath.Join(c.tmpDir, file.Name())
-		info, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("ERROR: Error stating file %s: %v", file.Name(), err)
+		if err := c.store.Delete(ctx, obj.Key); err != nil {
+			slog.Error("Failed to remove file", "key", obj.Key, "error", err)
+			result.Errors++
 			continue
 		}
-
-		if now.Sub(info.ModTime()) > c.maxAge {
-			fileSize := info.Size()
-			if err := os.Remove(filePath); err != nil {
-				log.Printf("ERROR: Error removing file %s: %v", file.Name(), err)
-			} else {
-				cleanedCount++
-				totalSize += fileSize
-				log.Printf("INFO: Cleaned up old file: %s (size: %d bytes, age: %v)",
-					file.Name(), fileSize, now.Sub(info.ModTime()).Round(time.Second))
-			}
+		if partial {
+			result.PartialsRemoved++
+			slog.Info("Cleaned up partial file", "key", obj.Key, "size", obj.Size)
+		} else {
+			result.FilesRemoved++
+			slog.Info("Cleaned up old file", "key", obj.Key, "size", obj.Size, "age", age.Round(time.Second))
 		}
+		result.BytesFreed += obj.Size
+	}
+
+	if removed := result.FilesRemoved + result.PartialsRemoved; removed > 0 || result.SessionsRemoved > 0 {
+		slog.Info("Cleanup complete", "files", removed, "partial", result.PartialsRemoved,
+			"sessions", result.SessionsRemoved, "freed_bytes", result.BytesFreed)
 	}
+	c.record(result)
 
-	if cleanedCount > 0 {
-		log.Printf("INFO: Cleanup complete: removed %d files, freed %d MB",
-			cleanedCount, totalSize/(1024*1024))
+	if c.shortfall != nil && c.scheduler != nil {
+		c.relievePressure()
 	}
+	return result
 }
 
-func ScheduleFileRemoval(filePath string, delay time.Duration) {
-	go func() {
-		time.Sleep(delay)
-		if err := os.Remove(filePath); err != nil {
-			log.Printf("ERROR: Failed to cleanup file %s: %v", filePath, err)
-		} else {
-			log.Printf("INFO: Cleaned up downloaded file: %s", filePath)
+// sweepSessionDirs removes working directories of sessions that are no
+// longer running, left behind by a crash, and half-removed ones.
+func (c *Cleaner) sweepSessionDirs(result *SweepResult) {
+	entries, err := os.ReadDir(c.workDir)
+	if err != nil {
+		slog.Error("Failed to list session directories", "error", err)
+		result.Errors++
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			continue
+		}
+		trash := strings.HasPrefix(name, ".trash-")
+		if !trash && (!sessionDir.MatchString(name) || c.active(name)) {
+			continue
 		}
-	}()
+
+		path := filepath.Join(c.workDir, name)
+		size, _ := disk.Used(path)
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Failed to remove session directory", "session", name, "error", err)
+			result.Errors++
+			continue
+		}
+		slog.Info("Cleaned up session directory", "session", name, "size", size)
+		result.SessionsRemoved++
+		result.BytesFreed += size
+	}
+}
+
+func (c *Cleaner) record(result SweepResult) {
+	metrics.CleanupSweeps.Inc()
+	metrics.CleanupRemoved.WithLabelValues("file").Add(float64(result.FilesRemoved))
+	metrics.CleanupRemoved.WithLabelValues("partial").Add(float64(result.PartialsRemoved))
+	metrics.CleanupRemoved.WithLabelValues("session").Add(float64(result.SessionsRemoved))
+	metrics.CleanupFreedBytes.Add(float64(result.BytesFreed))
+	metrics.CleanupErrors.Add(float64(result.Errors))
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.Sweeps++
+	c.stats.LastSweep = time.Now()
+	c.stats.Last = result
+	c.stats.Total.add(result)
 }
@@ -0,0 +1,105 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/storage"
+)
+
+const (
+	activeSession = "0123456789abcdef0123456789abcdef"
+	endedSession  = "fedcba9876543210fedcba9876543210"
+)
+
+func TestParseArtifact(t *testing.T) {
+	tests := []struct {
+		name        string
+		wantSession string
+		wantPartial bool
+	}{
+		{activeSession + "_Some Video.mp4", activeSession, false},
+		{activeSession + "_Some Video.mp4.part", activeSession, true},
+		{activeSession + "_Some Video.mp4.ytdl", activeSession, true},
+		{activeSession + "_Some Video.mp4.part-Frag12", activeSession, true},
+		{activeSession + "_Some Video.f137.mp4", activeSession, true},
+		{activeSession + "_Some Video.f140.m4a.part", activeSession, true},
+		{activeSession + "_Some Video.temp.mp4", activeSession, true},
+		{activeSession + "_Some.funny.video.mp4", activeSession, false},
+		{"stray.mp4", "", false},
+		{"stray.mp4.part", "", true},
+	}
+
+	for _, tt := range tests {
+		session, partial := parseArtifact(tt.name)
+		if session != tt.wantSession || partial != tt.wantPartial {
+			t.Errorf("parseArtifact(%q) = %q, %v, want %q, %v",
+				tt.name, session, partial, tt.wantSession, tt.wantPartial)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	files := map[string]time.Time{
+		activeSession + "_stalled.mp4.part": old,
+		activeSession + "_Video.f137.mp4":   old,
+		endedSession + "_Video.f137.mp4":    time.Now(),
+		endedSession + "_Video.mp4.part":    time.Now(),
+		endedSession + "_Video.mp4":         time.Now(),
+		"stray.mp4":                         old,
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := New(storage.NewLocal(dir), nil, time.Minute, 5*time.Minute)
+	for _, name := range []string{activeSession, endedSession, ".trash-" + endedSession, ".cache"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.TrackSessions(dir, func(id string) bool { return id == activeSession })
+
+	result := c.Sweep()
+	want := SweepResult{FilesRemoved: 1, PartialsRemoved: 2, SessionsRemoved: 2, BytesFreed: 12, SkippedActive: 2}
+	if result != want {
+		t.Errorf("Sweep() = %+v, want %+v", result, want)
+	}
+
+	for name, keep := range map[string]bool{
+		activeSession + "_stalled.mp4.part": true,
+		activeSession + "_Video.f137.mp4":   true,
+		endedSession + "_Video.f137.mp4":    false,
+		endedSession + "_Video.mp4.part":    false,
+		endedSession + "_Video.mp4":         true,
+		"stray.mp4":                         false,
+		activeSession:                       true,
+		endedSession:                        false,
+		".trash-" + endedSession:            false,
+		".cache":                            true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != keep {
+			t.Errorf("%s exists = %v, want %v", name, exists, keep)
+		}
+	}
+
+	// Start sweeps right away; a stopped cleaner must be restartable
+	c.Start()
+	c.Stop()
+	c.Start()
+	c.Stop()
+	if stats := c.Stats(); stats.Sweeps != 3 || stats.Total.PartialsRemoved != 2 {
+		t.Errorf("Stats() = %+v, want 3 sweeps with 2 partials removed", stats)
+	}
+}
@@ -0,0 +1,201 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/storage"
+)
+
+// Scheduler removes finished jobs and their files when they expire. Expiry
+// is kept in the job store, so pending removals survive a restart.
+type Scheduler struct {
+	jobs  *jobs.Store
+	store storage.Storage
+
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+func NewScheduler(jobStore *jobs.Store, store storage.Storage) *Scheduler {
+	return &Scheduler{
+		jobs:   jobStore,
+		store:  store,
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// Schedule removes the job and its file at job.ExpiresAt.
+func (s *Scheduler) Schedule(job *jobs.Job) {
+	if job.ExpiresAt.IsZero() {
+		return
+	}
+	id := job.ID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if t, ok := s.timers[id]; ok {
+		t.Stop()
+	}
+	s.timers[id] = time.AfterFunc(time.Until(job.ExpiresAt), func() { s.remove(id) })
+}
+
+// Stop cancels pending removals before the job store is closed. They are
+// restored by Reconcile on the next start.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.timers {
+		t.Stop()
+		delete(s.timers, id)
+	}
+	s.stopped = true
+}
+
+// Expire removes the file stored under key and its job right away. Files
+// of other instances sharing the store are left to them to remove at
+// expiry.
+func (s *Scheduler) Expire(key string) {
+	job, err := s.jobs.ByKey(key)
+	if err != nil {
+		if !errors.Is(err, jobs.ErrNotFound) {
+			slog.Error("Failed to look up job", "key", key, "error", err)
+		}
+		return
+	}
+	s.remove(job.ID)
+}
+
+// Active reports whether key belongs to a job that has not expired yet.
+func (s *Scheduler) Active(key string) bool {
+	job, err := s.jobs.ByKey(key)
+	return err == nil && time.Now().Before(job.ExpiresAt)
+}
+
+// Evict removes finished downloads oldest first, before their links
+// expire, until at least need bytes are freed. It returns the bytes freed,
+// leaving out files that could not be removed.
+func (s *Scheduler) Evict(need int64) int64 {
+	list, err := s.jobs.List()
+	if err != nil {
+		slog.Error("Failed to list jobs for eviction", "error", err)
+		return 0
+	}
+
+	var done []*jobs.Job
+	for _, job := range list {
+		if job.Status == jobs.StatusDone && job.Key != "" {
+			done = append(done, job)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i].UpdatedAt.Before(done[j].UpdatedAt) })
+
+	var freed int64
+	for _, job := range done {
+		if freed >= need {
+			break
+		}
+		slog.Warn("Evicting file early to free disk space", "key", job.Key, "job_id", job.ID)
+		if s.remove(job.ID) {
+			freed += job.Size
+		}
+	}
+	return freed
+}
+
+// remove deletes the job and its file, and reports whether it deleted the
+// file.
+func (s *Scheduler) remove(id string) bool {
+	s.mu.Lock()
+	if t, ok := s.timers[id]; ok {
+		t.Stop()
+		delete(s.timers, id)
+	}
+	s.mu.Unlock()
+
+	job, err := s.jobs.Get(id)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		slog.Error("Failed to load job", "job_id", id, "error", err)
+		return false
+	}
+
+	if job.Key != "" {
+		if err := s.store.Delete(context.Background(), job.Key); err != nil {
+			slog.Error("Failed to remove file", "key", job.Key, "job_id", id, "error", err)
+			return false
+		}
+		slog.Info("Cleaned up downloaded file", "key", job.Key, "job_id", id)
+	}
+	if err := s.jobs.Delete(id); err != nil {
+		slog.Error("Failed to delete job", "job_id", id, "error", err)
+	}
+	return job.Key != ""
+}
+
+// Reconcile brings the job store and the stored files back in line after a
+// restart. Jobs that were still running are marked failed, expired jobs are
+// removed, timers are restored for the rest, and files in any of stores that
+// no job refers to are deleted. Stores shared with other instances must not
+// be passed, their files are unknown to this job store.
+func (s *Scheduler) Reconcile(ctx context.Context, failedTTL time.Duration, stores ...storage.Storage) error {
+	list, err := s.jobs.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	restored, expired, interrupted := 0, 0, 0
+	for _, job := range list {
+		if job.Status == jobs.StatusRunning {
+			job.Status = jobs.StatusFailed
+			job.Error = "interrupted by restart"
+			job.ExpiresAt = now.Add(failedTTL)
+			if err := s.jobs.Put(job); err != nil {
+				slog.ErrorContext(ctx, "Failed to update job", "job_id", job.ID, "error", err)
+			}
+			interrupted++
+		}
+		if !now.Before(job.ExpiresAt) {
+			s.remove(job.ID)
+			expired++
+			continue
+		}
+		s.Schedule(job)
+		restored++
+	}
+
+	orphans := 0
+	for _, store := range stores {
+		objects, err := store.ListOlderThan(ctx, 0)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list stored files", "error", err)
+			continue
+		}
+		for _, obj := range objects {
+			if _, err := s.jobs.ByKey(obj.Key); err == nil {
+				continue
+			}
+			if err := store.Delete(ctx, obj.Key); err != nil {
+				slog.ErrorContext(ctx, "Failed to remove orphaned file", "key", obj.Key, "error", err)
+				continue
+			}
+			orphans++
+		}
+	}
+
+	slog.InfoContext(ctx, "Job store reconciled", "restored", restored, "expired", expired,
+		"interrupted", interrupted, "orphans_removed", orphans)
+	return nil
+}
@@ -0,0 +1,130 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/storage"
+)
+
+func TestReconcile(t *testing.T) {
+	dir := t.TempDir()
+	jobStore, err := jobs.Open(filepath.Join(dir, ".jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobStore.Close()
+
+	now := time.Now()
+	for _, job := range []*jobs.Job{
+		{ID: "live", Status: jobs.StatusDone, Key: "live.mp4", ExpiresAt: now.Add(time.Hour)},
+		{ID: "expired", Status: jobs.StatusDone, Key: "expired.mp4", ExpiresAt: now.Add(-time.Minute)},
+		{ID: "running", Status: jobs.StatusRunning},
+	} {
+		if err := jobStore.Put(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"live.mp4", "expired.mp4", "orphan.mp4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := storage.NewLocal(dir)
+	s := NewScheduler(jobStore, store)
+	if err := s.Reconcile(context.Background(), time.Hour, store); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{"live.mp4": true, "expired.mp4": false, "orphan.mp4": false} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists = %v, want %v", name, exists, want)
+		}
+	}
+
+	if _, err := jobStore.Get("expired"); err != jobs.ErrNotFound {
+		t.Errorf("expired job still stored: %v", err)
+	}
+	running, err := jobStore.Get("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.Status != jobs.StatusFailed {
+		t.Errorf("interrupted job status = %s, want failed", running.Status)
+	}
+	if !s.Active("live.mp4") {
+		t.Error("live.mp4 should stay active until it expires")
+	}
+
+	s.Expire("live.mp4")
+	if _, err := os.Stat(filepath.Join(dir, "live.mp4")); !os.IsNotExist(err) {
+		t.Errorf("live.mp4 not removed on Expire: %v", err)
+	}
+}
+
+// failingStore fails to delete key.
+type failingStore struct {
+	storage.Storage
+	key string
+}
+
+func (s failingStore) Delete(ctx context.Context, key string) error {
+	if key == s.key {
+		return errors.New("delete failed")
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+func TestEvict(t *testing.T) {
+	dir := t.TempDir()
+	jobStore, err := jobs.Open(filepath.Join(dir, ".jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobStore.Close()
+
+	// Put order sets UpdatedAt, so "old" finished first
+	expires := time.Now().Add(time.Hour)
+	for _, job := range []*jobs.Job{
+		{ID: "old", Status: jobs.StatusDone, Key: "old.mp4", Size: 100, ExpiresAt: expires},
+		{ID: "running", Status: jobs.StatusRunning},
+		{ID: "new", Status: jobs.StatusDone, Key: "new.mp4", Size: 100, ExpiresAt: expires},
+	} {
+		if err := jobStore.Put(job); err != nil {
+			t.Fatal(err)
+		}
+		if job.Key != "" {
+			if err := os.WriteFile(filepath.Join(dir, job.Key), []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s := NewScheduler(jobStore, storage.NewLocal(dir))
+	if freed := s.Evict(50); freed != 100 {
+		t.Errorf("Evict freed %d, want 100", freed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.mp4")); !os.IsNotExist(err) {
+		t.Error("oldest file should be evicted first")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.mp4")); err != nil {
+		t.Errorf("newer file should be kept: %v", err)
+	}
+	if _, err := jobStore.Get("running"); err != nil {
+		t.Errorf("running job should be kept: %v", err)
+	}
+
+	// Files that stay on disk free nothing
+	s = NewScheduler(jobStore, failingStore{storage.NewLocal(dir), "new.mp4"})
+	if freed := s.Evict(50); freed != 0 {
+		t.Errorf("Evict freed %d with the delete failing, want 0", freed)
+	}
+}
@@ -1,21 +1,140 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/disk"
+	"viddl.me/backend/internal/downloader"
+	"viddl.me/backend/internal/policy"
+	"viddl.me/backend/internal/proxy"
+	"viddl.me/backend/internal/retry"
 )
 
+// Config is read from the YAML file named by CONFIG_FILE, if any, with
+// environment variables taking precedence. File keys are the environment
+// variable names in lower case. Fields tagged reload take effect when the
+// configuration is reloaded, the others only at startup.
 type Config struct {
-	Port            string
-	AllowedOrigins  []string
-	AllowedDomains  []string
-	MaxDownloadSize string
-	CookiesFile     string
-	TmpDir          string
-	APIKey          string
+	// The file the configuration was read from
+	File string `yaml:"-"`
+
+	Port               string   `yaml:"port"`
+	AllowedOrigins     []string `yaml:"allowed_origins" reload:"true"`
+	DirectMediaDomains []string `yaml:"direct_media_domains" reload:"true"`
+	MaxDownloadSize    string   `yaml:"max_download_size"`
+	MinFreeDisk        string   `yaml:"min_free_disk"`
+	CookiesFile        string   `yaml:"ytdlp_cookies" reload:"true"`
+	TmpDir             string   `yaml:"tmp_dir"`
+	StateDB            string   `yaml:"state_db"`
+	APIKey             string   `yaml:"api_key" reload:"true"`
+	APIKeysFile        string   `yaml:"api_keys_file" reload:"true"`
+
+	// Domains URLs may point to, with per-domain limits. In the file an
+	// entry is either a domain or a policy
+	AllowedDomains policy.Set `yaml:"allowed_domains" reload:"true"`
+
+	// Per-IP limits for clients without an API key: requests per minute
+	// with bursts of RateBurst, and downloads running at once
+	RateLimit              int `yaml:"rate_limit" reload:"true"`
+	RateBurst              int `yaml:"rate_burst" reload:"true"`
+	MaxConcurrentDownloads int `yaml:"max_concurrent_downloads" reload:"true"`
+
+	// How long one download may take
+	DownloadTimeout time.Duration `yaml:"download_timeout" reload:"true"`
+
+	// How often a yt-dlp run is tried when it fails with one of the
+	// RetryOn error codes, waiting a jittered RetryBackoff that doubles up
+	// to RetryMaxBackoff in between
+	DownloadAttempts int           `yaml:"download_attempts" reload:"true"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff" reload:"true"`
+	RetryMaxBackoff  time.Duration `yaml:"retry_max_backoff" reload:"true"`
+	RetryOn          []string      `yaml:"retry_on" reload:"true"`
+
+	// BreakerThreshold failed runs in a row for a platform make its
+	// requests fail fast for BreakerCooldown. 0 turns the breakers off
+	BreakerThreshold int           `yaml:"breaker_threshold" reload:"true"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" reload:"true"`
+
+	// Cookies files of platform accounts, used for their domains in turns.
+	// Only in the file
+	CookieJars []cookies.Jar `yaml:"cookie_jars" reload:"true"`
+
+	// Outbound proxies yt-dlp runs go through, unless a domain policy sets
+	// its own: picked per request by "round-robin" or "least-failures",
+	// and set aside for ProxyQuarantine once a platform blocks them
+	Proxies         []string      `yaml:"proxies" reload:"true"`
+	ProxyStrategy   string        `yaml:"proxy_strategy" reload:"true"`
+	ProxyQuarantine time.Duration `yaml:"proxy_quarantine" reload:"true"`
+
+	// How often the cleaner sweeps, and the age of files it removes
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+	CleanupMaxAge   time.Duration `yaml:"cleanup_max_age"`
+
+	// OIDC bearer tokens for internal services
+	OIDCIssuer     string `yaml:"oidc_issuer"`
+	OIDCAudience   string `yaml:"oidc_audience"`
+	OIDCJWKSURL    string `yaml:"oidc_jwks_url"`
+	OIDCKeyFile    string `yaml:"oidc_key_file"`
+	OIDCScopeClaim string `yaml:"oidc_scope_claim"`
+	OIDCScopeMap   string `yaml:"oidc_scope_map"`
+	// Limits every token subject is held to, 0 for unlimited
+	OIDCRateLimit     int `yaml:"oidc_rate_limit" reload:"true"`
+	OIDCRateBurst     int `yaml:"oidc_rate_burst" reload:"true"`
+	OIDCMaxConcurrent int `yaml:"oidc_max_concurrent" reload:"true"`
+
+	// Separate listener for /metrics, e.g. "127.0.0.1:9090". Without one
+	// metrics are served on Port to admin keys only
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// Span exporter: "otlp", "stdout" or "none"
+	TracingExporter string `yaml:"tracing_exporter"`
+
+	// How long shutdown waits for running downloads and file transfers
+	// before canceling them
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Log level ("debug", "info", "warn", "error") and format ("text" or
+	// "json")
+	LogLevel  string `yaml:"log_level" reload:"true"`
+	LogFormat string `yaml:"log_format"`
+
+	// Result storage: "local" keeps finished files in TmpDir, "s3" uploads
+	// them to an S3-compatible bucket
+	StorageBackend string `yaml:"storage_backend"`
+	S3Endpoint     string `yaml:"s3_endpoint"`
+	S3Region       string `yaml:"s3_region"`
+	S3Bucket       string `yaml:"s3_bucket"`
+	S3AccessKey    string `yaml:"s3_access_key"`
+	S3SecretKey    string `yaml:"s3_secret_key"`
+	S3Prefix       string `yaml:"s3_prefix"`
+	S3PathStyle    bool   `yaml:"s3_path_style"`
+	// Directory under S3Prefix this server stores its results in and
+	// sweeps, so instances sharing a bucket leave each other's alone.
+	// Defaults to the host name
+	InstanceID string `yaml:"instance_id"`
+
+	// Signed download links returned instead of streaming the file
+	LinkSecret  string        `yaml:"link_secret"`
+	LinkTTL     time.Duration `yaml:"download_link_ttl" reload:"true"`
+	LinkMaxUses int           `yaml:"download_link_max_uses" reload:"true"`
+	LinkBindIP  bool          `yaml:"download_link_bind_ip" reload:"true"`
+	PublicURL   string        `yaml:"public_url" reload:"true"`
 }
 
 var defaultOrigins = []string{
@@ -41,49 +160,369 @@ var defaultDomains = []string{
 	"fal.media",
 }
 
-func Load() *Config {
+// Hosts serving plain media files, fetched directly instead of through yt-dlp
+var defaultDirectMediaDomains = []string{
+	"sirv.com",
+	"fal.media",
+	"v3.fal.media",
+}
+
+func defaults() *Config {
+	return &Config{
+		Port:                   "3000",
+		AllowedOrigins:         append([]string{}, defaultOrigins...),
+		AllowedDomains:         policy.FromDomains(defaultDomains),
+		DirectMediaDomains:     append([]string{}, defaultDirectMediaDomains...),
+		MaxDownloadSize:        "2G",
+		MinFreeDisk:            "1G",
+		TmpDir:                 "./tmp",
+		RateLimit:              3,
+		RateBurst:              3,
+		MaxConcurrentDownloads: 2,
+		DownloadTimeout:        10 * time.Minute,
+		DownloadAttempts:       3,
+		RetryBackoff:           time.Second,
+		RetryMaxBackoff:        30 * time.Second,
+		RetryOn:                []string{downloader.CodeTimeout, downloader.CodeUpstream},
+		BreakerThreshold:       5,
+		BreakerCooldown:        time.Minute,
+		ProxyStrategy:          proxy.RoundRobin,
+		ProxyQuarantine:        30 * time.Minute,
+		CleanupInterval:        5 * time.Minute,
+		CleanupMaxAge:          5 * time.Minute,
+		OIDCScopeClaim:         "scope",
+		OIDCRateLimit:          60,
+		OIDCRateBurst:          10,
+		OIDCMaxConcurrent:      4,
+		TracingExporter:        "none",
+		ShutdownTimeout:        5 * time.Minute,
+		LogLevel:               "info",
+		LogFormat:              "text",
+		StorageBackend:         "local",
+		S3Region:               "us-east-1",
+		S3PathStyle:            true,
+		InstanceID:             hostname(),
+		LinkTTL:                10 * time.Minute,
+		LinkMaxUses:            3,
+	}
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// Load reads the configuration and validates it. The error lists every
+// invalid setting.
+func Load() (*Config, error) {
 	godotenv.Load()
 
-	cfg := &Config{
-		Port:            getEnv("PORT", "3000"),
-		MaxDownloadSize: getEnv("MAX_DOWNLOAD_SIZE", "2G"),
-		CookiesFile:     os.Getenv("YTDLP_COOKIES"),
-		TmpDir:          getEnv("TMP_DIR", "./tmp"),
-		APIKey:          os.Getenv("API_KEY"),
-	}
-
-	// Parse allowed origins (env var adds to defaults)
-	cfg.AllowedOrigins = append([]string{}, defaultOrigins...)
-	if originsEnv := os.Getenv("ALLOWED_ORIGINS"); originsEnv != "" {
-		for _, origin := range strings.Split(originsEnv, ",") {
-			origin = strings.TrimSpace(origin)
-			// Add https:// if no protocol specified
-			if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
-				origin = "https://" + origin
-			}
-			cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+	cfg := defaults()
+	cfg.File = os.Getenv("CONFIG_FILE")
+	if cfg.File != "" {
+		if err := cfg.readFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &env{}
+	e.string("PORT", &cfg.Port)
+	e.string("METRICS_ADDR", &cfg.MetricsAddr)
+	e.string("MAX_DOWNLOAD_SIZE", &cfg.MaxDownloadSize)
+	e.string("MIN_FREE_DISK", &cfg.MinFreeDisk)
+	e.string("YTDLP_COOKIES", &cfg.CookiesFile)
+	e.string("TMP_DIR", &cfg.TmpDir)
+	e.string("STATE_DB", &cfg.StateDB)
+	e.string("API_KEY", &cfg.APIKey)
+	e.string("API_KEYS_FILE", &cfg.APIKeysFile)
+	e.int("RATE_LIMIT", &cfg.RateLimit)
+	e.int("RATE_BURST", &cfg.RateBurst)
+	e.int("MAX_CONCURRENT_DOWNLOADS", &cfg.MaxConcurrentDownloads)
+	e.duration("DOWNLOAD_TIMEOUT", &cfg.DownloadTimeout)
+	e.int("DOWNLOAD_ATTEMPTS", &cfg.DownloadAttempts)
+	e.duration("RETRY_BACKOFF", &cfg.RetryBackoff)
+	e.duration("RETRY_MAX_BACKOFF", &cfg.RetryMaxBackoff)
+	e.list("RETRY_ON", &cfg.RetryOn)
+	e.int("BREAKER_THRESHOLD", &cfg.BreakerThreshold)
+	e.duration("BREAKER_COOLDOWN", &cfg.BreakerCooldown)
+	e.list("PROXIES", &cfg.Proxies)
+	e.string("PROXY_STRATEGY", &cfg.ProxyStrategy)
+	e.duration("PROXY_QUARANTINE", &cfg.ProxyQuarantine)
+	e.duration("CLEANUP_INTERVAL", &cfg.CleanupInterval)
+	e.duration("CLEANUP_MAX_AGE", &cfg.CleanupMaxAge)
+	e.string("OIDC_ISSUER", &cfg.OIDCIssuer)
+	e.string("OIDC_AUDIENCE", &cfg.OIDCAudience)
+	e.string("OIDC_JWKS_URL", &cfg.OIDCJWKSURL)
+	e.string("OIDC_KEY_FILE", &cfg.OIDCKeyFile)
+	e.string("OIDC_SCOPE_CLAIM", &cfg.OIDCScopeClaim)
+	e.string("OIDC_SCOPE_MAP", &cfg.OIDCScopeMap)
+	e.int("OIDC_RATE_LIMIT", &cfg.OIDCRateLimit)
+	e.int("OIDC_RATE_BURST", &cfg.OIDCRateBurst)
+	e.int("OIDC_MAX_CONCURRENT", &cfg.OIDCMaxConcurrent)
+	e.string("TRACING_EXPORTER", &cfg.TracingExporter)
+	e.string("LOG_LEVEL", &cfg.LogLevel)
+	e.string("LOG_FORMAT", &cfg.LogFormat)
+	e.duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	e.string("STORAGE_BACKEND", &cfg.StorageBackend)
+	e.string("S3_ENDPOINT", &cfg.S3Endpoint)
+	e.string("S3_REGION", &cfg.S3Region)
+	e.string("S3_BUCKET", &cfg.S3Bucket)
+	e.string("S3_ACCESS_KEY", &cfg.S3AccessKey)
+	e.string("S3_SECRET_KEY", &cfg.S3SecretKey)
+	e.string("S3_PREFIX", &cfg.S3Prefix)
+	e.bool("S3_PATH_STYLE", &cfg.S3PathStyle)
+	e.string("INSTANCE_ID", &cfg.InstanceID)
+	e.string("LINK_SECRET", &cfg.LinkSecret)
+	e.duration("DOWNLOAD_LINK_TTL", &cfg.LinkTTL)
+	e.int("DOWNLOAD_LINK_MAX_USES", &cfg.LinkMaxUses)
+	e.bool("DOWNLOAD_LINK_BIND_IP", &cfg.LinkBindIP)
+	e.string("PUBLIC_URL", &cfg.PublicURL)
+	// Domains from the environment replace the file's policies
+	var domains []string
+	e.list("ALLOWED_DOMAINS", &domains)
+	if domains != nil {
+		cfg.AllowedDomains = policy.FromDomains(domains)
+	}
+	e.list("DIRECT_MEDIA_DOMAINS", &cfg.DirectMediaDomains)
+
+	// Origins from the environment add to those of the file or the
+	// defaults
+	var origins []string
+	e.list("ALLOWED_ORIGINS", &origins)
+	cfg.AllowedOrigins = append(cfg.AllowedOrigins, origins...)
+	for i, origin := range cfg.AllowedOrigins {
+		// Add https:// if no protocol specified
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			cfg.AllowedOrigins[i] = "https://" + origin
+		}
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+
+	// Job records live next to the files they describe by default; the dot
+	// keeps the database out of storage listings
+	if cfg.StateDB == "" {
+		cfg.StateDB = filepath.Join(cfg.TmpDir, ".viddl.db")
+	}
+
+	if err := errors.Join(append(e.errs, cfg.Validate())...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// readFile decodes the YAML file at path over c. Unknown keys are errors,
+// so typos don't silently leave defaults in place.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting and returns the problems found, joined.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port", "%q is not a port number", c.Port)
+	if c.MetricsAddr != "" {
+		_, metricsPort, err := net.SplitHostPort(c.MetricsAddr)
+		check(err == nil && metricsPort != c.Port, "metrics_addr", "%q is not a host:port other than port", c.MetricsAddr)
+	}
+	check(len(c.AllowedDomains) > 0, "allowed_domains", "must not be empty")
+	for _, domain := range c.DirectMediaDomains {
+		check(domain != "" && !strings.ContainsAny(domain, "/: "), "direct_media_domains", "%q is not a domain", domain)
+	}
+	maxBytes, _ := disk.ParseSize(c.MaxDownloadSize)
+	for _, p := range c.AllowedDomains {
+		key := fmt.Sprintf("allowed_domains[%s]", p.Domain)
+		if err := p.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		if p.MaxFileSize != "" {
+			size, err := disk.ParseSize(p.MaxFileSize)
+			check(err == nil, key, "max_download_size %q is not a size such as 500M or 2G", p.MaxFileSize)
+			check(err != nil || size <= maxBytes, key, "max_download_size %s is above the global %s", p.MaxFileSize, c.MaxDownloadSize)
+		}
+		if p.CookiesFile != "" {
+			_, err := os.Stat(p.CookiesFile)
+			check(err == nil, key, "%v", err)
 		}
+		check(p.Weight() <= c.RateBurst, key, "rate_weight %d is above rate_burst %d, requests would never be allowed", p.RateWeight, c.RateBurst)
+	}
+	for key, size := range map[string]string{"max_download_size": c.MaxDownloadSize, "min_free_disk": c.MinFreeDisk} {
+		_, err := disk.ParseSize(size)
+		check(err == nil, key, "%q is not a size such as 500M or 2G", size)
+	}
+	if c.CookiesFile != "" {
+		_, err := os.Stat(c.CookiesFile)
+		check(err == nil, "ytdlp_cookies", "%v", err)
 	}
 
-	// Parse allowed domains
-	domainsEnv := os.Getenv("ALLOWED_DOMAINS")
-	if domainsEnv != "" {
-		domains := strings.Split(domainsEnv, ",")
-		for i, domain := range domains {
-			domains[i] = strings.TrimSpace(domain)
+	names := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, j := range c.CookieJars {
+		key := fmt.Sprintf("cookie_jars[%s]", j.Name)
+		if err := j.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		check(!names[j.Name], key, "name is used by another jar")
+		check(!files[j.File], key, "file %s is used by another jar", j.File)
+		names[j.Name], files[j.File] = true, true
+	}
+	for i, u := range c.Proxies {
+		if err := proxy.CheckURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("proxies[%d]: %w", i, err))
 		}
-		cfg.AllowedDomains = domains
-	} else {
-		cfg.AllowedDomains = defaultDomains
 	}
+	check(slices.Contains(proxy.Strategies, c.ProxyStrategy), "proxy_strategy", "%q is not %s", c.ProxyStrategy, strings.Join(proxy.Strategies, " or "))
 
-	log.Printf("INFO: Configuration loaded - Port: %s, Domains: %v", cfg.Port, cfg.AllowedDomains)
-	return cfg
+	check(c.RateLimit > 0, "rate_limit", "must be at least 1 request per minute")
+	check(c.RateBurst > 0, "rate_burst", "must be at least 1")
+	check(c.MaxConcurrentDownloads > 0, "max_concurrent_downloads", "must be at least 1")
+	check(c.DownloadAttempts > 0, "download_attempts", "must be at least 1")
+	check(c.RetryMaxBackoff >= c.RetryBackoff, "retry_max_backoff", "must not be below retry_backoff %s", c.RetryBackoff)
+	for _, code := range c.RetryOn {
+		check(slices.Contains(downloader.RetryableCodes, code), "retry_on", "%q is not one of %s", code, strings.Join(downloader.RetryableCodes, ", "))
+	}
+	check(c.BreakerThreshold >= 0, "breaker_threshold", "must not be negative, use 0 to turn breakers off")
+	check(c.LinkMaxUses >= 0, "download_link_max_uses", "must not be negative, use 0 for unlimited")
+	for key, n := range map[string]int{
+		"oidc_rate_limit":     c.OIDCRateLimit,
+		"oidc_rate_burst":     c.OIDCRateBurst,
+		"oidc_max_concurrent": c.OIDCMaxConcurrent,
+	} {
+		check(n >= 0, key, "must not be negative, use 0 for unlimited")
+	}
+	for key, d := range map[string]time.Duration{
+		"download_timeout":  c.DownloadTimeout,
+		"cleanup_interval":  c.CleanupInterval,
+		"cleanup_max_age":   c.CleanupMaxAge,
+		"shutdown_timeout":  c.ShutdownTimeout,
+		"download_link_ttl": c.LinkTTL,
+		"proxy_quarantine":  c.ProxyQuarantine,
+		"retry_backoff":     c.RetryBackoff,
+		"breaker_cooldown":  c.BreakerCooldown,
+	} {
+		check(d > 0, key, "must be positive")
+	}
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log_level", "%q is not debug, info, warn or error", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format", "%q is not text or json", c.LogFormat)
+	check(c.TracingExporter == "otlp" || c.TracingExporter == "stdout" || c.TracingExporter == "none",
+		"tracing_exporter", "%q is not otlp, stdout or none", c.TracingExporter)
+	switch c.StorageBackend {
+	case "local":
+	case "s3":
+		check(c.S3Bucket != "", "s3_bucket", "required with the s3 storage backend")
+		check(c.InstanceID != "" && !strings.Contains(c.InstanceID, "/"), "instance_id", "must be set and not contain /")
+		// Results stay in the bucket until swept, they must outlive
+		// their links
+		check(c.CleanupMaxAge >= c.LinkTTL, "cleanup_max_age", "must not be below download_link_ttl %s with the s3 storage backend", c.LinkTTL)
+	default:
+		check(false, "storage_backend", "%q is not local or s3", c.StorageBackend)
+	}
+
+	// Map iteration above is unordered
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
 }
 
-func getEnv(key, defaultValue string) string {
+// RetryPolicy returns the retry policy of yt-dlp runs.
+func (c *Config) RetryPolicy() retry.Policy {
+	return retry.Policy{
+		Attempts:   c.DownloadAttempts,
+		Backoff:    c.RetryBackoff,
+		MaxBackoff: c.RetryMaxBackoff,
+		On:         c.RetryOn,
+	}
+}
+
+// Reload returns next with the settings that only take effect at startup
+// kept from c, and the keys of those that differ.
+func (c *Config) Reload(next *Config) (*Config, []string) {
+	merged := *next
+	cur := reflect.ValueOf(c).Elem()
+	out := reflect.ValueOf(&merged).Elem()
+	var ignored []string
+	for i := 0; i < out.NumField(); i++ {
+		field := out.Type().Field(i)
+		if field.Tag.Get("reload") == "true" {
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(), out.Field(i).Interface()) {
+			ignored = append(ignored, field.Tag.Get("yaml"))
+			out.Field(i).Set(cur.Field(i))
+		}
+	}
+	return &merged, ignored
+}
+
+// env overrides settings with environment variables, collecting the
+// errors of those that don't parse.
+type env struct {
+	errs []error
+}
+
+func (e *env) string(key string, v *string) {
+	if value := os.Getenv(key); value != "" {
+		*v = value
+	}
+}
+
+func (e *env) list(key string, v *[]string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		items[i] = strings.TrimSpace(item)
+	}
+	*v = items
+}
+
+func (e *env) int(key string, v *int) {
 	if value := os.Getenv(key); value != "" {
-		return value
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a number", key, value))
+			return
+		}
+		*v = n
+	}
+}
+
+func (e *env) bool(key string, v *bool) {
+	if value := os.Getenv(key); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not true or false", key, value))
+			return
+		}
+		*v = b
+	}
+}
+
+func (e *env) duration(key string, v *time.Duration) {
+	if value := os.Getenv(key); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not a duration such as 30s or 10m", key, value))
+			return
+		}
+		*v = d
 	}
-	return defaultValue
 }
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/policy"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "viddl.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	writeConfig(t, `
+port: "8080"
+allowed_origins: [viddl.me]
+allowed_domains: [youtube.com, vimeo.com]
+rate_limit: 10
+download_timeout: 20m
+download_link_bind_ip: true
+`)
+	t.Setenv("RATE_LIMIT", "5")
+	t.Setenv("ALLOWED_ORIGINS", "http://localhost:3000")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "8080" || cfg.DownloadTimeout != 20*time.Minute || !cfg.LinkBindIP {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if cfg.RateLimit != 5 {
+		t.Errorf("RateLimit = %d, want the environment's 5", cfg.RateLimit)
+	}
+	if want := []string{"https://viddl.me", "http://localhost:3000"}; !reflect.DeepEqual(cfg.AllowedOrigins, want) {
+		t.Errorf("AllowedOrigins = %v, want %v", cfg.AllowedOrigins, want)
+	}
+	if cfg.MaxConcurrentDownloads != 2 || cfg.MaxDownloadSize != "2G" {
+		t.Errorf("defaults not kept: %+v", cfg)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr []string
+	}{
+		{name: "unknown key", file: "rate_limt: 10\n", wantErr: []string{"field rate_limt not found"}},
+		{
+			name: "invalid values",
+			file: "port: http\nmetrics_addr: 9090\nrate_limit: 0\nmax_download_size: lots\nstorage_backend: s3\n",
+			env:  map[string]string{"DOWNLOAD_TIMEOUT": "soon"},
+			wantErr: []string{
+				`port: "http" is not a port number`,
+				`metrics_addr: "9090" is not a host:port other than port`,
+				"rate_limit: must be at least 1",
+				`max_download_size: "lots" is not a size`,
+				"s3_bucket: required",
+				`DOWNLOAD_TIMEOUT: "soon" is not a duration`,
+			},
+		},
+		{
+			name: "s3",
+			file: "storage_backend: s3\ns3_bucket: viddl\ninstance_id: web/1\ncleanup_max_age: 5m\ndownload_link_ttl: 10m\n",
+			wantErr: []string{
+				"instance_id: must be set and not contain /",
+				"cleanup_max_age: must not be below download_link_ttl 10m0s",
+			},
+		},
+		{
+			name: "proxies",
+			file: "proxies: [http://10.0.0.1:3128, ftp://10.0.0.2]\nproxy_strategy: random\n",
+			wantErr: []string{
+				"proxies[1]: proxy must be an http, https or socks URL",
+				`proxy_strategy: "random" is not round-robin or least-failures`,
+			},
+		},
+		{
+			name: "retries",
+			file: "retry_on: [timeout, private]\nretry_backoff: 10s\nretry_max_backoff: 5s\nbreaker_threshold: -1\n",
+			wantErr: []string{
+				`retry_on: "private" is not one of timeout, upstream_error, rate_limited, failed`,
+				"retry_max_backoff: must not be below retry_backoff 10s",
+				"breaker_threshold: must not be negative",
+			},
+		},
+		{
+			name: "cookie jars",
+			file: "cookie_jars:\n" +
+				"  - {name: yt, file: /nonexistent/yt.txt, domains: [youtube.com]}\n" +
+				"  - {name: yt, file: cookies.txt, domains: []}\n",
+			wantErr: []string{
+				"cookie_jars[yt]: directory of /nonexistent/yt.txt does not exist",
+				"cookie_jars[yt]: domains must not be empty",
+				"cookie_jars[yt]: name is used by another jar",
+			},
+		},
+		{name: "missing cookies", file: "ytdlp_cookies: /nonexistent/cookies.txt\n", wantErr: []string{"ytdlp_cookies:"}},
+		{
+			name: "domain policy",
+			file: "allowed_domains:\n  - domain: twitch.tv\n    max_download_size: 8G\n    rate_weight: 5\n",
+			wantErr: []string{
+				"allowed_domains[twitch.tv]: max_download_size 8G is above the global 2G",
+				"allowed_domains[twitch.tv]: rate_weight 5 is above rate_burst 3",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, tt.file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := Load()
+			if err == nil {
+				t.Fatal("Load() succeeded, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	cur := defaults()
+	next := defaults()
+	next.Port = "9000"
+	next.RateLimit = 10
+	next.AllowedDomains = policy.FromDomains([]string{"youtube.com"})
+
+	merged, ignored := cur.Reload(next)
+	if merged.Port != cur.Port {
+		t.Errorf("Port = %q, want it kept at %q until a restart", merged.Port, cur.Port)
+	}
+	if merged.RateLimit != 10 || len(merged.AllowedDomains) != 1 {
+		t.Errorf("reloadable settings not applied: %+v", merged)
+	}
+	if want := []string{"port"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("ignored = %v, want %v", ignored, want)
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often the config file is checked for changes.
+const watchInterval = 5 * time.Second
+
+// Watch reloads the configuration on SIGHUP and whenever the config file
+// changes, and calls apply with each valid result. Invalid configurations
+// are logged and leave cur in effect. It returns when ctx is done.
+func Watch(ctx context.Context, cur *Config, apply func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	modified := modTime(cur.File)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Reloading configuration on SIGHUP")
+		case <-ticker.C:
+			if cur.File == "" || modTime(cur.File).Equal(modified) {
+				continue
+			}
+			slog.Info("Reloading configuration, file changed", "file", cur.File)
+		}
+		modified = modTime(cur.File)
+
+		next, err := Load()
+		if err != nil {
+			slog.Error("Configuration not reloaded", "error", err)
+			continue
+		}
+		next, ignored := cur.Reload(next)
+		if len(ignored) > 0 {
+			slog.Warn("Changed settings take effect after a restart", "settings", ignored)
+		}
+		cur = next
+		apply(cur)
+		slog.Info("Configuration reloaded")
+	}
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,124 @@
+// Package cookies reads Netscape cookies files and rotates the cookie jars
+// yt-dlp logs in to platforms with.
+package cookies
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"viddl.me/backend/internal/models"
+)
+
+// Info summarizes a cookies file.
+type Info struct {
+	Entries int
+	Expired int
+	// When the last cookie expires, zero if a session cookie never does
+	Expires time.Time
+}
+
+// Parse reads a Netscape cookies file as yt-dlp does.
+func Parse(r io.Reader, now time.Time) (Info, error) {
+	var info Info
+	session := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// HttpOnly cookies are written as comments
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return Info{}, fmt.Errorf("cookies file line %d: want 7 tab-separated fields, got %d", n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return Info{}, fmt.Errorf("cookies file line %d: invalid expiry %q", n, fields[4])
+		}
+		info.Entries++
+		// 0 marks session cookies, which never expire in a file
+		if expires == 0 {
+			session = true
+			continue
+		}
+		t := time.Unix(expires, 0)
+		if t.Before(now) {
+			info.Expired++
+		}
+		if t.After(info.Expires) {
+			info.Expires = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Info{}, fmt.Errorf("reading cookies file: %w", err)
+	}
+	if info.Entries == 0 {
+		return Info{}, errors.New("cookies file has no cookies")
+	}
+	if session {
+		info.Expires = time.Time{}
+	}
+	return info, nil
+}
+
+// AllExpired reports whether every cookie has expired by now.
+func (i Info) AllExpired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// CheckUpload validates a cookies file before it replaces a jar: yt-dlp
+// refuses files without the Netscape header, and a file whose cookies have
+// all expired logs in nowhere.
+func CheckUpload(data []byte, now time.Time) (Info, error) {
+	first, _, _ := bytes.Cut(data, []byte("\n"))
+	first = bytes.TrimSpace(first)
+	if !bytes.Equal(first, []byte("# Netscape HTTP Cookie File")) && !bytes.Equal(first, []byte("# HTTP Cookie File")) {
+		if bytes.HasPrefix(first, []byte("[")) || bytes.HasPrefix(first, []byte("{")) {
+			return Info{}, errors.New("cookies file must be in Netscape format, not JSON")
+		}
+		return Info{}, errors.New(`cookies file must start with "# Netscape HTTP Cookie File"`)
+	}
+	info, err := Parse(bytes.NewReader(data), now)
+	if err != nil {
+		return Info{}, err
+	}
+	if info.AllExpired(now) {
+		return Info{}, errors.New("every cookie in the file has expired")
+	}
+	return info, nil
+}
+
+// Check reads the cookies file at path for health reports.
+func Check(path string) *models.CookiesStatus {
+	status := &models.CookiesStatus{}
+	f, err := os.Open(path)
+	if err != nil {
+		status.Error = "cookies file not readable"
+		return status
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		status.ModifiedAt = fi.ModTime()
+		status.Age = time.Since(fi.ModTime()).Round(time.Minute).String()
+	}
+
+	info, err := Parse(f, time.Now())
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Entries, status.Expired = info.Entries, info.Expired
+	status.Valid = true
+	return status
+}
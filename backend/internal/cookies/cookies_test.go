@@ -0,0 +1,74 @@
+package cookies
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	tests := []struct {
+		name        string
+		file        string
+		wantEntries int
+		wantExpired int
+		wantErr     string
+	}{
+		{
+			name: "valid",
+			file: "# Netscape HTTP Cookie File\n\n" +
+				".youtube.com\tTRUE\t/\tTRUE\t1900000000\tPREF\tf6=40000000\n" +
+				"#HttpOnly_.youtube.com\tTRUE\t/\tTRUE\t1700000000\tSID\tabc\r\n" +
+				".instagram.com\tTRUE\t/\tFALSE\t0\tcsrftoken\t\n",
+			wantEntries: 3,
+			wantExpired: 1,
+		},
+		{name: "empty", file: "# Netscape HTTP Cookie File\n", wantErr: "no cookies"},
+		{name: "spaces instead of tabs", file: ".youtube.com TRUE / TRUE 0 PREF x\n", wantErr: "line 1"},
+		{name: "bad expiry", file: "# header\n.x.com\tTRUE\t/\tTRUE\tsoon\tA\tb\n", wantErr: "line 2: invalid expiry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Parse(strings.NewReader(tt.file), now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || info.Entries != tt.wantEntries || info.Expired != tt.wantExpired {
+				t.Errorf("Parse() = %+v, %v, want %d entries, %d expired", info, err, tt.wantEntries, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestCheckUpload(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{name: "valid", file: "# Netscape HTTP Cookie File\n.youtube.com\tTRUE\t/\tTRUE\t1900000000\tSID\tabc\n"},
+		{name: "old header", file: "# HTTP Cookie File\n.youtube.com\tTRUE\t/\tTRUE\t0\tSID\tabc\n"},
+		{name: "json export", file: `[{"domain": ".youtube.com", "name": "SID"}]`, wantErr: "not JSON"},
+		{name: "no header", file: ".youtube.com\tTRUE\t/\tTRUE\t1900000000\tSID\tabc\n", wantErr: "must start with"},
+		{name: "all expired", file: "# Netscape HTTP Cookie File\n.youtube.com\tTRUE\t/\tTRUE\t1700000000\tSID\tabc\n", wantErr: "expired"},
+		{name: "bad line", file: "# Netscape HTTP Cookie File\n.youtube.com TRUE / TRUE 0 SID abc\n", wantErr: "line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CheckUpload([]byte(tt.file), now)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("CheckUpload() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("CheckUpload() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
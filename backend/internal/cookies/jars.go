@@ -0,0 +1,338 @@
+package cookies
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"viddl.me/backend/internal/metrics"
+	"viddl.me/backend/internal/models"
+)
+
+// ErrUnknownJar is returned for jar names that aren't configured.
+var ErrUnknownJar = errors.New("no such cookie jar")
+
+// Jar is a cookies file, usually of one account, for the platforms in
+// Domains. Jars sharing a domain take turns.
+type Jar struct {
+	Name    string   `yaml:"name"`
+	File    string   `yaml:"file"`
+	Domains []string `yaml:"domains"`
+}
+
+var jarName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate checks the jar on its own. The file may be missing until it is
+// uploaded, its directory may not.
+func (j Jar) Validate() error {
+	var errs []error
+	if !jarName.MatchString(j.Name) {
+		errs = append(errs, fmt.Errorf("name %q must be lower case letters, digits, - and _", j.Name))
+	}
+	if j.File == "" {
+		errs = append(errs, errors.New("file is required"))
+	} else if fi, err := os.Stat(filepath.Dir(j.File)); err != nil || !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("directory of %s does not exist", j.File))
+	}
+	if len(j.Domains) == 0 {
+		errs = append(errs, errors.New("domains must not be empty"))
+	}
+	for _, domain := range j.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			errs = append(errs, fmt.Errorf("%q is not a domain", domain))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matchLen returns the length of the longest of the jar's domains hostname
+// belongs to, or -1.
+func (j Jar) matchLen(hostname string) int {
+	best := -1
+	for _, domain := range j.Domains {
+		if (hostname == domain || strings.HasSuffix(hostname, "."+domain)) && len(domain) > best {
+			best = len(domain)
+		}
+	}
+	return best
+}
+
+// Messages of platforms that no longer accept a jar's login. Instagram's
+// "rate-limit reached or login required" is left out, it is sent for rate
+// limits just as well, and so is YouTube's "Sign in to confirm your age",
+// which is about the video.
+var loginMarkers = []string{
+	"cookies are no longer valid",
+	"You need to log in",
+	"requires authentication",
+	"only available for registered users",
+	"locked behind the login page",
+}
+
+// LoginRequired reports whether yt-dlp's stderr says the cookies it was
+// given don't log in.
+func LoginRequired(output string) bool {
+	for _, m := range loginMarkers {
+		if strings.Contains(output, m) {
+			return true
+		}
+	}
+	return false
+}
+
+type jar struct {
+	Jar
+	uses        int64
+	staleSince  *time.Time
+	staleReason string
+
+	// The file as last read, see refresh
+	modTime time.Time
+	info    Info
+	readErr error
+}
+
+// Pool hands out cookie jars by domain and tracks the stale ones. A nil
+// Pool has no jars.
+type Pool struct {
+	mu   sync.Mutex
+	jars []*jar
+	// Round-robin position per domain
+	next map[string]int
+	now  func() time.Time
+}
+
+func NewPool(jars []Jar) *Pool {
+	p := &Pool{now: time.Now}
+	p.Set(jars)
+	return p
+}
+
+// Set replaces the jars. Jars with the same name and file keep their use
+// count and staleness.
+func (p *Pool) Set(jars []Jar) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := make(map[string]*jar, len(p.jars))
+	for _, j := range p.jars {
+		old[j.Name] = j
+	}
+	list := make([]*jar, 0, len(jars))
+	for _, cfg := range jars {
+		if abs, err := filepath.Abs(cfg.File); err == nil {
+			cfg.File = abs
+		}
+		j, ok := old[cfg.Name]
+		if ok && j.File == cfg.File {
+			j.Domains = cfg.Domains
+			delete(old, cfg.Name)
+		} else {
+			j = &jar{Jar: cfg}
+			metrics.CookieJarStale.WithLabelValues(cfg.Name).Set(0)
+		}
+		list = append(list, j)
+	}
+	for name := range old {
+		if !slices.ContainsFunc(list, func(j *jar) bool { return j.Name == name }) {
+			metrics.CookieJarStale.DeleteLabelValues(name)
+		}
+	}
+	p.jars = list
+	p.next = make(map[string]int)
+}
+
+// refresh rereads the jar's file when it changed. yt-dlp only ever gets a
+// copy, so a changed file has been replaced and is no longer stale.
+func (p *Pool) refresh(j *jar) {
+	fi, err := os.Stat(j.File)
+	if err != nil {
+		j.readErr = err
+		return
+	}
+	if fi.ModTime().Equal(j.modTime) && j.readErr == nil {
+		return
+	}
+	j.modTime = fi.ModTime()
+	f, err := os.Open(j.File)
+	if err != nil {
+		j.readErr = err
+		return
+	}
+	defer f.Close()
+	j.info, j.readErr = Parse(f, p.now())
+	if j.readErr == nil && j.staleSince != nil {
+		j.staleSince, j.staleReason = nil, ""
+		metrics.CookieJarStale.WithLabelValues(j.Name).Set(0)
+		slog.Info("Cookie jar replaced, back in rotation", "jar", j.Name)
+	}
+}
+
+func (j *jar) usable(now time.Time) bool {
+	return j.readErr == nil && j.staleSince == nil && !j.info.AllExpired(now)
+}
+
+// Pick returns the cookies file for the next request to hostname, or ""
+// when no usable jar covers it. Jars of the most specific domain take
+// turns.
+func (p *Pool) Pick(hostname string) string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hostname = strings.TrimPrefix(strings.ToLower(hostname), "www.")
+	var candidates []*jar
+	best := -1
+	for _, j := range p.jars {
+		n := j.matchLen(hostname)
+		if n < 0 || n < best {
+			continue
+		}
+		if n > best {
+			best, candidates = n, nil
+		}
+		candidates = append(candidates, j)
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	// Candidates share their most specific matching domain
+	key := hostname
+	for _, domain := range candidates[0].Domains {
+		if len(domain) == best && (hostname == domain || strings.HasSuffix(hostname, "."+domain)) {
+			key = domain
+		}
+	}
+	now := p.now()
+	for i := range candidates {
+		idx := (p.next[key] + i) % len(candidates)
+		j := candidates[idx]
+		p.refresh(j)
+		if j.usable(now) {
+			p.next[key] = idx + 1
+			j.uses++
+			return j.File
+		}
+	}
+	return ""
+}
+
+// PickURL is Pick for the host of rawURL.
+func (p *Pool) PickURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return p.Pick(u.Hostname())
+}
+
+// MarkStale takes the jar with file out of rotation until the file is
+// replaced, and returns whether it did. Files of no jar are ignored.
+func (p *Pool) MarkStale(file, reason string) bool {
+	if p == nil || file == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := slices.IndexFunc(p.jars, func(j *jar) bool { return j.File == file })
+	if i < 0 || p.jars[i].staleSince != nil {
+		return false
+	}
+	j := p.jars[i]
+	// Staleness lasts until the file changes from the one read now
+	p.refresh(j)
+	now := p.now()
+	j.staleSince, j.staleReason = &now, reason
+	metrics.CookieJarStale.WithLabelValues(j.Name).Set(1)
+	slog.Warn("Cookie jar stale, upload a new cookies file", "jar", j.Name, "error", reason)
+	return true
+}
+
+// Replace writes data, which must have passed CheckUpload, as the file of
+// the named jar and puts the jar back in rotation.
+func (p *Pool) Replace(name string, data []byte) (models.CookieJarStatus, error) {
+	if p == nil {
+		return models.CookieJarStatus{}, ErrUnknownJar
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := slices.IndexFunc(p.jars, func(j *jar) bool { return j.Name == name })
+	if i < 0 {
+		return models.CookieJarStatus{}, ErrUnknownJar
+	}
+	j := p.jars[i]
+	if err := writeFile(j.File, data); err != nil {
+		return models.CookieJarStatus{}, err
+	}
+	// Force a reread, the modification time may not have moved
+	j.modTime = time.Time{}
+	p.refresh(j)
+	slog.Info("Cookie jar uploaded", "jar", j.Name, "cookies", j.info.Entries)
+	return p.status(j), nil
+}
+
+// writeFile replaces path in one rename, so yt-dlp never reads half a
+// file. Cookies are credentials, only the owner may read them.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Status describes every jar, in configuration order.
+func (p *Pool) Status() []models.CookieJarStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]models.CookieJarStatus, len(p.jars))
+	for i, j := range p.jars {
+		p.refresh(j)
+		list[i] = p.status(j)
+	}
+	return list
+}
+
+func (p *Pool) status(j *jar) models.CookieJarStatus {
+	status := models.CookieJarStatus{
+		Name:        j.Name,
+		Domains:     j.Domains,
+		Uses:        j.uses,
+		Stale:       j.staleSince != nil,
+		StaleSince:  j.staleSince,
+		StaleReason: j.staleReason,
+		File:        *Check(j.File),
+	}
+	if !status.Stale && status.File.Valid && j.info.AllExpired(p.now()) {
+		status.Stale, status.StaleReason = true, "every cookie has expired"
+	}
+	return status
+}
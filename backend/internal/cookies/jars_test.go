@@ -0,0 +1,94 @@
+package cookies
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const validFile = "# Netscape HTTP Cookie File\n.youtube.com\tTRUE\t/\tTRUE\t0\tSID\tabc\n"
+
+func newTestJars(t *testing.T) (*Pool, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"yt1.txt", "yt2.txt", "music.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(validFile), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewPool([]Jar{
+		{Name: "yt1", File: filepath.Join(dir, "yt1.txt"), Domains: []string{"youtube.com", "youtu.be"}},
+		{Name: "yt2", File: filepath.Join(dir, "yt2.txt"), Domains: []string{"youtube.com"}},
+		{Name: "music", File: filepath.Join(dir, "music.txt"), Domains: []string{"music.youtube.com"}},
+		{Name: "ig", File: filepath.Join(dir, "missing.txt"), Domains: []string{"instagram.com"}},
+	})
+	return p, dir
+}
+
+func TestPick(t *testing.T) {
+	p, dir := newTestJars(t)
+	yt1, yt2 := filepath.Join(dir, "yt1.txt"), filepath.Join(dir, "yt2.txt")
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.youtube.com", yt1},
+		{"m.youtube.com", yt2},
+		{"youtube.com", yt1},
+		{"music.youtube.com", filepath.Join(dir, "music.txt")},
+		{"youtu.be", yt1},
+		// The file hasn't been uploaded yet
+		{"instagram.com", ""},
+		{"vimeo.com", ""},
+	}
+	for _, tt := range tests {
+		if got := p.Pick(tt.host); got != tt.want {
+			t.Errorf("Pick(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMarkStale(t *testing.T) {
+	p, dir := newTestJars(t)
+	yt1, yt2 := filepath.Join(dir, "yt1.txt"), filepath.Join(dir, "yt2.txt")
+
+	// Age checks are about the video, not the jar's login
+	if LoginRequired("ERROR: [youtube] abc: Sign in to confirm your age. This video may be inappropriate for some users.") {
+		t.Error("LoginRequired() of an age check = true")
+	}
+	if !p.MarkStale(yt1, "The provided YouTube account cookies are no longer valid") {
+		t.Fatal("MarkStale() = false")
+	}
+	if p.MarkStale(filepath.Join(dir, "other.txt"), "") {
+		t.Error("MarkStale() of a file outside the jars = true")
+	}
+	for i := 0; i < 3; i++ {
+		if got := p.Pick("youtube.com"); got != yt2 {
+			t.Fatalf("Pick() = %q, want the other jar %q", got, yt2)
+		}
+	}
+
+	status, err := p.Replace("yt1", []byte(validFile))
+	if err != nil || status.Stale || !status.File.Valid {
+		t.Fatalf("Replace() = %+v, %v, want a valid jar back in rotation", status, err)
+	}
+	if info, err := os.Stat(yt1); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("replaced file = %v, %v, want mode 0600", info, err)
+	}
+	if got := [2]string{p.Pick("youtube.com"), p.Pick("youtube.com")}; got != [2]string{yt1, yt2} {
+		t.Errorf("Pick() after Replace = %v, want both jars", got)
+	}
+
+	if _, err := p.Replace("nope", []byte(validFile)); !errors.Is(err, ErrUnknownJar) {
+		t.Errorf("Replace() of an unknown jar error = %v, want ErrUnknownJar", err)
+	}
+	// Uploading the missing file brings the jar into use
+	if _, err := p.Replace("ig", []byte(validFile)); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Pick("instagram.com"); got != filepath.Join(dir, "missing.txt") {
+		t.Errorf("Pick() after upload = %q", got)
+	}
+}
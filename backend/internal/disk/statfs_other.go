@@ -0,0 +1,10 @@
+//go:build !unix
+
+package disk
+
+import "errors"
+
+// Free is not implemented on this platform; admission control is skipped.
+func Free(dir string) (int64, error) {
+	return 0, errors.New("free disk space not available on this platform")
+}
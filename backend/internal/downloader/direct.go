@@ -0,0 +1,242 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"viddl.me/backend/internal/models"
+)
+
+var mediaContentTypeExts = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"audio/mpeg":       ".mp3",
+	"audio/mp4":        ".m4a",
+	"audio/ogg":        ".ogg",
+	"audio/wav":        ".wav",
+	"audio/flac":       ".flac",
+}
+
+// directMedia describes a URL that serves a media file itself rather than a
+// page for yt-dlp to extract from.
+type directMedia struct {
+	ContentType string
+	Size        int64
+	FileName    string
+}
+
+// isDirectMediaHost reports whether the URL belongs to a host configured
+// as serving plain media files.
+func (d *Downloader) isDirectMediaHost(mediaURL string) bool {
+	parsedURL, err := url.Parse(mediaURL)
+	if err != nil {
+		return false
+	}
+	return hostAllowed(parsedURL.Hostname(), d.current().directDomains)
+}
+
+// directClient is the HTTP client for direct media fetches. It follows
+// redirects only within the direct media domains, a listed host must not
+// bounce fetches to arbitrary origins.
+func (d *Downloader) directClient() *http.Client {
+	client := *d.httpClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !d.isDirectMediaHost(req.URL.String()) {
+			return fmt.Errorf("redirect to %s is outside the direct media domains", req.URL.Hostname())
+		}
+		return nil
+	}
+	return &client
+}
+
+// probeDirectMedia checks whether mediaURL is a plain media file. It asks
+// with HEAD first and falls back to sniffing the first bytes of a ranged GET
+// when the server refuses HEAD or answers with a generic content type. A nil
+// result without error means the URL is not direct media.
+func (d *Downloader) probeDirectMedia(ctx context.Context, mediaURL string) (*directMedia, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.directClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		contentType := headerContentType(resp.Header)
+		if isMediaContentType(contentType) {
+			return &directMedia{
+				ContentType: contentType,
+				Size:        resp.ContentLength,
+				FileName:    directFileName(mediaURL, resp.Header, contentType),
+			}, nil
+		}
+		if contentType != "" && contentType != "application/octet-stream" && contentType != "binary/octet-stream" {
+			return nil, nil
+		}
+	}
+
+	return d.sniffDirectMedia(ctx, mediaURL)
+}
+
+func (d *Downloader) sniffDirectMedia(ctx context.Context, mediaURL string) (*directMedia, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-511")
+	resp, err := d.directClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("probe returned status %d", resp.StatusCode)
+	}
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if err != nil {
+		return nil, err
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !isMediaContentType(contentType) {
+		return nil, nil
+	}
+
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		size = contentRangeTotal(resp.Header.Get("Content-Range"))
+	}
+	return &directMedia{
+		ContentType: contentType,
+		Size:        size,
+		FileName:    directFileName(mediaURL, resp.Header, contentType),
+	}, nil
+}
+
+// directInfo builds video info for a direct media file without running
+// yt-dlp.
+func directInfo(media *directMedia) *models.VideoInfo {
+	ext := strings.TrimPrefix(filepath.Ext(media.FileName), ".")
+	mediaType := strings.SplitN(media.ContentType, "/", 2)[0]
+	return &models.VideoInfo{
+		Title:     strings.TrimSuffix(media.FileName, filepath.Ext(media.FileName)),
+		MediaType: mediaType,
+		Formats: []models.FormatInfo{{
+			FormatID: "best",
+			Ext:      ext,
+			Quality:  "original",
+			Filesize: media.Size,
+		}},
+	}
+}
+
+// downloadDirect fetches a direct media file into the session directory,
+// keeping the type the server reported or that was sniffed while probing.
+func (d *Downloader) downloadDirect(ctx context.Context, mediaURL string, media *directMedia, dir string) (*DownloadResult, error) {
+	maxBytes := d.maxBytesOf(d.policyFor(mediaURL))
+	if media.Size > maxBytes {
+		return nil, ErrTooLarge
+	}
+
+	filePath := filepath.Join(dir, media.FileName)
+	tmpPath := filePath + ".part"
+
+	slog.InfoContext(ctx, "Fetching direct media", "content_type", media.ContentType, "size", media.Size)
+	contentType, size, err := d.fetchToFile(ctx, d.directClient(), mediaURL, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		slog.ErrorContext(ctx, "Direct media fetch failed", "error", err)
+		if errors.Is(err, ErrTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("download failed")
+	}
+	// Servers don't always announce the size
+	if size > maxBytes {
+		os.Remove(tmpPath)
+		return nil, ErrTooLarge
+	}
+	if !isMediaContentType(contentType) {
+		contentType = media.ContentType
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Downloaded file", "size", size)
+	return &DownloadResult{
+		FilePath:    filePath,
+		FileName:    media.FileName,
+		FileSize:    size,
+		ContentType: contentType,
+	}, nil
+}
+
+func isMediaContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "audio/") ||
+		strings.HasPrefix(contentType, "image/")
+}
+
+func headerContentType(header http.Header) string {
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return contentType
+}
+
+// directFileName picks a download name from Content-Disposition or the URL
+// path, adding an extension for the content type when the name has none.
+func directFileName(mediaURL string, header http.Header, contentType string) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if parsedURL, err := url.Parse(mediaURL); err == nil {
+			name = path.Base(parsedURL.Path)
+		}
+	}
+	name = safeFilename(name)
+
+	ext, ok := mediaContentTypeExts[contentType]
+	if !ok {
+		ext = imageContentTypeExts[contentType]
+	}
+	if ext != "" && filepath.Ext(name) == "" {
+		name += ext
+	}
+	return name
+}
+
+func contentRangeTotal(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
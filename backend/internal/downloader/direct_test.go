@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/retry"
+)
+
+// mp4Header is the start of an ISO BMFF file as served by media CDNs.
+var mp4Header = []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+
+func newDirectMediaServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	webm := append([]byte("\x1a\x45\xdf\xa3"), make([]byte, 60)...)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/clip.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Length", "24")
+			if r.Method == http.MethodGet {
+				w.Write(mp4Header)
+			}
+		case "/files/abc123":
+			// Object store serving a generic type and refusing HEAD
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="render output.webm"`)
+			w.Write(webm)
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html><video src=clip.mp4></video></html>"))
+		case "/moved.mp4":
+			http.Redirect(w, r, "/clip.mp4", http.StatusFound)
+		case "/elsewhere.mp4":
+			// The same server under a host name that isn't listed
+			_, port, _ := net.SplitHostPort(r.Host)
+			http.Redirect(w, r, "http://localhost:"+port+"/clip.mp4", http.StatusFound)
+		case "/big.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write(append(mp4Header, []byte(strings.Repeat("x", 1024))...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProbeDirectMedia(t *testing.T) {
+	srv := newDirectMediaServer(t)
+	d := &Downloader{httpClient: srv.Client()}
+
+	tests := []struct {
+		name         string
+		path         string
+		wantType     string
+		wantFileName string
+		wantNil      bool
+	}{
+		{name: "head with video content type", path: "/clip.mp4", wantType: "video/mp4", wantFileName: "clip.mp4"},
+		{name: "head refused, sniffed from body", path: "/files/abc123", wantType: "video/webm", wantFileName: "render_output.webm"},
+		{name: "html page is not direct media", path: "/page", wantNil: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media, err := d.probeDirectMedia(context.Background(), srv.URL+tt.path)
+			if err != nil {
+				t.Fatalf("probeDirectMedia() error = %v", err)
+			}
+			if tt.wantNil {
+				if media != nil {
+					t.Errorf("probeDirectMedia() = %+v, want nil", media)
+				}
+				return
+			}
+			if media == nil {
+				t.Fatal("probeDirectMedia() = nil, want media")
+			}
+			if media.ContentType != tt.wantType {
+				t.Errorf("ContentType = %q, want %q", media.ContentType, tt.wantType)
+			}
+			if media.FileName != tt.wantFileName {
+				t.Errorf("FileName = %q, want %q", media.FileName, tt.wantFileName)
+			}
+		})
+	}
+}
+
+func TestDownloadDirect(t *testing.T) {
+	srv := newDirectMediaServer(t)
+
+	t.Run("writes into session directory with served content type", func(t *testing.T) {
+		d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20, httpClient: srv.Client()}
+		mediaURL := srv.URL + "/files/abc123"
+
+		media, err := d.probeDirectMedia(context.Background(), mediaURL)
+		if err != nil || media == nil {
+			t.Fatalf("probeDirectMedia() = %v, %v", media, err)
+		}
+		result, err := d.downloadDirect(context.Background(), mediaURL, media, d.tmpDir)
+		if err != nil {
+			t.Fatalf("downloadDirect() error = %v", err)
+		}
+
+		if result.ContentType != "video/webm" {
+			t.Errorf("ContentType = %q, want video/webm", result.ContentType)
+		}
+		if result.FileName != "render_output.webm" {
+			t.Errorf("FileName = %q, want render_output.webm", result.FileName)
+		}
+		if want := filepath.Join(d.tmpDir, "render_output.webm"); result.FilePath != want {
+			t.Errorf("FilePath = %q, want %q", result.FilePath, want)
+		}
+		info, err := os.Stat(result.FilePath)
+		if err != nil || info.Size() != result.FileSize {
+			t.Errorf("file on disk = %v, %v, want %d bytes", info, err, result.FileSize)
+		}
+	})
+
+	t.Run("enforces size cap while streaming", func(t *testing.T) {
+		d := &Downloader{tmpDir: t.TempDir(), maxBytes: 512, httpClient: srv.Client()}
+		media := &directMedia{ContentType: "video/mp4", Size: -1, FileName: "big.mp4"}
+
+		if _, err := d.downloadDirect(context.Background(), srv.URL+"/big.mp4", media, d.tmpDir); err == nil {
+			t.Fatal("downloadDirect() error = nil, want size limit error")
+		}
+		entries, _ := os.ReadDir(d.tmpDir)
+		if len(entries) != 0 {
+			t.Errorf("tmp dir has %d leftover files, want 0", len(entries))
+		}
+	})
+}
+
+func TestDirectMediaRedirects(t *testing.T) {
+	srv := newDirectMediaServer(t)
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20, httpClient: srv.Client()}
+	d.Configure("", []string{"127.0.0.1"}, nil, time.Minute, retry.Policy{})
+
+	if media, err := d.probeDirectMedia(context.Background(), srv.URL+"/moved.mp4"); err != nil || media == nil {
+		t.Errorf("probeDirectMedia() through a listed redirect = %v, %v, want media", media, err)
+	}
+	if media, err := d.probeDirectMedia(context.Background(), srv.URL+"/elsewhere.mp4"); err == nil {
+		t.Errorf("probeDirectMedia() through an unlisted redirect = %+v, want an error", media)
+	}
+	media := &directMedia{ContentType: "video/mp4", Size: -1, FileName: "clip.mp4"}
+	if _, err := d.downloadDirect(context.Background(), srv.URL+"/elsewhere.mp4", media, d.tmpDir); err == nil {
+		t.Error("downloadDirect() through an unlisted redirect error = nil")
+	}
+}
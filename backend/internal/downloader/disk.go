@@ -0,0 +1,93 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"viddl.me/backend/internal/disk"
+)
+
+var (
+	// ErrDiskFull means the disk cannot fit another download even once the
+	// running ones finish.
+	ErrDiskFull = &Error{Code: CodeDiskFull, Message: "server is out of disk space, please try again later", Retryable: true, RetryAfter: 5 * time.Minute}
+	// ErrDiskBusy means running downloads have reserved the free space.
+	ErrDiskBusy = &Error{Code: CodeDiskBusy, Message: "server is busy, please try again shortly", Retryable: true, RetryAfter: time.Minute}
+)
+
+// DiskUsage describes space in the download directory.
+type DiskUsage struct {
+	Free     int64 `json:"free"`
+	Used     int64 `json:"used"`
+	Reserved int64 `json:"reserved"`
+	MinFree  int64 `json:"min_free"`
+}
+
+// reserve admits a job if the disk can hold need bytes, its largest
+// possible output, on top of what running jobs have reserved, keeping
+// minFree spare. Reserving the full size limit is pessimistic, bytes a
+// running job has already written count against free space and its
+// reservation alike.
+func (d *Downloader) reserve(ctx context.Context, need int64) (func(), error) {
+	free, err := d.freeSpace(d.tmpDir)
+	if err != nil {
+		slog.WarnContext(ctx, "Cannot check free disk space, admitting download", "error", err)
+		return func() {}, nil
+	}
+
+	d.diskMu.Lock()
+	defer d.diskMu.Unlock()
+
+	if free < need+d.minFree {
+		slog.WarnContext(ctx, "Rejecting download, disk full", "free_bytes", free)
+		return nil, ErrDiskFull
+	}
+	if free < d.reserved+need+d.minFree {
+		slog.WarnContext(ctx, "Rejecting download, disk space reserved", "free_bytes", free, "reserved_bytes", d.reserved)
+		return nil, ErrDiskBusy
+	}
+	d.reserved += need
+
+	released := false
+	return func() {
+		d.diskMu.Lock()
+		defer d.diskMu.Unlock()
+		if !released {
+			d.reserved -= need
+			released = true
+		}
+	}, nil
+}
+
+// DiskUsage reports free, used and reserved bytes in the download directory.
+func (d *Downloader) DiskUsage() (DiskUsage, error) {
+	free, err := d.freeSpace(d.tmpDir)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	used, err := disk.Used(d.tmpDir)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+
+	d.diskMu.Lock()
+	defer d.diskMu.Unlock()
+	return DiskUsage{Free: free, Used: used, Reserved: d.reserved, MinFree: d.minFree}, nil
+}
+
+// Shortfall returns how many bytes must be freed before another download
+// can be admitted, or 0 if there is room.
+func (d *Downloader) Shortfall() int64 {
+	free, err := d.freeSpace(d.tmpDir)
+	if err != nil {
+		return 0
+	}
+
+	d.diskMu.Lock()
+	defer d.diskMu.Unlock()
+	if short := d.reserved + d.maxBytes + d.minFree - free; short > 0 {
+		return short
+	}
+	return 0
+}
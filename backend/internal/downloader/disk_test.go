@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReserve(t *testing.T) {
+	const gb = 1 << 30
+	free := int64(4 * gb)
+	d := &Downloader{
+		maxBytes:  2 * gb,
+		minFree:   gb,
+		freeSpace: func(string) (int64, error) { return free, nil },
+	}
+
+	release, err := d.reserve(context.Background(), d.maxBytes)
+	if err != nil {
+		t.Fatalf("first reserve: %v", err)
+	}
+	if _, err := d.reserve(context.Background(), d.maxBytes); !errors.Is(err, ErrDiskBusy) {
+		t.Fatalf("second reserve: got %v, want ErrDiskBusy", err)
+	}
+	if got := d.Shortfall(); got != gb {
+		t.Errorf("Shortfall = %d, want %d", got, gb)
+	}
+
+	release()
+	release() // releasing twice must not free the reservation twice
+	if d.reserved != 0 {
+		t.Errorf("reserved = %d after release, want 0", d.reserved)
+	}
+
+	free = 2 * gb
+	if _, err := d.reserve(context.Background(), d.maxBytes); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("reserve on full disk: got %v, want ErrDiskFull", err)
+	}
+}
@@ -0,0 +1,150 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/proxy"
+)
+
+// Codes of Error. They are part of the API, clients switch on them.
+const (
+	CodePrivate           = "private"
+	CodeAgeRestricted     = "age_restricted"
+	CodeGeoBlocked        = "geo_blocked"
+	CodeRemoved           = "removed"
+	CodeLoginRequired     = "login_required"
+	CodeRateLimited       = "rate_limited"
+	CodeTooLarge          = "too_large"
+	CodeTooLong           = "too_long"
+	CodeUnsupportedURL    = "unsupported_url"
+	CodeFormatUnavailable = "format_unavailable"
+	CodeTimeout           = "timeout"
+	CodeUpstream          = "upstream_error"
+	CodeLiveStream        = "live_stream"
+	CodeNotLive           = "not_live"
+	CodeUpcoming          = "upcoming"
+	CodeNotStarted        = "not_started"
+	CodeDiskFull          = "disk_full"
+	CodeDiskBusy          = "disk_busy"
+	CodeCanceled          = "canceled"
+	// The platform's breaker is open, see retry.Breakers
+	CodePlatformUnavailable = "platform_unavailable"
+	// The requested item of a post is missing or of the wrong kind
+	CodeInvalidItem = "invalid_item"
+	// A failure nothing more is known about
+	CodeFailed = "failed"
+)
+
+// Error is a download or lookup failure classified by its cause. Message
+// is meant for users, yt-dlp's own output stays in the logs.
+type Error struct {
+	Code    string
+	Message string
+	// Whether the same request may succeed when tried again, after
+	// RetryAfter if that is set
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrPrivate           = &Error{Code: CodePrivate, Message: "this video is private"}
+	ErrAgeRestricted     = &Error{Code: CodeAgeRestricted, Message: "this video is age-restricted and needs a logged-in account"}
+	ErrGeoBlocked        = &Error{Code: CodeGeoBlocked, Message: "this video is not available in the server's country"}
+	ErrRemoved           = &Error{Code: CodeRemoved, Message: "this video has been removed or does not exist"}
+	ErrLoginRequired     = &Error{Code: CodeLoginRequired, Message: "this video is only available to logged-in accounts"}
+	ErrRateLimited       = &Error{Code: CodeRateLimited, Message: "the platform is rate-limiting the server, please try again later", Retryable: true, RetryAfter: 5 * time.Minute}
+	ErrTooLarge          = &Error{Code: CodeTooLarge, Message: "file exceeds size limit"}
+	ErrUnsupportedURL    = &Error{Code: CodeUnsupportedURL, Message: "no downloadable media found at this URL"}
+	ErrFormatUnavailable = &Error{Code: CodeFormatUnavailable, Message: "the requested format is not available"}
+	ErrTimeout           = &Error{Code: CodeTimeout, Message: "the platform took too long to respond", Retryable: true}
+	ErrUpstream          = &Error{Code: CodeUpstream, Message: "the platform failed to respond, please try again", Retryable: true}
+)
+
+// Messages yt-dlp prints for each class of failure, in the order they are
+// checked: a private video's message also asks for cookies, an age check's
+// also asks to sign in, and geo blocks start with "Video unavailable".
+// Rate limits and bot checks are told by proxy.Blocked before these.
+var classes = []struct {
+	err     *Error
+	markers []string
+	// Checked besides markers
+	match func(output string) bool
+}{
+	{err: ErrTimeout, markers: []string{"timed out"}},
+	{err: ErrUpstream, markers: []string{
+		"HTTP Error 5",
+		"Connection reset",
+		"Connection refused",
+		"Remote end closed connection",
+		"Temporary failure in name resolution",
+		"IncompleteRead",
+	}},
+	{err: ErrTooLarge, markers: []string{"File is larger than max-filesize"}},
+	{err: ErrPrivate, markers: []string{"Private video", "This video is private", "protected by a password"}},
+	{err: ErrAgeRestricted, markers: []string{"confirm your age", "age-restricted", "inappropriate for some users"}},
+	{err: ErrGeoBlocked, markers: []string{
+		"not made this video available in your country",
+		"blocked it in your country",
+		"not available from your location",
+		"geo restriction",
+	}},
+	{err: ErrLoginRequired, markers: []string{"members-only content", "login required"}, match: cookies.LoginRequired},
+	{err: ErrRemoved, markers: []string{
+		"Video unavailable",
+		"has been removed",
+		"no longer available",
+		"No status found with that ID",
+		"HTTP Error 404",
+	}},
+	{err: ErrFormatUnavailable, markers: []string{"Requested format is not available", "No video formats found"}},
+	{err: ErrUnsupportedURL, markers: []string{"Unsupported URL", "No video could be found in this tweet"}},
+}
+
+// classify maps yt-dlp's output of a failed run onto an Error, or returns
+// nil when the output is about nothing known.
+func classify(output string) *Error {
+	if proxy.Blocked(output) {
+		return ErrRateLimited
+	}
+	for _, class := range classes {
+		if class.match != nil && class.match(output) {
+			return class.err
+		}
+		for _, m := range class.markers {
+			if strings.Contains(output, m) {
+				return class.err
+			}
+		}
+	}
+	return nil
+}
+
+// runError is the error of a yt-dlp run under ctx that failed with output,
+// or one with fallback as message when its cause is unknown.
+func runError(ctx context.Context, output []byte, fallback string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if err := classify(string(output)); err != nil {
+		return err
+	}
+	return &Error{Code: CodeFailed, Message: fallback, Retryable: true}
+}
+
+// AsError returns the Error err is or wraps. Other errors become an
+// unclassified one with err's message.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeFailed, Message: err.Error(), Retryable: true}
+}
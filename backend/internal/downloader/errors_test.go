@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClassify runs the stderr samples in testdata/stderr, named after the
+// code they must be classified as. "failed" samples are not classified.
+func TestClassify(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "stderr", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no stderr samples: %v", err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		want, _, _ := strings.Cut(name, "-")
+		t.Run(name, func(t *testing.T) {
+			output, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := CodeFailed
+			if e := classify(string(output)); e != nil {
+				got = e.Code
+			}
+			if got != want {
+				t.Errorf("classify() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRunError(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if err := runError(expired, nil, "download failed"); err != ErrTimeout {
+		t.Errorf("runError() after the deadline = %v, want ErrTimeout", err)
+	}
+
+	err := runError(context.Background(), []byte("ERROR: something new"), "download failed")
+	if e := AsError(err); e.Code != CodeFailed || e.Message != "download failed" {
+		t.Errorf("runError() = %+v, want the fallback message", e)
+	}
+
+	wrapped := fmt.Errorf("failed to fetch item 2: %w", ErrTooLarge)
+	if e := AsError(wrapped); e != ErrTooLarge {
+		t.Errorf("AsError(wrapped) = %+v, want ErrTooLarge", e)
+	}
+	if e := AsError(errors.New("boom")); e.Code != CodeFailed || e.Message != "boom" {
+		t.Errorf("AsError(plain) = %+v, want an unclassified error", e)
+	}
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/models"
+)
+
+// toolCheckTTL is how long a tool check is trusted, so installs and
+// upgrades are noticed without running the tool on every probe.
+const toolCheckTTL = time.Minute
+
+// toolCheck caches the status of a tool. Concurrent callers share one run.
+type toolCheck struct {
+	mu     sync.Mutex
+	status models.ToolStatus
+}
+
+func (t *toolCheck) get(run func() models.ToolStatus) models.ToolStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status.CheckedAt.IsZero() || time.Since(t.status.CheckedAt) >= toolCheckTTL {
+		t.status = run()
+	}
+	return t.status
+}
+
+// YtDlpStatus reports whether yt-dlp runs and its version.
+func (d *Downloader) YtDlpStatus() models.ToolStatus {
+	return d.ytdlpCheck.get(func() models.ToolStatus {
+		return d.toolVersion(firstLine, "yt-dlp", "--version")
+	})
+}
+
+// FFmpegStatus reports whether ffmpeg, which yt-dlp needs for merging and
+// audio extraction, runs and its version.
+func (d *Downloader) FFmpegStatus() models.ToolStatus {
+	return d.ffmpegCheck.get(func() models.ToolStatus {
+		return d.toolVersion(func(out string) string {
+			// "ffmpeg version 6.1.1-3ubuntu5 Copyright ..."
+			if f := strings.Fields(firstLine(out)); len(f) >= 3 && f[1] == "version" {
+				return f[2]
+			}
+			return firstLine(out)
+		}, "ffmpeg", "-version")
+	})
+}
+
+func (d *Downloader) toolVersion(version func(out string) string, name string, args ...string) models.ToolStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status := models.ToolStatus{CheckedAt: time.Now()}
+	out, err := d.command(ctx, "", name, args...).Output()
+	if err != nil {
+		status.Error = fmt.Sprintf("%s not available: %v", name, err)
+		return status
+	}
+	status.Available = true
+	status.Version = version(string(out))
+	return status
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
+
+// TmpDirStatus checks that the tmp directory is writable and whether a new
+// download would fit on its disk.
+func (d *Downloader) TmpDirStatus() models.TmpDirStatus {
+	var status models.TmpDirStatus
+	f, err := os.CreateTemp(d.tmpDir, ".health_check-*")
+	if err != nil {
+		status.Error = "tmp directory not writable"
+		return status
+	}
+	f.Close()
+	os.Remove(f.Name())
+	status.Writable = true
+
+	free, err := d.freeSpace(d.tmpDir)
+	if err != nil {
+		status.Error = fmt.Sprintf("cannot check free disk space: %v", err)
+		return status
+	}
+	d.diskMu.Lock()
+	reserved := d.reserved
+	d.diskMu.Unlock()
+
+	status.Free = free
+	status.Reserved = reserved
+	status.MinFree = d.minFree
+	status.Full = free < reserved+d.maxBytes+d.minFree
+	return status
+}
+
+// CookiesStatus checks that the cookies file parses and reports its age,
+// or returns nil when no cookies file is configured.
+func (d *Downloader) CookiesStatus() *models.CookiesStatus {
+	cookiesFile := d.current().cookiesFile
+	if cookiesFile == "" {
+		return nil
+	}
+	return cookies.Check(cookiesFile)
+}
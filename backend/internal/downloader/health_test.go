@@ -0,0 +1,41 @@
+package downloader
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/models"
+)
+
+func TestToolCheckCached(t *testing.T) {
+	var check toolCheck
+	var runs atomic.Int32
+	run := func() models.ToolStatus {
+		runs.Add(1)
+		return models.ToolStatus{Available: true, Version: "2024.08.06", CheckedAt: time.Now()}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s := check.get(run); s.Version != "2024.08.06" {
+				t.Errorf("get() = %+v", s)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Errorf("version command ran %d times, want 1", n)
+	}
+
+	// Stale results are checked again
+	check.status.CheckedAt = time.Now().Add(-toolCheckTTL)
+	check.get(run)
+	if n := runs.Load(); n != 2 {
+		t.Errorf("version command ran %d times after TTL, want 2", n)
+	}
+}
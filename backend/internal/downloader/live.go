@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxLiveDuration caps how long a single live recording may run.
+const MaxLiveDuration = 30 * time.Minute
+
+var (
+	ErrLiveStream = &Error{Code: CodeLiveStream, Message: "video is a live stream, choose a recording mode to download it"}
+	ErrNotLive    = &Error{Code: CodeNotLive, Message: "stream is not live anymore, download it as a regular video"}
+	ErrUpcoming   = &Error{Code: CodeUpcoming, Message: "stream has not started yet"}
+	ErrNotStarted = &Error{Code: CodeNotStarted, Message: "channel is not currently live"}
+)
+
+// LiveOptions controls how a live stream is recorded. The zero value
+// refuses live streams so a pasted live URL fails fast instead of
+// recording until the download timeout.
+type LiveOptions struct {
+	FromStart bool
+	Duration  time.Duration
+}
+
+func (l LiveOptions) enabled() bool {
+	return l.Duration > 0
+}
+
+// args returns the yt-dlp flags for recording a live stream. Recording from
+// now hands the stream to ffmpeg with an output duration; recording from the
+// start uses YouTube's DVR window and trims to the requested section.
+func (l LiveOptions) args() []string {
+	if !l.enabled() {
+		return nil
+	}
+	seconds := int(l.Duration.Seconds())
+	if l.FromStart {
+		return []string{"--live-from-start", "--download-sections", fmt.Sprintf("*0-%d", seconds)}
+	}
+	return []string{"--downloader", "ffmpeg", "--downloader-args", fmt.Sprintf("ffmpeg_o:-t %d", seconds)}
+}
+
+// filter returns the --match-filters condition that keeps yt-dlp from
+// downloading a stream in the wrong mode.
+func (l LiveOptions) filter() string {
+	if l.enabled() {
+		return "is_live"
+	}
+	return "!is_live"
+}
+
+// supportsLiveFromStart reports whether yt-dlp can download the given
+// platform's live streams from the beginning.
+func supportsLiveFromStart(videoURL string) bool {
+	return strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
+		strings.Contains(strings.ToLower(videoURL), "youtu.be")
+}
+
+// liveError maps yt-dlp output for live and scheduled streams onto the
+// matching sentinel error, or nil if the output is about something else.
+// A "does not pass filter" skip means the stream was refused by the filter
+// from LiveOptions.filter.
+func liveError(output string, live LiveOptions) error {
+	switch {
+	case strings.Contains(output, "Premieres in"),
+		strings.Contains(output, "This live event will begin"):
+		return ErrUpcoming
+	case strings.Contains(output, "is not currently live"):
+		return ErrNotStarted
+	case strings.Contains(output, "does not pass filter"):
+		return filterSkipError(live)
+	}
+	return nil
+}
+
+// filterSkipError is the error for a video refused by the filter from
+// LiveOptions.filter.
+func filterSkipError(live LiveOptions) error {
+	if live.enabled() {
+		return ErrNotLive
+	}
+	return ErrLiveStream
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLiveError(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		live   LiveOptions
+		want   error
+	}{
+		{
+			name:   "youtube premiere",
+			output: "ERROR: [youtube] abc123: Premieres in 5 hours",
+			want:   ErrUpcoming,
+		},
+		{
+			name:   "youtube scheduled live event",
+			output: "ERROR: [youtube] abc123: This live event will begin in 2 days.",
+			want:   ErrUpcoming,
+		},
+		{
+			name:   "twitch channel offline",
+			output: "ERROR: [twitch:stream] somechannel: The channel is not currently live",
+			want:   ErrNotStarted,
+		},
+		{
+			name:   "live stream refused without recording mode",
+			output: "[download] Some stream does not pass filter (!is_live), skipping ..",
+			want:   ErrLiveStream,
+		},
+		{
+			name:   "recording requested for a finished stream",
+			output: "[download] Some VOD does not pass filter (is_live), skipping ..",
+			live:   LiveOptions{Duration: 5 * time.Minute},
+			want:   ErrNotLive,
+		},
+		{
+			name:   "unrelated failure",
+			output: "ERROR: [youtube] abc123: Video unavailable",
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := liveError(tt.output, tt.live); got != tt.want {
+				t.Errorf("liveError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiveOptionsArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		live LiveOptions
+		want []string
+	}{
+		{
+			name: "not recording",
+			live: LiveOptions{},
+			want: nil,
+		},
+		{
+			name: "record from now",
+			live: LiveOptions{Duration: 10 * time.Minute},
+			want: []string{"--downloader", "ffmpeg", "--downloader-args", "ffmpeg_o:-t 600"},
+		},
+		{
+			name: "record from start",
+			live: LiveOptions{FromStart: true, Duration: 2 * time.Minute},
+			want: []string{"--live-from-start", "--download-sections", "*0-120"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.live.args(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
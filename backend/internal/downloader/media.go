@@ -0,0 +1,345 @@
+package downloader
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"viddl.me/backend/internal/logging"
+	"viddl.me/backend/internal/metrics"
+	"viddl.me/backend/internal/models"
+	"viddl.me/backend/internal/tracing"
+)
+
+var imageExts = map[string]bool{"jpg": true, "jpeg": true, "png": true, "webp": true, "gif": true, "heic": true}
+
+var imageContentTypeExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/heic": ".heic",
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// isImageEntry reports whether a flat playlist entry is a still image, such
+// as an Instagram or X carousel slide. Those entries carry a direct media
+// URL and no video or audio codec.
+func isImageEntry(entry models.YtDlpEntry) bool {
+	if entry.URL == "" {
+		return false
+	}
+	if imageExts[strings.ToLower(entry.Ext)] {
+		return true
+	}
+	return entry.VCodec == "none" && entry.ACodec == "none"
+}
+
+// DownloadImages downloads image content from a post. A single image is
+// returned as-is in its original format; with all set, every item of the
+// carousel, videos included, is packed into a ZIP archive.
+func (d *Downloader) DownloadImages(ctx context.Context, videoURL string, item PlaylistItem, all bool) (result *DownloadResult, err error) {
+	ctx, span := tracing.Start(ctx, "DownloadImages",
+		attribute.String("platform", metrics.Platform(videoURL)),
+		attribute.Bool("all", all))
+	defer func() { endSpan(span, result, err) }()
+
+	// An archive holds up to the size limit, and the item being added
+	// takes up to as much again
+	need := d.maxBytes
+	if all {
+		need *= 2
+	}
+	release, err := d.reserve(ctx, need)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	sess, end, err := d.startSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	defer end()
+	if result, err = d.downloadImages(ctx, sess, videoURL, item, all); err == nil {
+		result, err = d.persist(ctx, result)
+	}
+	return result, canceled(ctx, err)
+}
+
+func (d *Downloader) downloadImages(ctx context.Context, sess *session, videoURL string, item PlaylistItem, all bool) (*DownloadResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.policyFor(videoURL).Timeout)
+	defer cancel()
+
+	entries, err := d.checkMultipleVideos(ctx, videoURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list post media", "error", err)
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("failed to fetch post media")
+	}
+
+	if all {
+		return d.zipMedia(ctx, videoURL, entries, sess)
+	}
+
+	entry, err := selectEntry(entries, item)
+	if err != nil {
+		return nil, err
+	}
+	if entry.MediaType != "image" {
+		return nil, &Error{Code: CodeInvalidItem, Message: "selected item is not an image"}
+	}
+
+	name := fmt.Sprintf("%s_%d", safeFilename(entry.Title), entry.Index)
+	filePath, contentType, size, err := d.fetchImage(ctx, entry, filepath.Join(sess.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Downloaded image", "size", size)
+	return &DownloadResult{
+		FilePath:    filePath,
+		FileName:    filepath.Base(filePath),
+		FileSize:    size,
+		ContentType: contentType,
+	}, nil
+}
+
+func selectEntry(entries []models.VideoEntry, item PlaylistItem) (models.VideoEntry, error) {
+	for _, e := range entries {
+		if (item.ID != "" && e.ID == item.ID) || (item.ID == "" && item.Index > 0 && e.Index == item.Index) {
+			return e, nil
+		}
+	}
+	if item == (PlaylistItem{}) && len(entries) == 1 {
+		return entries[0], nil
+	}
+	if item == (PlaylistItem{}) {
+		return models.VideoEntry{}, &Error{Code: CodeInvalidItem, Message: "post has multiple items, select one or download all"}
+	}
+	return models.VideoEntry{}, &Error{Code: CodeInvalidItem, Message: "selected item not found in post"}
+}
+
+// fetchImage downloads an image entry to basePath, adding the extension
+// that matches the served content type.
+func (d *Downloader) fetchImage(ctx context.Context, entry models.VideoEntry, basePath string) (string, string, int64, error) {
+	tmpPath := basePath + ".part"
+	contentType, size, err := d.fetchToFile(ctx, d.httpClient, entry.URL, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", "", 0, err
+	}
+
+	ext, ok := imageContentTypeExts[contentType]
+	if !ok {
+		os.Remove(tmpPath)
+		slog.ErrorContext(ctx, "Unexpected content type for image", "content_type", contentType)
+		return "", "", 0, fmt.Errorf("item is not an image")
+	}
+
+	filePath := basePath + ext
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return "", "", 0, fmt.Errorf("failed to save image: %w", err)
+	}
+	return filePath, contentType, size, nil
+}
+
+// fetchToFile streams mediaURL into destPath with client, refusing anything
+// larger than the configured maximum download size. It returns the response
+// content type without parameters.
+func (d *Downloader) fetchToFile(ctx context.Context, client *http.Client, mediaURL, destPath string) (string, int64, error) {
+	if !strings.HasPrefix(mediaURL, "https://") && !strings.HasPrefix(mediaURL, "http://") {
+		return "", 0, fmt.Errorf("invalid media URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid media URL")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Media fetch failed", "error", logging.Text(err.Error()))
+		return "", 0, fmt.Errorf("failed to fetch media")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Media fetch failed", "status", resp.StatusCode)
+		return "", 0, fmt.Errorf("failed to fetch media")
+	}
+	if resp.ContentLength > d.maxBytes {
+		return "", 0, ErrTooLarge
+	}
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, io.LimitReader(resp.Body, d.maxBytes+1))
+	if err != nil {
+		slog.ErrorContext(ctx, "Media fetch interrupted", "error", logging.Text(err.Error()))
+		return "", 0, fmt.Errorf("failed to fetch media")
+	}
+	if size > d.maxBytes {
+		return "", 0, ErrTooLarge
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return contentType, size, nil
+}
+
+// zipMedia packs every item of a post into one archive. An item that would
+// take the archive over the size limit fails it before being added.
+func (d *Downloader) zipMedia(ctx context.Context, videoURL string, entries []models.VideoEntry, sess *session) (*DownloadResult, error) {
+	zipName := safeFilename(entries[0].Title) + ".zip"
+	zipPath := filepath.Join(sess.dir, zipName)
+
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	zw := zip.NewWriter(f)
+
+	fail := func(err error) (*DownloadResult, error) {
+		zw.Close()
+		f.Close()
+		os.Remove(zipPath)
+		return nil, err
+	}
+
+	maxBytes := d.maxBytesOf(d.policyFor(videoURL))
+	var total int64
+	for _, e := range entries {
+		itemPath, endItem, err := d.fetchItem(ctx, videoURL, e, sess)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to fetch carousel item", "index", e.Index, "error", err)
+			return fail(fmt.Errorf("failed to fetch item %d: %w", e.Index, err))
+		}
+		if info, err := os.Stat(itemPath); err == nil && total+info.Size() > maxBytes {
+			endItem()
+			return fail(ErrTooLarge)
+		}
+
+		// Items are removed as soon as they are in the archive, so the
+		// disk holds the archive and one item at most
+		size, err := addFileToZip(zw, itemPath, fmt.Sprintf("%02d_%s%s", e.Index, safeFilename(e.Title), filepath.Ext(itemPath)))
+		endItem()
+		if err != nil {
+			return fail(fmt.Errorf("failed to write archive: %w", err))
+		}
+		total += size
+	}
+
+	if err := zw.Close(); err != nil {
+		return fail(fmt.Errorf("failed to write archive: %w", err))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(zipPath)
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	fileInfo, err := os.Stat(zipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file info: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Archived post media", "items", len(entries), "size", fileInfo.Size())
+	return &DownloadResult{
+		FilePath:    zipPath,
+		FileName:    zipName,
+		FileSize:    fileInfo.Size(),
+		ContentType: "application/zip",
+	}, nil
+}
+
+// fetchItem downloads one item of a post for the archive. Images are
+// fetched directly, videos go through the regular yt-dlp download in a
+// session directory of their own. The returned func removes the item.
+func (d *Downloader) fetchItem(ctx context.Context, videoURL string, e models.VideoEntry, sess *session) (string, func(), error) {
+	if e.MediaType == "image" {
+		base := filepath.Join(sess.dir, fmt.Sprintf("item%d", e.Index))
+		path, _, _, err := d.fetchImage(ctx, e, base)
+		return path, func() { os.Remove(path) }, err
+	}
+
+	itemSession, end, err := d.startSession()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	result, err := d.download(ctx, itemSession, videoURL, "best", PlaylistItem{Index: e.Index}, LiveOptions{})
+	if err != nil {
+		end()
+		return "", nil, err
+	}
+	return result.FilePath, end, nil
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	// Media is already compressed, deflating it again only costs CPU
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, src)
+}
+
+func safeFilename(name string) string {
+	name = strings.Trim(unsafeFilenameChars.ReplaceAllString(name, "_"), "._")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	if name == "" {
+		return "media"
+	}
+	return name
+}
+
+// newHTTPClient returns the client used for fetching media directly. It
+// refuses to connect to loopback, private and link-local addresses so media
+// URLs taken from extractor output can't reach internal services.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: refusePrivateAddrs,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
+
+func refusePrivateAddrs(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	return nil
+}
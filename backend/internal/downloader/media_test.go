@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"viddl.me/backend/internal/models"
+)
+
+func TestFetchImage(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0fake jpeg body")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpeg)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html></html>"))
+		case "/huge.webp":
+			w.Header().Set("Content-Type", "image/webp")
+			w.Write([]byte(strings.Repeat("x", 64)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 32, httpClient: srv.Client()}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantType string
+		wantErr  string
+	}{
+		{name: "jpeg keeps original bytes", path: "/photo.jpg", wantType: "image/jpeg"},
+		{name: "non-image content type", path: "/page.html", wantErr: "item is not an image"},
+		{name: "over size limit", path: "/huge.webp", wantErr: "file exceeds size limit"},
+		{name: "missing", path: "/gone.jpg", wantErr: "failed to fetch media"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := models.VideoEntry{URL: srv.URL + tt.path}
+			base := filepath.Join(d.tmpDir, "session_image")
+			path, contentType, _, err := d.fetchImage(context.Background(), entry, base)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("fetchImage() error = %v, want %q", err, tt.wantErr)
+				}
+				if _, statErr := os.Stat(base + ".part"); !os.IsNotExist(statErr) {
+					t.Errorf("partial file left behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchImage() error = %v", err)
+			}
+			if contentType != tt.wantType {
+				t.Errorf("content type = %q, want %q", contentType, tt.wantType)
+			}
+			if filepath.Ext(path) != ".jpg" {
+				t.Errorf("path = %q, want .jpg extension", path)
+			}
+			got, _ := os.ReadFile(path)
+			if string(got) != string(jpeg) {
+				t.Errorf("file content = %q, want original bytes", got)
+			}
+		})
+	}
+}
+
+func TestZipMedia(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("\xff\xd8\xff\xe0" + strings.Repeat("x", 16)))
+	}))
+	defer srv.Close()
+	entries := []models.VideoEntry{
+		{Index: 1, Title: "Post", MediaType: "image", URL: srv.URL + "/1.jpg"},
+		{Index: 2, Title: "Post", MediaType: "image", URL: srv.URL + "/2.jpg"},
+	}
+
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 64, httpClient: srv.Client()}
+	sess, end, err := d.startSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+	result, err := d.zipMedia(context.Background(), srv.URL, entries, sess)
+	if err != nil {
+		t.Fatalf("zipMedia() error = %v", err)
+	}
+	// Items are gone once they are in the archive
+	if files, _ := os.ReadDir(sess.dir); len(files) != 1 || files[0].Name() != result.FileName {
+		t.Errorf("session holds %v, want only the archive", files)
+	}
+
+	// The second item would take the archive over the limit
+	d.maxBytes = 32
+	if _, err := d.zipMedia(context.Background(), srv.URL, entries, sess); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("zipMedia() over the limit error = %v, want ErrTooLarge", err)
+	}
+}
@@ -0,0 +1,167 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/disk"
+	"viddl.me/backend/internal/logging"
+	"viddl.me/backend/internal/models"
+	"viddl.me/backend/internal/policy"
+	"viddl.me/backend/internal/proxy"
+	"viddl.me/backend/internal/retry"
+)
+
+// ErrTooLong is returned for videos longer than their domain allows.
+var ErrTooLong = &Error{Code: CodeTooLong, Message: "video is longer than allowed for this platform"}
+
+// policyFor returns the policy of videoURL's domain with unset limits
+// filled in from the global settings.
+func (d *Downloader) policyFor(videoURL string) policy.Policy {
+	opts := d.current()
+	p, _ := opts.policies.LookupURL(videoURL)
+	if p.Timeout == 0 {
+		p.Timeout = opts.timeout
+	}
+	if p.MaxFileSize == "" {
+		p.MaxFileSize = d.maxFilesize
+	}
+	return p
+}
+
+// toolPolicy is policyFor for a yt-dlp run. Unless the domain's policy
+// sets its own, the proxy comes from the pool and the cookies from the
+// domain's jars, or else the global cookies file.
+func (d *Downloader) toolPolicy(videoURL string) policy.Policy {
+	p := d.policyFor(videoURL)
+	if p.Proxy == "" {
+		p.Proxy = d.proxies.Pick()
+	}
+	if p.CookiesFile == "" {
+		p.CookiesFile = d.cookiesFor(videoURL)
+	}
+	return p
+}
+
+func (d *Downloader) cookiesFor(videoURL string) string {
+	if file := d.jars.PickURL(videoURL); file != "" {
+		return file
+	}
+	return d.current().cookiesFile
+}
+
+// report records how a run under p went, given its stderr. When the run
+// put its proxy in quarantine or its cookie jar out of rotation, p gets the
+// next ones and report returns true, as the run is worth retrying.
+func (d *Downloader) report(p *policy.Policy, videoURL string, stderr []byte, err error) bool {
+	outcome := proxy.Classify(string(stderr), err)
+	var message string
+	if outcome != proxy.OutcomeSuccess {
+		message = logging.Truncate(logging.Text(lastLine(stderr)), 200)
+	}
+
+	retry := false
+	if d.proxies.Report(p.Proxy, outcome, message) {
+		if next := d.proxies.Pick(); next != p.Proxy {
+			p.Proxy, retry = next, true
+		}
+	}
+	if err != nil && cookies.LoginRequired(string(stderr)) && d.jars.MarkStale(p.CookiesFile, message) {
+		if next := d.cookiesFor(videoURL); next != p.CookiesFile {
+			p.CookiesFile, retry = next, true
+		}
+	}
+	return retry
+}
+
+func lastLine(b []byte) string {
+	b = bytes.TrimSpace(b)
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	return string(b)
+}
+
+// ProxyStats returns the strategy and stats of the outbound proxy pool.
+func (d *Downloader) ProxyStats() (string, []proxy.Stats) {
+	if d.proxies == nil {
+		return "", nil
+	}
+	return d.proxies.Strategy(), d.proxies.Stats()
+}
+
+// Breakers describes the circuit breakers of platforms that have failed.
+func (d *Downloader) Breakers() []retry.BreakerStats {
+	return d.breakers.Stats()
+}
+
+// CookieJars describes the cookie jars.
+func (d *Downloader) CookieJars() []models.CookieJarStatus {
+	return d.jars.Status()
+}
+
+// ReplaceCookieJar writes a new cookies file for the named jar, see
+// cookies.Pool.Replace.
+func (d *Downloader) ReplaceCookieJar(name string, data []byte) (models.CookieJarStatus, error) {
+	return d.jars.Replace(name, data)
+}
+
+// maxBytesOf returns the size limit of p in bytes. It is never above the
+// global limit, which disk space is reserved for.
+func (d *Downloader) maxBytesOf(p policy.Policy) int64 {
+	if n, err := disk.ParseSize(p.MaxFileSize); err == nil && n < d.maxBytes {
+		return n
+	}
+	return d.maxBytes
+}
+
+// toolArgs returns the yt-dlp options every run for a URL under p gets.
+func toolArgs(p policy.Policy) []string {
+	var args []string
+	if p.CookiesFile != "" {
+		args = append(args, "--cookies", p.CookiesFile)
+	}
+	if p.Proxy != "" {
+		args = append(args, "--proxy", p.Proxy)
+	}
+	return append(args, p.YtDlpArgs...)
+}
+
+// durationPrefix marks the line with the video's duration that yt-dlp
+// prints before applying --match-filters, to tell a video skipped for its
+// length from one skipped for being live.
+const durationPrefix = "[viddl-duration] "
+
+func durationFilter(p policy.Policy) string {
+	if p.MaxDuration <= 0 {
+		return ""
+	}
+	// Durations are unknown for live streams, which the live filter handles
+	return fmt.Sprintf("duration <=? %d", int(p.MaxDuration.Seconds()))
+}
+
+func durationArgs(p policy.Policy) []string {
+	if p.MaxDuration <= 0 {
+		return nil
+	}
+	return []string{"--print", "pre_process:" + durationPrefix + "%(duration)s"}
+}
+
+// tooLong reports whether yt-dlp printed a duration above p's limit.
+func tooLong(stdout []byte, p policy.Policy) bool {
+	if p.MaxDuration <= 0 {
+		return false
+	}
+	for _, line := range bytes.Split(stdout, []byte("\n")) {
+		value, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte(durationPrefix))
+		if !ok {
+			continue
+		}
+		if seconds, err := strconv.ParseFloat(string(value), 64); err == nil && seconds > p.MaxDuration.Seconds() {
+			return true
+		}
+	}
+	return false
+}
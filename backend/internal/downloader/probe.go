@@ -0,0 +1,186 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// container is a detected file format.
+type container struct {
+	ContentType string
+	Ext         string
+}
+
+// detectContainer identifies a downloaded file by its magic bytes. For
+// formats that can hold either video or audio (MP4, Matroska/WebM) it asks
+// ffprobe, when available, whether there is a video stream at all.
+func detectContainer(path string) (container, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return container{}, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return container{}, err
+	}
+	head = head[:n]
+
+	c, ok := sniffContainer(head)
+	if !ok {
+		return container{}, fmt.Errorf("unknown container format")
+	}
+
+	switch c.ContentType {
+	case "video/mp4", "video/webm", "video/x-matroska":
+		if hasVideo, err := probeHasVideo(path); err == nil && !hasVideo {
+			c = audioVariant(c)
+		}
+	}
+	return c, nil
+}
+
+// sniffContainer matches the leading bytes of a file against known media
+// signatures.
+func sniffContainer(head []byte) (container, bool) {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "M4A ", "M4B ", "M4P ":
+			return container{"audio/mp4", ".m4a"}, true
+		case "qt  ":
+			return container{"video/quicktime", ".mov"}, true
+		}
+		return container{"video/mp4", ".mp4"}, true
+	case bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")):
+		if bytes.Contains(head, []byte("webm")) {
+			return container{"video/webm", ".webm"}, true
+		}
+		return container{"video/x-matroska", ".mkv"}, true
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return container{"audio/opus", ".opus"}, true
+		}
+		return container{"audio/ogg", ".ogg"}, true
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return container{"audio/flac", ".flac"}, true
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return container{"audio/wav", ".wav"}, true
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return container{"image/webp", ".webp"}, true
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return container{"audio/mpeg", ".mp3"}, true
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		// ADTS sync word with layer bits 00
+		return container{"audio/aac", ".aac"}, true
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0:
+		return container{"audio/mpeg", ".mp3"}, true
+	case bytes.HasPrefix(head, []byte("FLV")):
+		return container{"video/x-flv", ".flv"}, true
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		return container{"video/mp2t", ".ts"}, true
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return container{"image/jpeg", ".jpg"}, true
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return container{"image/png", ".png"}, true
+	}
+	return container{}, false
+}
+
+// extTypes are the content types of the extensions yt-dlp gives formats.
+var extTypes = map[string]string{
+	"mp4":  "video/mp4",
+	"m4a":  "audio/mp4",
+	"mov":  "video/quicktime",
+	"webm": "video/webm",
+	"mkv":  "video/x-matroska",
+	"opus": "audio/opus",
+	"ogg":  "audio/ogg",
+	"mp3":  "audio/mpeg",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"flv":  "video/x-flv",
+	"ts":   "video/mp2t",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+func audioVariant(c container) container {
+	switch c.ContentType {
+	case "video/mp4":
+		return container{"audio/mp4", ".m4a"}
+	case "video/webm":
+		return container{"audio/webm", ".weba"}
+	case "video/x-matroska":
+		return container{"audio/x-matroska", ".mka"}
+	}
+	return c
+}
+
+// probeHasVideo asks ffprobe whether the file has a video stream. It
+// returns an error when ffprobe is missing or fails, in which case the
+// caller should trust the magic bytes alone.
+func probeHasVideo(path string) (bool, error) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	dir := filepath.Dir(path)
+	cmd := sandboxCommand(ctx, dir, dir, 0, "ffprobe", "-v", "error", "-show_entries", "stream=codec_type", "-of", "csv=p=0", path)
+	output, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		// Cover art is reported as a video stream too, but only
+		// matters for audio files where the container says audio
+		if strings.TrimSpace(line) == "video" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fixContainer detects the actual format of a downloaded file, renames it
+// when its extension doesn't match, and warns when the result differs from
+// what the download profile asked for.
+func fixContainer(ctx context.Context, filePath, expectedType string) (string, string) {
+	c, err := detectContainer(filePath)
+	if err != nil {
+		slog.WarnContext(ctx, "Could not detect container", "file", filepath.Base(filePath), "error", err)
+		return filePath, expectedType
+	}
+
+	if c.ContentType != expectedType {
+		slog.WarnContext(ctx, "Downloaded file differs from requested profile", "content_type", c.ContentType, "expected", expectedType)
+	}
+
+	ext := filepath.Ext(filePath)
+	if strings.EqualFold(ext, c.Ext) || (c.Ext == ".jpg" && strings.EqualFold(ext, ".jpeg")) {
+		return filePath, c.ContentType
+	}
+
+	renamed := strings.TrimSuffix(filePath, ext) + c.Ext
+	if err := os.Rename(filePath, renamed); err != nil {
+		slog.WarnContext(ctx, "Failed to fix file extension", "file", filepath.Base(filePath), "error", err)
+		return filePath, c.ContentType
+	}
+	slog.InfoContext(ctx, "Renamed file to match its content", "file", filepath.Base(filePath), "content_type", c.ContentType)
+	return renamed, c.ContentType
+}
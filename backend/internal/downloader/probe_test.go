@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffContainer(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		wantType string
+		wantExt  string
+	}{
+		{name: "mp4", head: "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2", wantType: "video/mp4", wantExt: ".mp4"},
+		{name: "m4a", head: "\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A mp42", wantType: "audio/mp4", wantExt: ".m4a"},
+		{name: "quicktime", head: "\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00", wantType: "video/quicktime", wantExt: ".mov"},
+		{name: "webm", head: "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm", wantType: "video/webm", wantExt: ".webm"},
+		{name: "matroska", head: "\x1a\x45\xdf\xa3\xa3\x42\x86\x81\x01\x42\x82\x88matroska", wantType: "video/x-matroska", wantExt: ".mkv"},
+		{name: "opus", head: "OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00OpusHead", wantType: "audio/opus", wantExt: ".opus"},
+		{name: "vorbis", head: "OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x01vorbis", wantType: "audio/ogg", wantExt: ".ogg"},
+		{name: "mp3 with id3", head: "ID3\x04\x00\x00\x00\x00\x00\x00", wantType: "audio/mpeg", wantExt: ".mp3"},
+		{name: "mp3 frame sync", head: "\xff\xfb\x90\x64\x00", wantType: "audio/mpeg", wantExt: ".mp3"},
+		{name: "aac adts", head: "\xff\xf1\x50\x80\x00", wantType: "audio/aac", wantExt: ".aac"},
+		{name: "flac", head: "fLaC\x00\x00\x00\x22", wantType: "audio/flac", wantExt: ".flac"},
+		{name: "wav", head: "RIFF\x24\x08\x00\x00WAVEfmt ", wantType: "audio/wav", wantExt: ".wav"},
+		{name: "jpeg", head: "\xff\xd8\xff\xe0\x00\x10JFIF", wantType: "image/jpeg", wantExt: ".jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ok := sniffContainer([]byte(tt.head))
+			if !ok {
+				t.Fatal("sniffContainer() did not match")
+			}
+			if c.ContentType != tt.wantType || c.Ext != tt.wantExt {
+				t.Errorf("sniffContainer() = %+v, want %s %s", c, tt.wantType, tt.wantExt)
+			}
+		})
+	}
+
+	if _, ok := sniffContainer([]byte("<!DOCTYPE html>")); ok {
+		t.Error("sniffContainer() matched an HTML page")
+	}
+}
+
+func TestFixContainer(t *testing.T) {
+	dir := t.TempDir()
+	webm := filepath.Join(dir, "session_Some_Title.mp4")
+	if err := os.WriteFile(webm, []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, contentType := fixContainer(context.Background(), webm, "video/mp4")
+	if contentType != "video/webm" {
+		t.Errorf("content type = %q, want video/webm", contentType)
+	}
+	if filepath.Base(path) != "session_Some_Title.webm" {
+		t.Errorf("path = %q, want extension fixed to .webm", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("renamed file missing: %v", err)
+	}
+
+	unknown := filepath.Join(dir, "session_unknown.mp4")
+	if err := os.WriteFile(unknown, []byte("not media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path, contentType = fixContainer(context.Background(), unknown, "video/mp4")
+	if path != unknown || contentType != "video/mp4" {
+		t.Errorf("fixContainer() = %q, %q, want file and expected type unchanged", path, contentType)
+	}
+}
@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"viddl.me/backend/internal/logging"
+)
+
+// ErrCanceled is returned when a download's context was canceled, e.g. by
+// an admin.
+var ErrCanceled = &Error{Code: CodeCanceled, Message: "download was canceled"}
+
+type jobKey struct{}
+
+// WithJob tags ctx with the job a download belongs to, so its processes can
+// be attributed in Processes and its log records carry the job ID.
+func WithJob(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(logging.With(ctx, "job_id", jobID), jobKey{}, jobID)
+}
+
+func jobFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobKey{}).(string)
+	return id
+}
+
+// Process is a running yt-dlp process.
+type Process struct {
+	PID     int       `json:"pid"`
+	Job     string    `json:"job,omitempty"`
+	Session string    `json:"session"`
+	Started time.Time `json:"started"`
+}
+
+func (d *Downloader) trackProcess(ctx context.Context, cmd *exec.Cmd) {
+	d.procsMu.Lock()
+	defer d.procsMu.Unlock()
+	if d.procs == nil {
+		d.procs = make(map[int]Process)
+	}
+	d.procs[cmd.Process.Pid] = Process{
+		PID:     cmd.Process.Pid,
+		Job:     jobFromContext(ctx),
+		Session: filepath.Base(cmd.Dir),
+		Started: time.Now(),
+	}
+}
+
+func (d *Downloader) untrackProcess(cmd *exec.Cmd) {
+	d.procsMu.Lock()
+	defer d.procsMu.Unlock()
+	delete(d.procs, cmd.Process.Pid)
+}
+
+// Processes returns the running download processes, oldest first.
+func (d *Downloader) Processes() []Process {
+	d.procsMu.Lock()
+	defer d.procsMu.Unlock()
+	list := make([]Process, 0, len(d.procs))
+	for _, p := range d.procs {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// canceled replaces a download error with ErrCanceled when the download
+// failed because ctx was canceled.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return ErrCanceled
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"viddl.me/backend/internal/metrics"
+	"viddl.me/backend/internal/retry"
+)
+
+// RetryableCodes are the error codes a retry policy may list. Other
+// failures would fail the same way again.
+var RetryableCodes = []string{CodeTimeout, CodeUpstream, CodeRateLimited, CodeFailed}
+
+// platformUnavailable is the error for runs turned away by an open
+// breaker, wait being how long it stays open.
+func platformUnavailable(wait time.Duration) error {
+	return &Error{
+		Code:       CodePlatformUnavailable,
+		Message:    "platform temporarily unavailable, please try again later",
+		Retryable:  true,
+		RetryAfter: (wait + time.Second - 1).Truncate(time.Second),
+	}
+}
+
+// breakerOutcome is what err, the error of a run under ctx, says about its
+// platform. Errors about the video mean the platform answered. Only errors
+// the platform's network or servers reported count against it: runs cut
+// short by cancellation or our own deadline, and failures nothing is known
+// about, which users can cause with odd URLs or formats, are ignored.
+func breakerOutcome(ctx context.Context, err error) retry.Outcome {
+	switch {
+	case err == nil:
+		return retry.Succeeded
+	case ctx.Err() != nil:
+		return retry.Ignored
+	}
+	switch AsError(err).Code {
+	case CodeTimeout, CodeUpstream, CodeRateLimited:
+		return retry.Failed
+	case CodeFailed:
+		return retry.Ignored
+	}
+	return retry.Succeeded
+}
+
+// platformAliases are domains of one platform, which share its breaker.
+var platformAliases = map[string]string{
+	"youtu.be": "youtube.com",
+	"x.com":    "twitter.com",
+	"fb.watch": "facebook.com",
+}
+
+// breakerPlatform is the platform whose breaker covers videoURL: the domain
+// of the URL's policy, without a www or mobile prefix and with aliases
+// resolved, so that an outage trips one breaker for all of a platform's
+// hosts. URLs outside the policies have none.
+func (d *Downloader) breakerPlatform(videoURL string) string {
+	p, ok := d.current().policies.LookupURL(videoURL)
+	if !ok {
+		return ""
+	}
+	domain := p.Domain
+	for _, prefix := range []string{"www.", "m.", "mobile."} {
+		domain = strings.TrimPrefix(domain, prefix)
+	}
+	if platform, ok := platformAliases[domain]; ok {
+		return platform
+	}
+	return domain
+}
+
+// retried calls attempt, one yt-dlp run for videoURL, under the retry
+// policy and the breaker of the URL's platform. attempt returns the run's
+// classified error and whether the run rotated its proxy or cookie jar,
+// which is worth another run whatever the error.
+func (d *Downloader) retried(ctx context.Context, videoURL string, attempt func(n int) (bool, error)) error {
+	platform := metrics.Platform(videoURL)
+	policy := d.current().retries
+	// URLs outside the known platforms share one label, a failing site
+	// must not stop the others
+	breakers, breaker := d.breakers, d.breakerPlatform(videoURL)
+	if breaker == "" {
+		breakers = nil
+	}
+
+	var err error
+	for n := 0; n < max(policy.Attempts, 1); n++ {
+		if n > 0 {
+			delay := policy.Delay(n)
+			slog.InfoContext(ctx, "Retrying yt-dlp", "attempt", n+1, "max_attempts", policy.Attempts, "backoff", delay, "error", err)
+			metrics.DownloadRetries.WithLabelValues(platform).Inc()
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+		if wait, ok := breakers.Allow(breaker); !ok {
+			slog.WarnContext(ctx, "Platform unavailable, not running yt-dlp", "platform", breaker, "retry_in", wait.Round(time.Second))
+			return platformUnavailable(wait)
+		}
+
+		var rotated bool
+		rotated, err = attempt(n)
+		var message string
+		if err != nil {
+			message = err.Error()
+		}
+		breakers.Record(breaker, breakerOutcome(ctx, err), message)
+		if err == nil || !(rotated || policy.Retries(AsError(err).Code)) {
+			return err
+		}
+	}
+	return err
+}
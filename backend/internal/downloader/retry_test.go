@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/metrics"
+	"viddl.me/backend/internal/policy"
+	"viddl.me/backend/internal/retry"
+)
+
+func TestRetried(t *testing.T) {
+	metrics.SetPlatforms([]string{"video.example"})
+	defer metrics.SetPlatforms(nil)
+	const videoURL = "https://video.example/watch?v=1"
+
+	d := &Downloader{breakers: retry.NewBreakers(4, time.Hour)}
+	domains := policy.FromDomains([]string{"video.example", "youtube.com", "youtu.be"})
+	d.Configure("", nil, domains, time.Minute, retry.Policy{Attempts: 3, On: []string{CodeUpstream}})
+
+	runs := 0
+	run := func(err error) func(int) (bool, error) {
+		return func(int) (bool, error) {
+			runs++
+			return false, err
+		}
+	}
+
+	// Only the policy's codes are retried
+	if err := d.retried(context.Background(), videoURL, run(ErrPrivate)); err != ErrPrivate || runs != 1 {
+		t.Errorf("private: err = %v after %d runs, want ErrPrivate after 1", err, runs)
+	}
+	runs = 0
+	if err := d.retried(context.Background(), videoURL, run(ErrUpstream)); err != ErrUpstream || runs != 3 {
+		t.Errorf("upstream: err = %v after %d runs, want ErrUpstream after 3", err, runs)
+	}
+
+	// Failures nothing is known about don't count against the platform
+	runs = 0
+	for i := 0; i < 3; i++ {
+		d.retried(context.Background(), videoURL, run(&Error{Code: CodeFailed, Message: "ERROR: Unable to extract data"}))
+	}
+	if runs != 3 {
+		t.Fatalf("unclassified failures: %d runs, want 3 let through", runs)
+	}
+
+	// The fourth failure in a row opens the breaker, the rest fail fast
+	runs = 0
+	err := d.retried(context.Background(), videoURL, run(ErrUpstream))
+	if e := AsError(err); e.Code != CodePlatformUnavailable || e.RetryAfter != time.Hour || runs != 1 {
+		t.Errorf("breaker: err = %+v after %d runs, want platform_unavailable after 1", e, runs)
+	}
+
+	// A platform's hosts share one breaker
+	runs = 0
+	d.retried(context.Background(), "https://youtu.be/1", run(ErrUpstream))
+	err = d.retried(context.Background(), "https://m.youtube.com/watch?v=1", run(ErrUpstream))
+	if e := AsError(err); e.Code != CodePlatformUnavailable || runs != 4 {
+		t.Errorf("breaker across hosts: err = %+v after %d runs, want platform_unavailable after 4", e, runs)
+	}
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Resource limits for yt-dlp and the ffmpeg processes it starts. The file
+// size limit is twice the download cap so merges of two capped streams
+// still fit.
+const (
+	sandboxCPUSeconds = 60 * 60
+	sandboxOpenFiles  = 256
+)
+
+// sandboxCommand builds a command that runs in workDir with a minimal
+// environment and, where the platform allows, CPU time, file size and open
+// file limits. Child processes inherit both. maxFileBytes of 0 leaves file
+// sizes unlimited.
+func sandboxCommand(ctx context.Context, workDir, cacheDir string, maxFileBytes int64, name string, args ...string) *exec.Cmd {
+	cmd := limitedCommand(ctx, maxFileBytes, name, args...)
+	cmd.Dir = workDir
+
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = "/usr/local/bin:/usr/bin:/bin"
+	}
+	cmd.Env = []string{
+		"PATH=" + path,
+		"HOME=" + workDir,
+		"TMPDIR=" + workDir,
+		"XDG_CACHE_HOME=" + cacheDir,
+		"LANG=C.UTF-8",
+	}
+
+	// Give the process a moment to exit on cancellation before the pipes
+	// are closed under it
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// command runs yt-dlp or ffmpeg for the downloader. Without a work
+// directory the process runs in TmpDir.
+func (d *Downloader) command(ctx context.Context, workDir, name string, args ...string) *exec.Cmd {
+	if workDir == "" {
+		workDir = d.tmpDir
+		os.MkdirAll(workDir, 0755)
+	}
+	// yt-dlp caches player code here, shared between sessions and hidden
+	// from storage listings by the dot
+	cacheDir := filepath.Join(d.tmpDir, ".cache")
+	return sandboxCommand(ctx, workDir, cacheDir, 2*d.maxBytes, name, args...)
+}
+
+// run executes cmd and returns its standard output and error separately.
+// The process is listed by Processes while it runs, under the job in ctx,
+// and the stages yt-dlp reports are traced as children of ctx's span.
+func (d *Downloader) run(ctx context.Context, cmd *exec.Cmd) ([]byte, []byte, error) {
+	var stdout stageWriter
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cleanup, err := privateCookies(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	d.trackProcess(ctx, cmd)
+	defer d.untrackProcess(cmd)
+
+	err = cmd.Wait()
+	traceStages(ctx, stdout.marks, time.Now())
+	return stdout.out.Bytes(), stderr.Bytes(), err
+}
+
+// privateCookies hands the run a copy of the --cookies file in cmd's
+// arguments. yt-dlp writes the jar back on exit, which would clobber the
+// file under concurrent runs and look like an upload of a stale jar. The
+// returned func removes the copy.
+func privateCookies(cmd *exec.Cmd) (func(), error) {
+	i := slices.Index(cmd.Args, "--cookies")
+	if i < 0 || i+1 >= len(cmd.Args) {
+		return func() {}, nil
+	}
+	data, err := os.ReadFile(cmd.Args[i+1])
+	if err != nil {
+		// yt-dlp reports the missing file itself
+		return func() {}, nil
+	}
+	// Hidden from storage listings by the dot, and only readable by us
+	f, err := os.CreateTemp(cmd.Dir, ".cookies-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	cmd.Args[i+1] = f.Name()
+	return func() { os.Remove(f.Name()) }, nil
+}
+
+// passedFilter reports whether yt-dlp printed anything but the duration
+// line, i.e. at least the --print after_filter line of a video that got
+// past --match-filters.
+func passedFilter(stdout []byte) bool {
+	for _, line := range bytes.Split(stdout, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && !bytes.HasPrefix(line, []byte(durationPrefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// printedFile returns the last path in yt-dlp's --print after_move:filepath
+// output that lies inside dir and exists.
+func printedFile(stdout []byte, dir string) (string, bool) {
+	lines := strings.Split(strings.TrimSpace(string(stdout)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		path := filepath.Clean(strings.TrimSpace(lines[i]))
+		if filepath.Dir(path) != filepath.Clean(dir) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, true
+		}
+	}
+	return "", false
+}
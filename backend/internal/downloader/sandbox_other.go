@@ -0,0 +1,13 @@
+//go:build !unix
+
+package downloader
+
+import (
+	"context"
+	"os/exec"
+)
+
+// limitedCommand runs name without resource limits, which need a unix shell.
+func limitedCommand(ctx context.Context, maxFileBytes int64, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
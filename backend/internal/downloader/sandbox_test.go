@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandboxCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("resource limits need a unix shell")
+	}
+	t.Setenv("VIDDL_SECRET", "leak")
+
+	dir := t.TempDir()
+	cmd := sandboxCommand(context.Background(), dir, dir, 1<<20, "sh", "-c",
+		`echo "$HOME|$VIDDL_SECRET|$(ulimit -n)|$(ulimit -f)|$(pwd)"`)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(output)), "|")
+	if len(fields) != 5 {
+		t.Fatalf("unexpected output %q", output)
+	}
+	if fields[0] != dir {
+		t.Errorf("HOME = %q, want %q", fields[0], dir)
+	}
+	if fields[1] != "" {
+		t.Errorf("environment leaked into the sandbox: %q", fields[1])
+	}
+	if fields[2] != "256" {
+		t.Errorf("open files limit = %s, want 256", fields[2])
+	}
+	if fields[3] != "2048" {
+		t.Errorf("file size limit = %s blocks, want 2048", fields[3])
+	}
+	if real, _ := filepath.EvalSymlinks(dir); fields[4] != dir && fields[4] != real {
+		t.Errorf("working directory = %q, want %q", fields[4], dir)
+	}
+}
+
+func TestPrintedFile(t *testing.T) {
+	dir := t.TempDir()
+	final := filepath.Join(dir, "Video.mp4")
+	if err := os.WriteFile(final, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stdout string
+		want   string
+	}{
+		{"final path after id", "dQw4w9WgXcQ\n" + final + "\n", final},
+		{"only id printed", "dQw4w9WgXcQ\n", ""},
+		{"path outside session", "/etc/passwd\n", ""},
+		{"missing file", filepath.Join(dir, "Gone.mp4") + "\n", ""},
+		{"nothing printed", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := printedFile([]byte(tt.stdout), dir)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("printedFile() = %q, %v, want %q", got, ok, tt.want)
+			}
+			if passed := passedFilter([]byte(tt.stdout)); passed != (tt.stdout != "") {
+				t.Errorf("passedFilter() = %v", passed)
+			}
+		})
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20}
+
+	ctx, cancel := context.WithCancel(WithJob(context.Background(), "job1"))
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := d.run(ctx, d.command(ctx, "", "sleep", "30"))
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.Processes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	procs := d.Processes()
+	if len(procs) != 1 || procs[0].Job != "job1" || procs[0].PID == 0 {
+		t.Fatalf("Processes() = %+v, want one process of job1", procs)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if got := canceled(ctx, err); got != ErrCanceled {
+			t.Errorf("canceled() = %v, want ErrCanceled", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("process not killed on cancel")
+	}
+	if procs := d.Processes(); len(procs) != 0 {
+		t.Errorf("Processes() after exit = %+v, want none", procs)
+	}
+}
+
+func TestRunPrivateCookies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20}
+	jar := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := os.WriteFile(jar, []byte("# Netscape HTTP Cookie File\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like yt-dlp, the script writes the jar back on exit
+	stdout, _, err := d.run(context.Background(), d.command(context.Background(), "", "sh", "-c",
+		`cat "$2" && echo rewritten > "$2"`, "sh", "--cookies", jar))
+	if err != nil || !strings.Contains(string(stdout), "Netscape") {
+		t.Fatalf("run() = %q, %v, want the jar's content", stdout, err)
+	}
+	if data, _ := os.ReadFile(jar); !strings.Contains(string(data), "Netscape") {
+		t.Errorf("jar after run = %q, want it untouched", data)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(d.tmpDir, ".cookies-*")); len(leftovers) != 0 {
+		t.Errorf("copies left behind: %v", leftovers)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// limitedCommand starts name through sh to apply rlimits before exec. The
+// limits are best effort, a hard limit already below ours stays in force.
+// The process gets its own group so cancellation also stops ffmpeg.
+func limitedCommand(ctx context.Context, maxFileBytes int64, name string, args ...string) *exec.Cmd {
+	script := fmt.Sprintf("ulimit -t %d 2>/dev/null; ulimit -n %d 2>/dev/null; ", sandboxCPUSeconds, sandboxOpenFiles)
+	if maxFileBytes > 0 {
+		// ulimit -f counts 512 byte blocks
+		script += fmt.Sprintf("ulimit -f %d 2>/dev/null; ", (maxFileBytes+511)/512)
+	}
+	script += `exec "$0" "$@"`
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script, name}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
@@ -5,9 +5,11 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var formatRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+var videoIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
 
 func SanitizeURL(inputURL string, allowedDomains []string) (string, error) {
 	if len(inputURL) > 2048 {
@@ -23,22 +25,25 @@ func SanitizeURL(inputURL string, allowedDomains []string) (string, error) {
 		return "", fmt.Errorf("invalid protocol")
 	}
 
-	hostname := strings.TrimPrefix(parsedURL.Hostname(), "www.")
-	allowed := false
-	for _, domain := range allowedDomains {
-		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
-			allowed = true
-			break
-		}
-	}
-
-	if !allowed {
+	if !hostAllowed(parsedURL.Hostname(), allowedDomains) {
 		return "", fmt.Errorf("domain not allowed")
 	}
 
 	return parsedURL.String(), nil
 }
 
+// hostAllowed reports whether hostname is one of domains or a subdomain of
+// one of them.
+func hostAllowed(hostname string, domains []string) bool {
+	hostname = strings.TrimPrefix(hostname, "www.")
+	for _, domain := range domains {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
 func SanitizeFormat(format string) string {
 	if format == "" || !formatRegex.MatchString(format) {
 		return "best"
@@ -48,3 +53,37 @@ func SanitizeFormat(format string) string {
 	}
 	return format
 }
+
+// SanitizeVideoID validates a playlist entry ID as returned by yt-dlp. An
+// empty ID is valid and means "no entry selected".
+func SanitizeVideoID(id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	if !videoIDRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid video ID")
+	}
+	return id, nil
+}
+
+// SanitizeLiveOptions validates the live recording mode requested by the
+// client. An empty mode means the video is not expected to be live.
+func SanitizeLiveOptions(mode string, minutes int, videoURL string) (LiveOptions, error) {
+	if mode == "" {
+		return LiveOptions{}, nil
+	}
+	if mode != "now" && mode != "start" {
+		return LiveOptions{}, fmt.Errorf("invalid live mode")
+	}
+
+	duration := time.Duration(minutes) * time.Minute
+	if duration <= 0 || duration > MaxLiveDuration {
+		return LiveOptions{}, fmt.Errorf("live recording must be between 1 and %d minutes", int(MaxLiveDuration.Minutes()))
+	}
+
+	if mode == "start" && !supportsLiveFromStart(videoURL) {
+		return LiveOptions{}, fmt.Errorf("recording from the start is not supported for this platform")
+	}
+
+	return LiveOptions{FromStart: mode == "start", Duration: duration}, nil
+}
@@ -2,6 +2,7 @@ package downloader
 
 import (
 	"testing"
+	"time"
 )
 
 var testAllowedDomains = []string{
@@ -263,3 +264,64 @@ func TestSanitizeFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestSanitizeVideoID(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty id is allowed", input: "", want: ""},
+		{name: "youtube id", input: "dQw4w9WgXcQ", want: "dQw4w9WgXcQ"},
+		{name: "youtube id with dash and underscore", input: "a-b_C9", want: "a-b_C9"},
+		{name: "twitter numeric id", input: "1843210987654321001", want: "1843210987654321001"},
+		{name: "filter injection", input: "x&duration>0", wantErr: true},
+		{name: "shell metacharacters", input: "$(id)", wantErr: true},
+		{name: "too long", input: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeVideoID(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SanitizeVideoID(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeVideoID(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLiveOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		minutes int
+		url     string
+		want    LiveOptions
+		wantErr bool
+	}{
+		{name: "no mode", url: "https://www.twitch.tv/somechannel"},
+		{name: "from now", mode: "now", minutes: 5, url: "https://www.twitch.tv/somechannel", want: LiveOptions{Duration: 5 * time.Minute}},
+		{name: "from start on youtube", mode: "start", minutes: 5, url: "https://www.youtube.com/watch?v=abc", want: LiveOptions{FromStart: true, Duration: 5 * time.Minute}},
+		{name: "from start on twitch", mode: "start", minutes: 5, url: "https://www.twitch.tv/somechannel", wantErr: true},
+		{name: "unknown mode", mode: "forever", minutes: 5, url: "https://www.twitch.tv/somechannel", wantErr: true},
+		{name: "zero minutes", mode: "now", url: "https://www.twitch.tv/somechannel", wantErr: true},
+		{name: "over the cap", mode: "now", minutes: 31, url: "https://www.twitch.tv/somechannel", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeLiveOptions(tt.mode, tt.minutes, tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizeLiveOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeLiveOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// session is one download's private working directory inside TmpDir.
+type session struct {
+	id  string
+	dir string
+}
+
+// startSession registers a new download session and creates its working
+// directory. The session counts as active before the directory exists, so
+// the cleaner never mistakes it for a leftover. end removes the directory
+// with whatever is still in it.
+func (d *Downloader) startSession() (*session, func(), error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &session{id: sessionID, dir: filepath.Join(d.tmpDir, sessionID)}
+
+	d.sessionsMu.Lock()
+	if d.sessions == nil {
+		d.sessions = make(map[string]struct{})
+	}
+	d.sessions[sessionID] = struct{}{}
+	d.sessionsMu.Unlock()
+
+	end := func() {
+		d.removeSessionDir(s)
+		d.sessionsMu.Lock()
+		delete(d.sessions, sessionID)
+		d.sessionsMu.Unlock()
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		end()
+		return nil, nil, err
+	}
+	return s, end, nil
+}
+
+// removeSessionDir moves the directory out of the way in one rename, so
+// nothing sees it half deleted, then deletes it.
+func (d *Downloader) removeSessionDir(s *session) {
+	trash := filepath.Join(d.tmpDir, ".trash-"+s.id)
+	if err := os.Rename(s.dir, trash); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to remove session directory", "session", s.id, "error", err)
+		}
+		return
+	}
+	if err := os.RemoveAll(trash); err != nil {
+		slog.Error("Failed to remove session directory", "session", s.id, "error", err)
+	}
+}
+
+// SessionActive reports whether the download session is still running.
+func (d *Downloader) SessionActive(sessionID string) bool {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	_, ok := d.sessions[sessionID]
+	return ok
+}
+
+// ActiveSessions returns the IDs of running download sessions.
+func (d *Downloader) ActiveSessions() []string {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	ids := make([]string, 0, len(d.sessions))
+	for id := range d.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
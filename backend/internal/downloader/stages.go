@@ -0,0 +1,86 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"viddl.me/backend/internal/tracing"
+)
+
+// yt-dlp runs ffmpeg itself, so the only way to tell fetching from merging
+// and converting is to have it print a marker as it enters each stage.
+const stagePrefix = "[viddl-stage] "
+
+var stageArgs = []string{
+	"--print", "before_dl:" + stagePrefix + "fetch",
+	"--print", "post_process:" + stagePrefix + "postprocess",
+}
+
+// Span names of the stages.
+var stageSpans = map[string]string{
+	"fetch":       "yt-dlp fetch",
+	"postprocess": "ffmpeg post-processing",
+}
+
+type stageMark struct {
+	stage string
+	at    time.Time
+}
+
+// stageWriter collects yt-dlp's standard output and notes when each stage
+// marker line arrives.
+type stageWriter struct {
+	out   bytes.Buffer
+	line  []byte
+	marks []stageMark
+}
+
+func (w *stageWriter) Write(p []byte) (int, error) {
+	w.out.Write(p)
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		if stage, ok := bytes.CutPrefix(bytes.TrimSpace(w.line[:i]), []byte(stagePrefix)); ok {
+			w.marks = append(w.marks, stageMark{stage: string(stage), at: time.Now()})
+		}
+		w.line = w.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// traceStages records a span per stage under the span in ctx. A stage lasts
+// until the next different one starts or the process ends; yt-dlp enters
+// the fetch stage once per format of a merged download.
+func traceStages(ctx context.Context, marks []stageMark, end time.Time) {
+	for i := 0; i < len(marks); {
+		j := i + 1
+		for j < len(marks) && marks[j].stage == marks[i].stage {
+			j++
+		}
+		stop := end
+		if j < len(marks) {
+			stop = marks[j].at
+		}
+		if name, ok := stageSpans[marks[i].stage]; ok {
+			tracing.Record(ctx, name, marks[i].at, stop)
+		}
+		i = j
+	}
+}
+
+// endSpan ends the span of a public download method with the size of what
+// it produced.
+func endSpan(span trace.Span, result *DownloadResult, err error) {
+	if result != nil {
+		span.SetAttributes(
+			attribute.Int64("bytes", result.FileSize),
+			attribute.String("content_type", result.ContentType))
+	}
+	tracing.End(span, err)
+}
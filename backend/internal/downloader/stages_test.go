@@ -0,0 +1,53 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStageWriter(t *testing.T) {
+	var w stageWriter
+	// Lines split across writes, fetch reported once per merged format
+	for _, chunk := range []string{"abc123\n[viddl-st", "age] fetch\n", "[viddl-stage] fetch\n[viddl-stage] post", "process\n/tmp/x/a.mp4\n"} {
+		w.Write([]byte(chunk))
+	}
+
+	if got := w.out.String(); got != "abc123\n[viddl-stage] fetch\n[viddl-stage] fetch\n[viddl-stage] postprocess\n/tmp/x/a.mp4\n" {
+		t.Errorf("output = %q", got)
+	}
+	if len(w.marks) != 3 || w.marks[0].stage != "fetch" || w.marks[2].stage != "postprocess" {
+		t.Fatalf("marks = %+v", w.marks)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	marks := []stageMark{
+		{stage: "fetch", at: start},
+		{stage: "fetch", at: start.Add(time.Second)},
+		{stage: "postprocess", at: start.Add(10 * time.Second)},
+	}
+	traceStages(context.Background(), marks, start.Add(12*time.Second))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	want := []struct {
+		name string
+		dur  time.Duration
+	}{{"yt-dlp fetch", 10 * time.Second}, {"ffmpeg post-processing", 2 * time.Second}}
+	for i, s := range spans {
+		if s.Name() != want[i].name || s.EndTime().Sub(s.StartTime()) != want[i].dur {
+			t.Errorf("span %d = %s lasting %v, want %s lasting %v",
+				i, s.Name(), s.EndTime().Sub(s.StartTime()), want[i].name, want[i].dur)
+		}
+	}
+}
@@ -1,143 +1,376 @@
 package downloader
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/disk"
+	"viddl.me/backend/internal/logging"
+	"viddl.me/backend/internal/metrics"
 	"viddl.me/backend/internal/models"
+	"viddl.me/backend/internal/policy"
+	"viddl.me/backend/internal/proxy"
+	"viddl.me/backend/internal/retry"
+	"viddl.me/backend/internal/storage"
+	"viddl.me/backend/internal/tracing"
 )
 
 type Downloader struct {
-	tmpDir        string
+	tmpDir      string
+	maxFilesize string
+	maxBytes    int64
+	results     storage.Storage
+	proxies     *proxy.Pool
+	jars        *cookies.Pool
+	breakers    *retry.Breakers
+	httpClient  *http.Client
+	settings    atomic.Pointer[settings]
+
+	ytdlpCheck  toolCheck
+	ffmpegCheck toolCheck
+
+	// Disk admission control, see reserve
+	minFree   int64
+	freeSpace func(dir string) (int64, error)
+	diskMu    sync.Mutex
+	reserved  int64
+
+	sessionsMu sync.Mutex
+	sessions   map[string]struct{}
+
+	procsMu sync.Mutex
+	procs   map[int]Process // by PID
+}
+
+// settings are the parts of the configuration that can change while the
+// downloader runs, see Configure.
+type settings struct {
 	cookiesFile   string
-	maxFilesize   string
-	healthChecked bool
-	healthError   error
+	directDomains []string
+	policies      policy.Set
+	timeout       time.Duration
+	retries       retry.Policy
 }
 
-func New(tmpDir, cookiesFile, maxFilesize string) *Downloader {
+func New(tmpDir, maxFilesize, minFreeDisk string, results storage.Storage, proxies *proxy.Pool, jars *cookies.Pool, breakers *retry.Breakers) *Downloader {
+	maxBytes, err := disk.ParseSize(maxFilesize)
+	if err != nil {
+		slog.Warn("Invalid max download size, direct fetches capped at 2G", "value", maxFilesize)
+		maxBytes = 2 << 30
+	}
+	minFree, err := disk.ParseSize(minFreeDisk)
+	if err != nil {
+		slog.Warn("Invalid minimum free disk space, using 1G", "value", minFreeDisk)
+		minFree = 1 << 30
+	}
+	// yt-dlp runs inside session directories, so relative paths would no
+	// longer resolve
+	if abs, err := filepath.Abs(tmpDir); err == nil {
+		tmpDir = abs
+	}
 	return &Downloader{
 		tmpDir:      tmpDir,
-		cookiesFile: cookiesFile,
 		maxFilesize: maxFilesize,
+		maxBytes:    maxBytes,
+		results:     results,
+		proxies:     proxies,
+		jars:        jars,
+		breakers:    breakers,
+		httpClient:  newHTTPClient(),
+		minFree:     minFree,
+		freeSpace:   disk.Free,
+	}
+}
+
+// Configure sets the cookies file, the hosts fetched directly, the
+// per-domain policies, how long one download may take and when failed
+// yt-dlp runs are retried. Downloads already running keep the settings they
+// started with.
+func (d *Downloader) Configure(cookiesFile string, directDomains []string, policies policy.Set, timeout time.Duration, retries retry.Policy) {
+	policies = slices.Clone(policies)
+	for i := range policies {
+		policies[i].CookiesFile = absPath(policies[i].CookiesFile)
+	}
+	d.settings.Store(&settings{
+		cookiesFile:   absPath(cookiesFile),
+		directDomains: directDomains,
+		policies:      policies,
+		timeout:       timeout,
+		retries:       retries,
+	})
+}
+
+// absPath is filepath.Abs for optional paths, see New.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// current returns the settings last passed to Configure.
+func (d *Downloader) current() settings {
+	if s := d.settings.Load(); s != nil {
+		return *s
 	}
+	return settings{timeout: 10 * time.Minute, retries: retry.Policy{Attempts: 1}}
 }
 
-func (d *Downloader) GetVideoInfo(videoURL string) (*models.VideoInfo, error) {
+// GetVideoInfo looks up the formats or entries of videoURL. Lookups end
+// with ctx or after the domain's timeout, retries included.
+func (d *Downloader) GetVideoInfo(ctx context.Context, videoURL string) (*models.VideoInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.policyFor(videoURL).Timeout)
+	defer cancel()
+	if media := d.detectDirectMedia(ctx, videoURL); media != nil {
+		return directInfo(media), nil
+	}
+
 	// Skip multi-video check for YouTube single videos (not playlists)
 	isYouTube := strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
 		strings.Contains(strings.ToLower(videoURL), "youtu.be")
 	isPlaylist := strings.Contains(videoURL, "/playlist") || strings.Contains(videoURL, "list=")
 
 	if !isYouTube || isPlaylist {
-		multiVideos, err := d.checkMultipleVideos(videoURL)
+		multiVideos, err := d.checkMultipleVideos(ctx, videoURL)
 		if err == nil && len(multiVideos) > 1 {
+			title := fmt.Sprintf("Multiple videos (%d)", len(multiVideos))
+			for _, v := range multiVideos {
+				if v.MediaType == "image" {
+					title = fmt.Sprintf("Carousel (%d items)", len(multiVideos))
+					break
+				}
+			}
 			return &models.VideoInfo{
-				Title:        fmt.Sprintf("Multiple videos (%d)", len(multiVideos)),
+				Title:        title,
 				IsMultiVideo: true,
 				MultiVideos:  multiVideos,
 			}, nil
 		}
+		// A single image post has nothing for getSingleVideoInfo to
+		// pick formats from, so report it from the flat entry
+		if err == nil && len(multiVideos) == 1 && multiVideos[0].MediaType == "image" {
+			image := multiVideos[0]
+			return &models.VideoInfo{
+				Title:     image.Title,
+				Thumbnail: image.Thumbnail,
+				MediaType: "image",
+				Width:     image.Width,
+				Height:    image.Height,
+			}, nil
+		}
 	}
 
-	return d.getSingleVideoInfo(videoURL)
+	info, err := d.getSingleVideoInfo(ctx, videoURL)
+	return info, canceled(ctx, err)
 }
 
-func (d *Downloader) checkMultipleVideos(videoURL string) ([]models.VideoEntry, error) {
-	args := []string{"--flat-playlist", "--dump-json", "--no-warnings"}
+// detectDirectMedia probes URLs on direct media hosts and returns the media
+// description when yt-dlp can be skipped, or nil to go through yt-dlp.
+func (d *Downloader) detectDirectMedia(ctx context.Context, videoURL string) *directMedia {
+	if !d.isDirectMediaHost(videoURL) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
 
-	if d.cookiesFile != "" {
-		args = append(args, "--cookies", d.cookiesFile)
+	media, err := d.probeDirectMedia(ctx, videoURL)
+	if err != nil {
+		slog.WarnContext(ctx, "Direct media probe failed, falling back to yt-dlp", "error", logging.Text(err.Error()))
+		return nil
 	}
-	args = append(args, videoURL)
+	if media != nil {
+		slog.InfoContext(ctx, "Direct media URL detected", "content_type", media.ContentType)
+	}
+	return media
+}
 
-	log.Printf("INFO: Checking for multiple videos with args: %v", args)
-	cmd := exec.Command("yt-dlp", args...)
-	output, err := cmd.CombinedOutput()
+func (d *Downloader) checkMultipleVideos(ctx context.Context, videoURL string) ([]models.VideoEntry, error) {
+	pol := d.toolPolicy(videoURL)
+	var output []byte
+	err := d.retried(ctx, videoURL, func(int) (bool, error) {
+		// Built for every run, the proxy and cookies may have rotated
+		args := []string{"--flat-playlist", "--dump-json", "--no-warnings"}
+		args = append(args, toolArgs(pol)...)
+		args = append(args, videoURL)
+
+		slog.DebugContext(ctx, "Checking for multiple videos", "args", logging.Args(args))
+		start := time.Now()
+		cmd := d.command(ctx, "", "yt-dlp", args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		var err error
+		output, err = cmd.Output()
+		metrics.ObserveYtdlp(ctx, metrics.Platform(videoURL), "playlist", start, err)
+		rotated := d.report(&pol, videoURL, stderr.Bytes(), err)
+		if err != nil {
+			return rotated, runError(ctx, stderr.Bytes(), "failed to fetch post media")
+		}
+		return false, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return parseFlatPlaylist(output), nil
+}
+
+// parseFlatPlaylist turns `--flat-playlist --dump-json` output into video
+// entries. Indexes come from yt-dlp's own playlist_index so they line up
+// with --playlist-items; blank or non-video lines never shift them.
+func parseFlatPlaylist(output []byte) []models.VideoEntry {
 	var videos []models.VideoEntry
-	lines := strings.Split(string(output), "\n")
-	for i, line := range lines {
-		if strings.TrimSpace(line) == "" {
+	position := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
-		var entry map[string]any
-		if json.Unmarshal([]byte(line), &entry) == nil {
-			if entry["_type"] == "url" || entry["_type"] == "video" {
-				video := models.VideoEntry{Index: i + 1}
-				if t, ok := entry["title"].(string); ok {
-					video.Title = t
-				}
-				if t, ok := entry["thumbnail"].(string); ok {
-					video.Thumbnail = t
-				}
-				if d, ok := entry["duration"].(float64); ok {
-					video.Duration = d
-				}
-				videos = append(videos, video)
+		var entry models.YtDlpEntry
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		image := isImageEntry(entry)
+		if entry.Type != "url" && entry.Type != "video" && !image {
+			continue
+		}
+		position++
+
+		index := entry.PlaylistIndex
+		if index <= 0 {
+			index = position
+		}
+		video := models.VideoEntry{
+			Index:     index,
+			ID:        entry.ID,
+			URL:       entry.URL,
+			Title:     entry.Title,
+			Thumbnail: entry.Thumbnail,
+			Duration:  entry.Duration,
+			MediaType: "video",
+			Ext:       entry.Ext,
+			Width:     entry.Width,
+			Height:    entry.Height,
+		}
+		if image {
+			video.MediaType = "image"
+			if video.Thumbnail == "" {
+				video.Thumbnail = entry.URL
 			}
 		}
+		videos = append(videos, video)
 	}
-	return videos, nil
+	return videos
 }
 
-func (d *Downloader) getSingleVideoInfo(videoURL string) (*models.VideoInfo, error) {
-	args := []string{"--dump-json", "--no-playlist", "--no-warnings"}
-
-	isYouTube := strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
-		strings.Contains(strings.ToLower(videoURL), "youtu.be")
-
-	if isYouTube {
-		if d.cookiesFile != "" {
-			args = append(args, "--extractor-args", "youtube:player_client=default,web_safari")
-		} else {
-			args = append(args, "--extractor-args", "youtube:player_client=web_safari")
+func (d *Downloader) getSingleVideoInfo(ctx context.Context, videoURL string) (*models.VideoInfo, error) {
+	pol := d.toolPolicy(videoURL)
+	var output []byte
+	err := d.retried(ctx, videoURL, func(int) (bool, error) {
+		args := buildInfoArgs(pol, videoURL)
+		slog.DebugContext(ctx, "Running yt-dlp", "args", logging.Args(args))
+		start := time.Now()
+		cmd := d.command(ctx, "", "yt-dlp", args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		var err error
+		output, err = cmd.Output()
+		metrics.ObserveYtdlp(ctx, metrics.Platform(videoURL), "info", start, err)
+		rotated := d.report(&pol, videoURL, stderr.Bytes(), err)
+		if err == nil {
+			return false, nil
 		}
-	}
-
-	if d.cookiesFile != "" {
-		log.Printf("INFO: Using cookies file: %s", d.cookiesFile)
-		args = append(args, "--cookies", d.cookiesFile)
-	}
-	args = append(args, videoURL)
-
-	log.Printf("INFO: Running yt-dlp with args: %v", args)
-	cmd := exec.Command("yt-dlp", args...)
-	output, err := cmd.Output()
+		slog.ErrorContext(ctx, "yt-dlp info lookup failed", "error", err, "stderr", logging.Text(stderr.String()))
+		if liveErr := liveError(stderr.String(), LiveOptions{}); liveErr != nil {
+			return rotated, liveErr
+		}
+		return rotated, runError(ctx, stderr.Bytes(), "failed to fetch video information")
+	})
 	if err != nil {
-		log.Printf("ERROR: yt-dlp error: %v", err)
-		return nil, fmt.Errorf("failed to fetch video information")
+		return nil, err
 	}
 
 	var ytdlpInfo models.YtDlpInfo
 	if err := json.Unmarshal(output, &ytdlpInfo); err != nil {
-		log.Printf("ERROR: JSON parse error: %v, output: %s", err, string(output[:min(500, len(output))]))
+		slog.ErrorContext(ctx, "Failed to parse yt-dlp info", "error", err, "output", logging.Text(string(output[:min(500, len(output))])))
 		return nil, fmt.Errorf("failed to parse video information")
 	}
 
 	isInstagram := strings.Contains(strings.ToLower(videoURL), "instagram.com")
 	formats := d.extractFormats(ytdlpInfo, isInstagram)
 
-	return &models.VideoInfo{
-		Title:        ytdlpInfo.Title,
-		Thumbnail:    ytdlpInfo.Thumbnail,
-		Duration:     ytdlpInfo.Duration,
-		Uploader:     ytdlpInfo.Uploader,
-		Formats:      formats,
-		IsMultiVideo: false,
-	}, nil
+	mediaType := "video"
+	if len(formats) == 0 && imageExts[strings.ToLower(ytdlpInfo.Ext)] {
+		mediaType = "image"
+	}
+
+	info := &models.VideoInfo{
+		Title:            ytdlpInfo.Title,
+		Thumbnail:        ytdlpInfo.Thumbnail,
+		Duration:         ytdlpInfo.Duration,
+		Uploader:         ytdlpInfo.Uploader,
+		Formats:          formats,
+		IsMultiVideo:     false,
+		IsLive:           ytdlpInfo.IsLive,
+		LiveStatus:       ytdlpInfo.LiveStatus,
+		ReleaseTimestamp: ytdlpInfo.ReleaseTimestamp,
+		Scheduled:        ytdlpInfo.LiveStatus == "is_upcoming",
+		MediaType:        mediaType,
+	}
+	if mediaType == "image" {
+		info.Width = ytdlpInfo.Width
+		info.Height = ytdlpInfo.Height
+		if info.Thumbnail == "" {
+			info.Thumbnail = ytdlpInfo.URL
+		}
+	}
+	if info.IsLive {
+		info.LiveFromStart = supportsLiveFromStart(videoURL)
+		slog.InfoContext(ctx, "Live stream detected", "from_start_supported", info.LiveFromStart)
+	}
+	if info.Scheduled {
+		slog.InfoContext(ctx, "Upcoming stream", "release_timestamp", info.ReleaseTimestamp)
+	}
+	return info, nil
+}
+
+func buildInfoArgs(pol policy.Policy, videoURL string) []string {
+	// --ignore-no-formats-error lets upcoming premieres return their
+	// metadata instead of failing with "Premieres in ..."
+	args := []string{"--dump-json", "--no-playlist", "--no-warnings", "--ignore-no-formats-error"}
+
+	isYouTube := strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
+		strings.Contains(strings.ToLower(videoURL), "youtu.be")
+
+	if isYouTube {
+		if pol.CookiesFile != "" {
+			args = append(args, "--extractor-args", "youtube:player_client=default,web_safari")
+		} else {
+			args = append(args, "--extractor-args", "youtube:player_client=web_safari")
+		}
+	}
+
+	args = append(args, toolArgs(pol)...)
+	args = append(args, videoURL)
+	return args
 }
 
 func (d *Downloader) extractFormats(info models.YtDlpInfo, isInstagram bool) []models.FormatInfo {
@@ -187,95 +420,176 @@ func (d *Downloader) extractFormats(info models.YtDlpInfo, isInstagram bool) []m
 	return formats
 }
 
+// PlaylistItem selects one entry of a multi-video URL, either by its
+// playlist_index or by its yt-dlp ID. The zero value selects nothing and
+// the URL is downloaded with --no-playlist.
+type PlaylistItem struct {
+	Index int
+	ID    string
+}
+
+func (p PlaylistItem) args() []string {
+	switch {
+	case p.ID != "":
+		// Selected by filter() instead, the whole playlist is walked
+		return nil
+	case p.Index > 0:
+		return []string{"--playlist-items", fmt.Sprintf("%d", p.Index)}
+	default:
+		return []string{"--no-playlist"}
+	}
+}
+
+func (p PlaylistItem) filter() string {
+	if p.ID == "" {
+		return ""
+	}
+	return "id=" + p.ID
+}
+
+// matchFilterArgs joins filter conditions into a single --match-filters
+// flag. Repeated --match-filters flags are OR'ed by yt-dlp, which would
+// let any one condition select the video.
+func matchFilterArgs(filters ...string) []string {
+	var conditions []string
+	for _, f := range filters {
+		if f != "" {
+			conditions = append(conditions, f)
+		}
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	return []string{"--match-filters", strings.Join(conditions, " & ")}
+}
+
 type DownloadResult struct {
-	FilePath    string
+	Key         string // storage key of the finished file
+	FilePath    string // local working path, gone once stored remotely
 	FileName    string
 	FileSize    int64
 	ContentType string
 }
 
-func (d *Downloader) Download(videoURL, format string, videoIndex int) (*DownloadResult, error) {
-	// 10 minute timeout for downloads
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
-	if err := os.MkdirAll(d.tmpDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+func (d *Downloader) Download(ctx context.Context, videoURL, format string, item PlaylistItem, live LiveOptions) (result *DownloadResult, err error) {
+	ctx, span := tracing.Start(ctx, "Download",
+		attribute.String("platform", metrics.Platform(videoURL)),
+		attribute.String("format", format),
+		attribute.Bool("live", live.enabled()))
+	defer func() { endSpan(span, result, err) }()
+
+	release, err := d.reserve(ctx, d.maxBytes)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	sessionID, err := generateSessionID()
+	// The session directory stays until the file is stored
+	sess, end, err := d.startSession()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
+	defer end()
+	if result, err = d.download(ctx, sess, videoURL, format, item, live); err == nil {
+		result, err = d.persist(ctx, result)
+	}
+	return result, canceled(ctx, err)
+}
 
-	// Use session ID prefix + title for filename
-	outputTemplate := filepath.Join(d.tmpDir, sessionID+"_%(title).80s.%(ext)s")
-	args := d.buildDownloadArgs(videoURL, format, outputTemplate, videoIndex)
+func (d *Downloader) download(ctx context.Context, sess *session, videoURL, format string, item PlaylistItem, live LiveOptions) (*DownloadResult, error) {
+	// The download timeout, plus the recording time for live streams
+	pol := d.toolPolicy(videoURL)
+	ctx, cancel := context.WithTimeout(ctx, pol.Timeout+live.Duration)
+	defer cancel()
 
-	// Retry logic with exponential backoff
-	var output []byte
-	maxRetries := 3
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
-			log.Printf("INFO: Retry attempt %d/%d after %v", attempt+1, maxRetries, backoff)
-			time.Sleep(backoff)
+	if item == (PlaylistItem{}) && !live.enabled() {
+		if media := d.detectDirectMedia(ctx, videoURL); media != nil {
+			return d.downloadDirect(ctx, videoURL, media, sess.dir)
 		}
+	}
 
-		log.Printf("INFO: Running yt-dlp download with args: %v", args)
-		cmd := exec.CommandContext(ctx, "yt-dlp", args...)
-		output, err = cmd.CombinedOutput()
+	if item != (PlaylistItem{}) {
+		slog.InfoContext(ctx, "Downloading playlist item", "index", item.Index, "id", item.ID)
+	}
+	if live.enabled() {
+		slog.InfoContext(ctx, "Recording live stream", "duration", live.Duration, "from_start", live.FromStart)
+	}
+	outputTemplate := filepath.Join(sess.dir, "%(title).80s.%(ext)s")
+
+	// yt-dlp prints the final path on stdout and its errors on stderr
+	var stdout, output []byte
+	platform := metrics.Platform(videoURL)
+	err := d.retried(ctx, videoURL, func(attempt int) (bool, error) {
+		args := d.buildDownloadArgs(pol, videoURL, format, outputTemplate, item, live)
+		slog.DebugContext(ctx, "Running yt-dlp", "args", logging.Args(args))
+		start := time.Now()
+		attemptCtx, span := tracing.Start(ctx, "yt-dlp",
+			attribute.Int("attempt", attempt+1), attribute.String("format", format))
+		var err error
+		stdout, output, err = d.run(attemptCtx, d.command(attemptCtx, sess.dir, "yt-dlp", args...))
+		tracing.End(span, err)
+		metrics.ObserveYtdlp(ctx, platform, "download", start, err)
+		rotated := d.report(&pol, videoURL, output, err)
 		if err == nil {
-			break
+			return false, nil
 		}
 
-		// Check if error is retryable (network issues, temporary failures)
-		outputStr := string(output)
-		if strings.Contains(outputStr, "HTTP Error 5") ||
-			strings.Contains(outputStr, "timed out") ||
-			strings.Contains(outputStr, "Connection reset") {
-			log.Printf("WARN: Retryable error on attempt %d: %v", attempt+1, err)
-			continue
-		}
-
-		// Check if format-specific error - try fallback to best
-		if format != "best" && (strings.Contains(outputStr, "format") || strings.Contains(outputStr, "unavailable")) {
-			log.Printf("WARN: Format %s failed, trying fallback to best", format)
-			fallbackArgs := d.buildDownloadArgs(videoURL, "best", outputTemplate, videoIndex)
-			cmd := exec.CommandContext(ctx, "yt-dlp", fallbackArgs...)
-			output, err = cmd.CombinedOutput()
+		// The requested format may not exist for this video, best always
+		// does. Later attempts keep to best
+		if format != "best" && classify(string(output)) == ErrFormatUnavailable {
+			slog.WarnContext(ctx, "Format failed, falling back to best", "format", format)
+			metrics.FormatFallbacks.WithLabelValues(platform).Inc()
+			format = "best"
+			fallbackArgs := d.buildDownloadArgs(pol, videoURL, format, outputTemplate, item, live)
+			start := time.Now()
+			attemptCtx, span := tracing.Start(ctx, "yt-dlp",
+				attribute.Int("attempt", attempt+1), attribute.String("format", format), attribute.Bool("fallback", true))
+			stdout, output, err = d.run(attemptCtx, d.command(attemptCtx, sess.dir, "yt-dlp", fallbackArgs...))
+			tracing.End(span, err)
+			metrics.ObserveYtdlp(ctx, platform, "download", start, err)
+			rotated = d.report(&pol, videoURL, output, err) || rotated
 			if err == nil {
-				break
+				return false, nil
 			}
 		}
 
-		// Non-retryable error, fail immediately
-		log.Printf("ERROR: yt-dlp download error: %v, output: %s", err, outputStr)
-		return nil, fmt.Errorf("download failed or file exceeds size limit")
-	}
-
+		slog.ErrorContext(ctx, "yt-dlp download failed", "attempt", attempt+1, "error", err, "output", logging.Text(string(output)))
+		if tooLong(stdout, pol) {
+			return false, ErrTooLong
+		}
+		if liveErr := liveError(string(output), live); liveErr != nil {
+			return false, liveErr
+		}
+		return rotated, runError(ctx, output, "download failed")
+	})
 	if err != nil {
-		log.Printf("ERROR: yt-dlp download failed after %d retries: %v, output: %s", maxRetries, err, string(output))
-		return nil, fmt.Errorf("download failed or file exceeds size limit")
+		return nil, err
 	}
 
-	files, err := filepath.Glob(filepath.Join(d.tmpDir, sessionID+"_*"))
-	if err != nil || len(files) == 0 {
-		return nil, fmt.Errorf("downloaded file not found")
+	downloaded, ok := printedFile(stdout, sess.dir)
+	if !ok {
+		// yt-dlp exits cleanly when --match-filters skips the video, which
+		// shows as not even the after_filter line being printed
+		if item.ID == "" && !passedFilter(stdout) {
+			if tooLong(stdout, pol) {
+				return nil, ErrTooLong
+			}
+			return nil, filterSkipError(live)
+		}
+		return nil, noFileError(ctx, pol, output)
 	}
 
-	filePath := files[0]
-	// Extract just the title part for the download filename (remove session ID prefix)
-	baseName := filepath.Base(filePath)
-	fileName := strings.TrimPrefix(baseName, sessionID+"_")
+	// Format fallbacks can produce WebM, MKV or audio-only files, so the
+	// type comes from the file itself
+	filePath, contentType := fixContainer(ctx, downloaded, selectedType(stdout, downloaded))
+	fileName := filepath.Base(filePath)
 
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file info: %w", err)
 	}
 
-	contentType := "video/mp4"
-
-	log.Printf("INFO: File size: %d bytes (%.2f MB)", fileInfo.Size(), float64(fileInfo.Size())/(1024*1024))
+	slog.InfoContext(ctx, "Downloaded file", "size", fileInfo.Size())
 
 	return &DownloadResult{
 		FilePath:    filePath,
@@ -285,7 +599,65 @@ func (d *Downloader) Download(videoURL, format string, videoIndex int) (*Downloa
 	}, nil
 }
 
-func (d *Downloader) buildDownloadArgs(videoURL, format, outputTemplate string, videoIndex int) []string {
+// formatPrefix marks the line with the format yt-dlp selected and the
+// extension it gave the file.
+const formatPrefix = "[viddl-format] "
+
+// mergeFormat is the container of downloads merged from separate video and
+// audio formats.
+const mergeFormat = "mp4"
+
+// selectedType is the content type of the format yt-dlp selected: the merge
+// container when it merged several formats, the format's own extension
+// otherwise. Without the format line it goes by the file's extension.
+func selectedType(stdout []byte, file string) string {
+	ext := strings.TrimPrefix(filepath.Ext(file), ".")
+	for _, line := range bytes.Split(stdout, []byte("\n")) {
+		value, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte(formatPrefix))
+		if !ok {
+			continue
+		}
+		formatID, formatExt, _ := strings.Cut(string(value), " ")
+		ext = formatExt
+		if strings.Contains(formatID, "+") {
+			ext = mergeFormat
+		}
+	}
+	if contentType, ok := extTypes[strings.ToLower(ext)]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// noFileError is the error of a yt-dlp run that exited cleanly with a video
+// past the filters but no file. --print makes yt-dlp quiet, so the only
+// trace of a file over --max-filesize, which yt-dlp skips without failing,
+// is the missing after_move line.
+func noFileError(ctx context.Context, pol policy.Policy, output []byte) error {
+	slog.WarnContext(ctx, "yt-dlp finished without a file, taking it as over the size limit",
+		"max_filesize", pol.MaxFileSize, "output", logging.Text(string(output)))
+	return ErrTooLarge
+}
+
+// persist moves a finished download from the working directory into the
+// result storage and records its key. Storing is not cut short by
+// cancellation, the download is already done.
+func (d *Downloader) persist(ctx context.Context, result *DownloadResult) (*DownloadResult, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+	defer cancel()
+
+	// Names stay flat: "<session>_<file name>"
+	key := d.results.Key(filepath.Base(filepath.Dir(result.FilePath)) + "_" + filepath.Base(result.FilePath))
+	if err := d.results.Put(ctx, key, result.FilePath, result.ContentType); err != nil {
+		slog.ErrorContext(ctx, "Failed to store file", "key", key, "error", err)
+		os.Remove(result.FilePath)
+		return nil, fmt.Errorf("failed to store downloaded file")
+	}
+	result.Key = key
+	return result, nil
+}
+
+func (d *Downloader) buildDownloadArgs(pol policy.Policy, videoURL, format, outputTemplate string, item PlaylistItem, live LiveOptions) []string {
 	isInstagram := strings.Contains(strings.ToLower(videoURL), "instagram.com")
 	isYouTube := strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
 		strings.Contains(strings.ToLower(videoURL), "youtu.be")
@@ -296,51 +668,66 @@ func (d *Downloader) buildDownloadArgs(videoURL, format, outputTemplate string,
 	}
 
 	if isInstagram {
+		// Format 1 is H.264 baseline, which plays on iPhones
 		formatSpec = "1/best[vcodec^=avc]/best[ext=mp4]/best"
-		log.Printf("INFO: Instagram URL detected, using format 1 (H.264 baseline for iPhone)")
 	}
 
-	log.Printf("INFO: Downloading with format: %s", formatSpec)
-	args := []string{"-f", formatSpec, "-o", outputTemplate, "--merge-output-format", "mp4", "--no-warnings", "--restrict-filenames"}
+	args := []string{"-f", formatSpec, "-o", outputTemplate, "--merge-output-format", mergeFormat, "--no-warnings", "--restrict-filenames",
+		"--print", "after_filter:id", "--print", "after_move:filepath",
+		"--print", "after_move:" + formatPrefix + "%(format_id)s %(ext)s", "--no-mtime"}
+	args = append(args, stageArgs...)
 
 	if isYouTube {
-		if d.cookiesFile != "" {
+		if pol.CookiesFile != "" {
 			args = append(args, "--extractor-args", "youtube:player_client=default,web_safari")
 		} else {
 			args = append(args, "--extractor-args", "youtube:player_client=web_safari")
 		}
-		log.Printf("INFO: YouTube URL detected, using web_safari player client")
 	}
 
-	if videoIndex > 0 {
-		args = append(args, "--playlist-items", fmt.Sprintf("%d", videoIndex))
-		log.Printf("INFO: Downloading video index: %d", videoIndex)
-	} else {
-		args = append(args, "--no-playlist")
+	args = append(args, item.args()...)
+	args = append(args, matchFilterArgs(live.filter(), item.filter(), durationFilter(pol))...)
+	args = append(args, durationArgs(pol)...)
+
+	if live.enabled() {
+		args = append(args, live.args()...)
 	}
 
-	args = append(args, "--max-filesize", d.maxFilesize)
+	args = append(args, "--max-filesize", pol.MaxFileSize)
 
-	if d.cookiesFile != "" {
-		args = append(args, "--cookies", d.cookiesFile)
-	}
+	args = append(args, toolArgs(pol)...)
 
 	args = append(args, videoURL)
 	return args
 }
 
-func (d *Downloader) ExtractAudio(videoURL, audioFormat string, videoIndex int) (*DownloadResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+func (d *Downloader) ExtractAudio(ctx context.Context, videoURL, audioFormat string, item PlaylistItem) (result *DownloadResult, err error) {
+	ctx, span := tracing.Start(ctx, "ExtractAudio",
+		attribute.String("platform", metrics.Platform(videoURL)),
+		attribute.String("format", audioFormat))
+	defer func() { endSpan(span, result, err) }()
 
-	if err := os.MkdirAll(d.tmpDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	release, err := d.reserve(ctx, d.maxBytes)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	sessionID, err := generateSessionID()
+	sess, end, err := d.startSession()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
+	defer end()
+	if result, err = d.extractAudio(ctx, sess, videoURL, audioFormat, item); err == nil {
+		result, err = d.persist(ctx, result)
+	}
+	return result, canceled(ctx, err)
+}
+
+func (d *Downloader) extractAudio(ctx context.Context, sess *session, videoURL, audioFormat string, item PlaylistItem) (*DownloadResult, error) {
+	pol := d.toolPolicy(videoURL)
+	ctx, cancel := context.WithTimeout(ctx, pol.Timeout)
+	defer cancel()
 
 	if audioFormat == "" {
 		audioFormat = "mp3"
@@ -351,33 +738,54 @@ func (d *Downloader) ExtractAudio(videoURL, audioFormat string, videoIndex int)
 		audioFormat = "mp3"
 	}
 
-	outputTemplate := filepath.Join(d.tmpDir, sessionID+"_%(title).80s.%(ext)s")
-	args := d.buildAudioArgs(videoURL, audioFormat, outputTemplate, videoIndex)
-
-	log.Printf("INFO: Running yt-dlp audio extraction with args: %v", args)
-	cmd := exec.CommandContext(ctx, "yt-dlp", args...)
-	output, err := cmd.CombinedOutput()
+	outputTemplate := filepath.Join(sess.dir, "%(title).80s.%(ext)s")
+	var stdout, output []byte
+	err := d.retried(ctx, videoURL, func(attempt int) (bool, error) {
+		args := d.buildAudioArgs(pol, videoURL, audioFormat, outputTemplate, item)
+		slog.DebugContext(ctx, "Running yt-dlp", "args", logging.Args(args))
+		start := time.Now()
+		runCtx, span := tracing.Start(ctx, "yt-dlp",
+			attribute.Int("attempt", attempt+1), attribute.String("format", audioFormat))
+		var err error
+		stdout, output, err = d.run(runCtx, d.command(runCtx, sess.dir, "yt-dlp", args...))
+		tracing.End(span, err)
+		metrics.ObserveYtdlp(ctx, metrics.Platform(videoURL), "audio", start, err)
+		rotated := d.report(&pol, videoURL, output, err)
+		if err == nil {
+			return false, nil
+		}
+		slog.ErrorContext(ctx, "yt-dlp audio extraction failed", "attempt", attempt+1, "error", err, "output", logging.Text(string(output)))
+		if tooLong(stdout, pol) {
+			return false, ErrTooLong
+		}
+		if liveErr := liveError(string(output), LiveOptions{}); liveErr != nil {
+			return false, liveErr
+		}
+		return rotated, runError(ctx, output, "audio extraction failed")
+	})
 	if err != nil {
-		log.Printf("ERROR: yt-dlp audio extraction error: %v, output: %s", err, string(output))
-		return nil, fmt.Errorf("audio extraction failed")
+		return nil, err
 	}
 
-	files, err := filepath.Glob(filepath.Join(d.tmpDir, sessionID+"_*"))
-	if err != nil || len(files) == 0 {
-		return nil, fmt.Errorf("extracted audio file not found")
+	extracted, ok := printedFile(stdout, sess.dir)
+	if !ok {
+		if item.ID == "" && !passedFilter(stdout) {
+			if tooLong(stdout, pol) {
+				return nil, ErrTooLong
+			}
+			return nil, filterSkipError(LiveOptions{})
+		}
+		return nil, noFileError(ctx, pol, output)
 	}
 
-	filePath := files[0]
-	baseName := filepath.Base(filePath)
-	fileName := strings.TrimPrefix(baseName, sessionID+"_")
+	filePath, contentType := fixContainer(ctx, extracted, getAudioContentType(audioFormat))
+	fileName := filepath.Base(filePath)
 
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file info: %w", err)
 	}
-
-	contentType := getAudioContentType(audioFormat)
-	log.Printf("INFO: Audio file size: %d bytes (%.2f MB)", fileInfo.Size(), float64(fileInfo.Size())/(1024*1024))
+	slog.InfoContext(ctx, "Extracted audio", "size", fileInfo.Size())
 
 	return &DownloadResult{
 		FilePath:    filePath,
@@ -387,31 +795,29 @@ func (d *Downloader) ExtractAudio(videoURL, audioFormat string, videoIndex int)
 	}, nil
 }
 
-func (d *Downloader) buildAudioArgs(videoURL, audioFormat, outputTemplate string, videoIndex int) []string {
+func (d *Downloader) buildAudioArgs(pol policy.Policy, videoURL, audioFormat, outputTemplate string, item PlaylistItem) []string {
 	isYouTube := strings.Contains(strings.ToLower(videoURL), "youtube.com") ||
 		strings.Contains(strings.ToLower(videoURL), "youtu.be")
 
-	args := []string{"-x", "--audio-format", audioFormat, "-o", outputTemplate, "--no-warnings", "--restrict-filenames"}
+	args := []string{"-x", "--audio-format", audioFormat, "-o", outputTemplate, "--no-warnings", "--restrict-filenames",
+		"--print", "after_filter:id", "--print", "after_move:filepath", "--no-mtime"}
+	args = append(args, stageArgs...)
 
 	if isYouTube {
-		if d.cookiesFile != "" {
+		if pol.CookiesFile != "" {
 			args = append(args, "--extractor-args", "youtube:player_client=default,web_safari")
 		} else {
 			args = append(args, "--extractor-args", "youtube:player_client=web_safari")
 		}
 	}
 
-	if videoIndex > 0 {
-		args = append(args, "--playlist-items", fmt.Sprintf("%d", videoIndex))
-	} else {
-		args = append(args, "--no-playlist")
-	}
+	args = append(args, item.args()...)
+	args = append(args, matchFilterArgs(LiveOptions{}.filter(), item.filter(), durationFilter(pol))...)
+	args = append(args, durationArgs(pol)...)
 
-	args = append(args, "--max-filesize", d.maxFilesize)
+	args = append(args, "--max-filesize", pol.MaxFileSize)
 
-	if d.cookiesFile != "" {
-		args = append(args, "--cookies", d.cookiesFile)
-	}
+	args = append(args, toolArgs(pol)...)
 
 	args = append(args, videoURL)
 	return args
@@ -436,16 +842,6 @@ func getAudioContentType(format string) string {
 	}
 }
 
-func (d *Downloader) CheckHealth() error {
-	if d.healthChecked {
-		return d.healthError
-	}
-	cmd := exec.Command("yt-dlp", "--version")
-	d.healthError = cmd.Run()
-	d.healthChecked = true
-	return d.healthError
-}
-
 func generateSessionID() (string, error) {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
@@ -476,4 +872,3 @@ func getQualityLabel(height int) string {
 		return fmt.Sprintf("%dp", height)
 	}
 }
-
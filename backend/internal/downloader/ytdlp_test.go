@@ -0,0 +1,304 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"viddl.me/backend/internal/proxy"
+	"viddl.me/backend/internal/retry"
+)
+
+func TestParseFlatPlaylist(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		wantIndex []int
+		wantID    []string
+		wantURL   []string
+		wantType  []string
+	}{
+		{
+			name:      "youtube playlist with blank line, warning and hidden entry",
+			file:      "flat_playlist_youtube.jsonl",
+			wantIndex: []int{1, 2, 4},
+			wantID:    []string{"dQw4w9WgXcQ", "9bZkp7q19f0", "kJQP7kiw5Fk"},
+			wantURL: []string{
+				"https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+				"https://www.youtube.com/watch?v=9bZkp7q19f0",
+				"https://www.youtube.com/watch?v=kJQP7kiw5Fk",
+			},
+			wantType: []string{"video", "video", "video"},
+		},
+		{
+			name:      "twitter post with two videos",
+			file:      "flat_playlist_twitter.jsonl",
+			wantIndex: []int{1, 2},
+			wantID:    []string{"1843210987654321001", "1843210987654321002"},
+			wantURL:   []string{"", ""},
+			wantType:  []string{"video", "video"},
+		},
+		{
+			name:      "instagram carousel mixing a video and images",
+			file:      "flat_playlist_instagram_carousel.jsonl",
+			wantIndex: []int{1, 2, 3},
+			wantID:    []string{"3456789012345678901", "3456789012345678902", "3456789012345678903"},
+			wantURL: []string{
+				"",
+				"https://scontent.cdninstagram.com/v/t51.2885-15/second.jpg",
+				"https://scontent.cdninstagram.com/v/t51.2885-15/third.webp",
+			},
+			wantType: []string{"video", "image", "image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatalf("reading fixture: %v", err)
+			}
+
+			entries := parseFlatPlaylist(output)
+			var gotIndex []int
+			var gotID, gotURL, gotType []string
+			for _, e := range entries {
+				gotIndex = append(gotIndex, e.Index)
+				gotID = append(gotID, e.ID)
+				gotURL = append(gotURL, e.URL)
+				gotType = append(gotType, e.MediaType)
+			}
+
+			if !reflect.DeepEqual(gotIndex, tt.wantIndex) {
+				t.Errorf("indexes = %v, want %v", gotIndex, tt.wantIndex)
+			}
+			if !reflect.DeepEqual(gotID, tt.wantID) {
+				t.Errorf("ids = %v, want %v", gotID, tt.wantID)
+			}
+			if !reflect.DeepEqual(gotURL, tt.wantURL) {
+				t.Errorf("urls = %v, want %v", gotURL, tt.wantURL)
+			}
+			if !reflect.DeepEqual(gotType, tt.wantType) {
+				t.Errorf("media types = %v, want %v", gotType, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestParseFlatPlaylistWithoutPlaylistIndex(t *testing.T) {
+	output := []byte(`{"_type": "url", "id": "a"}
+
+{"_type": "playlist", "id": "list"}
+{"_type": "url", "id": "b"}
+`)
+
+	entries := parseFlatPlaylist(output)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0].Index != 1 || entries[1].Index != 2 {
+		t.Errorf("indexes = %d, %d, want 1, 2", entries[0].Index, entries[1].Index)
+	}
+}
+
+func TestPlaylistItemArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		item PlaylistItem
+		want []string
+	}{
+		{
+			name: "no selection",
+			item: PlaylistItem{},
+			want: []string{"--no-playlist"},
+		},
+		{
+			name: "by index",
+			item: PlaylistItem{Index: 4},
+			want: []string{"--playlist-items", "4"},
+		},
+		{
+			name: "id takes precedence over index",
+			item: PlaylistItem{Index: 4, ID: "kJQP7kiw5Fk"},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.item.args(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeYtDlp stands in for yt-dlp: it fetches the URL through --proxy with
+// curl and reports HTTP errors the way yt-dlp does.
+const fakeYtDlp = `#!/bin/sh
+for arg; do
+	[ "$prev" = --proxy ] && proxy=$arg
+	prev=$arg
+done
+code=$(curl -s -o video.mp4 -w '%{http_code}' --proxy "$proxy" "$arg")
+if [ "$code" != 200 ]; then
+	echo "ERROR: [generic] Unable to download webpage: HTTP Error $code: Too Many Requests" >&2
+	exit 1
+fi
+echo id
+echo "$(pwd)/video.mp4"
+`
+
+func TestDownloadRotatesBlockedProxy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("needs curl")
+	}
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "yt-dlp"), []byte(fakeYtDlp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// Local proxy stubs: one the platform has blocked, one that works
+	var blockedHits, okHits atomic.Int32
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blockedHits.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer blocked.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		okHits.Add(1)
+		if !strings.HasPrefix(r.RequestURI, "http://video.example/") {
+			t.Errorf("proxy got %q, want an absolute URL", r.RequestURI)
+		}
+		w.Write([]byte("not really a video"))
+	}))
+	defer ok.Close()
+
+	pool := proxy.NewPool([]string{blocked.URL, ok.URL}, proxy.RoundRobin, time.Hour)
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20, proxies: pool}
+	d.Configure("", nil, nil, time.Minute, retry.Policy{Attempts: 2})
+	sess, end, err := d.startSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	result, err := d.download(context.Background(), sess, "http://video.example/watch?v=1", "best", PlaylistItem{}, LiveOptions{})
+	if err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+	if result.FileSize != int64(len("not really a video")) {
+		t.Errorf("FileSize = %d", result.FileSize)
+	}
+	if blockedHits.Load() != 1 || okHits.Load() != 1 {
+		t.Errorf("proxy hits = %d blocked, %d ok, want one each", blockedHits.Load(), okHits.Load())
+	}
+
+	_, stats := d.ProxyStats()
+	if stats[0].Blocks != 1 || stats[0].QuarantinedUntil == nil {
+		t.Errorf("blocked proxy stats = %+v, want it in quarantine", stats[0])
+	}
+	if stats[1].Failures != 0 {
+		t.Errorf("working proxy stats = %+v, want no failures", stats[1])
+	}
+	if got := pool.Pick(); got != ok.URL {
+		t.Errorf("next Pick() = %s, want the working proxy", got)
+	}
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	// yt-dlp skips files over --max-filesize without an error, and --print
+	// keeps it from saying so
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho id\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "yt-dlp"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20}
+	d.Configure("", nil, nil, time.Minute, retry.Policy{Attempts: 2, On: RetryableCodes})
+	sess, end, err := d.startSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer end()
+
+	_, err = d.download(context.Background(), sess, "http://video.example/watch?v=1", "best", PlaylistItem{}, LiveOptions{})
+	if e := AsError(err); e.Code != CodeTooLarge || e.Retryable {
+		t.Errorf("download() error = %+v, want too_large, not retryable", e)
+	}
+}
+
+func TestSelectedType(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		want   string
+	}{
+		{name: "merged", stdout: "id\n/tmp/s/a.mp4\n[viddl-format] 137+140 mp4\n", want: "video/mp4"},
+		{name: "single webm", stdout: "id\n/tmp/s/a.webm\n[viddl-format] 43 webm\n", want: "video/webm"},
+		{name: "audio only", stdout: "id\n/tmp/s/a.m4a\n[viddl-format] 140 m4a\n", want: "audio/mp4"},
+		{name: "no format line", stdout: "id\n/tmp/s/a.mkv\n", want: "video/x-matroska"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := strings.Split(tt.stdout, "\n")[1]
+			if got := selectedType([]byte(tt.stdout), file); got != tt.want {
+				t.Errorf("selectedType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVideoInfoEndsWithContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	// A stuck extractor
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "yt-dlp"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := &Downloader{tmpDir: t.TempDir(), maxBytes: 1 << 20}
+	d.Configure("", nil, nil, 200*time.Millisecond, retry.Policy{Attempts: 3, On: RetryableCodes})
+
+	start := time.Now()
+	_, err := d.GetVideoInfo(context.Background(), "https://www.youtube.com/watch?v=1")
+	if e := AsError(err); e.Code != CodeTimeout {
+		t.Errorf("GetVideoInfo() past the timeout error = %+v, want timeout", e)
+	}
+
+	d.Configure("", nil, nil, time.Minute, retry.Policy{Attempts: 3, On: RetryableCodes})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := d.GetVideoInfo(ctx, "https://www.youtube.com/watch?v=1"); !errors.Is(err, ErrCanceled) {
+		t.Errorf("GetVideoInfo() with a canceled context error = %v, want ErrCanceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("lookups took %v, want them ended with their contexts", elapsed)
+	}
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/cleanup"
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/downloader"
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/middleware"
+)
+
+// Admin serves the /admin API for inspecting and steering a running
+// server.
+type Admin struct {
+	handler     *Handler
+	limiter     *middleware.IPRateLimiter
+	concurrent  *middleware.ConcurrentDownloadLimiter
+	maintenance *middleware.Maintenance
+	cleaners    []*cleanup.Cleaner
+}
+
+func NewAdmin(h *Handler, limiter *middleware.IPRateLimiter, concurrent *middleware.ConcurrentDownloadLimiter, maintenance *middleware.Maintenance, cleaners ...*cleanup.Cleaner) *Admin {
+	return &Admin{
+		handler:     h,
+		limiter:     limiter,
+		concurrent:  concurrent,
+		maintenance: maintenance,
+		cleaners:    cleaners,
+	}
+}
+
+// activeJob is a running download with its yt-dlp processes.
+type activeJob struct {
+	jobs.Job
+	Running   string               `json:"running"`
+	Processes []downloader.Process `json:"processes"`
+}
+
+// Jobs lists running downloads and their processes. Processes of info
+// requests, which are not jobs, are listed separately.
+func (a *Admin) Jobs(c *gin.Context) {
+	byJob := make(map[string][]downloader.Process)
+	var other []downloader.Process
+	for _, p := range a.handler.downloader.Processes() {
+		if p.Job == "" {
+			other = append(other, p)
+			continue
+		}
+		byJob[p.Job] = append(byJob[p.Job], p)
+	}
+
+	running := a.handler.RunningJobs()
+	list := make([]activeJob, 0, len(running))
+	for _, job := range running {
+		list = append(list, activeJob{
+			Job:       job,
+			Running:   time.Since(job.CreatedAt).Round(time.Second).String(),
+			Processes: byJob[job.ID],
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": list, "other_processes": other})
+}
+
+func (a *Admin) CancelJob(c *gin.Context) {
+	if !a.handler.CancelJob(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found or not running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": "canceling"})
+}
+
+// Limits reports the per-IP rate limiters, running downloads per IP and
+// bans.
+func (a *Admin) Limits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"rate_limits": a.limiter.Entries(),
+		"concurrent":  a.concurrent.Active(),
+		"bans":        a.limiter.Bans(),
+	})
+}
+
+// BanIP bans an IP, for the optional duration query parameter or until it
+// is unblocked.
+func (a *Admin) BanIP(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid IP address"})
+		return
+	}
+
+	var d time.Duration
+	if s := c.Query("duration"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration"})
+			return
+		}
+	}
+
+	a.limiter.Ban(ip.String(), d)
+	c.JSON(http.StatusOK, gin.H{"bans": a.limiter.Bans()})
+}
+
+// UnblockIP lifts a ban and resets the IP's rate limit.
+func (a *Admin) UnblockIP(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid IP address"})
+		return
+	}
+	a.limiter.Unblock(ip.String())
+	c.JSON(http.StatusOK, gin.H{"bans": a.limiter.Bans()})
+}
+
+// Disk reports space used and reserved in the tmp directory.
+func (a *Admin) Disk(c *gin.Context) {
+	usage, err := a.handler.downloader.DiskUsage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tmp_dir":  a.handler.current().TmpDir,
+		"disk":     usage,
+		"sessions": a.handler.downloader.ActiveSessions(),
+	})
+}
+
+// Proxies reports how each outbound proxy fares and which are in
+// quarantine.
+func (a *Admin) Proxies(c *gin.Context) {
+	strategy, stats := a.handler.downloader.ProxyStats()
+	c.JSON(http.StatusOK, gin.H{"strategy": strategy, "proxies": stats})
+}
+
+// Breakers reports the circuit breaker of each platform that has failed
+// and whether it is failing requests fast.
+func (a *Admin) Breakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": a.handler.downloader.Breakers()})
+}
+
+func (a *Admin) CookieJars(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jars": a.handler.downloader.CookieJars()})
+}
+
+// maxCookiesFile is the largest cookies file accepted by UploadCookies.
+const maxCookiesFile = 1 << 20
+
+// UploadCookies replaces the file of a cookie jar with the Netscape
+// cookies file in the request body and puts the jar back in rotation.
+func (a *Admin) UploadCookies(c *gin.Context) {
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCookiesFile))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "cookies file too large"})
+		return
+	}
+	info, err := cookies.CheckUpload(data, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jar, err := a.handler.downloader.ReplaceCookieJar(c.Param("name"), data)
+	switch {
+	case errors.Is(err, cookies.ErrUnknownJar):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		slog.ErrorContext(c.Request.Context(), "Failed to write cookies file", "jar", c.Param("name"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to write cookies file"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jar": jar, "expired": info.Expired})
+}
+
+// Sweep runs every cleaner now and reports what they removed.
+func (a *Admin) Sweep(c *gin.Context) {
+	results := make([]cleanup.SweepResult, 0, len(a.cleaners))
+	for _, cleaner := range a.cleaners {
+		results = append(results, cleaner.Sweep())
+	}
+	c.JSON(http.StatusOK, gin.H{"sweeps": results})
+}
+
+func (a *Admin) Maintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": a.maintenance.Enabled()})
+}
+
+// SetMaintenance turns maintenance mode on or off. Running downloads are
+// not affected.
+func (a *Admin) SetMaintenance(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	a.maintenance.Set(*req.Enabled)
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": a.maintenance.Enabled(),
+		"running": len(a.handler.RunningJobs()),
+	})
+}
@@ -1,31 +1,86 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"viddl.me/backend/internal/apikeys"
+	"viddl.me/backend/internal/buildinfo"
 	"viddl.me/backend/internal/cleanup"
 	"viddl.me/backend/internal/config"
 	"viddl.me/backend/internal/downloader"
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/links"
+	"viddl.me/backend/internal/logging"
+	"viddl.me/backend/internal/metrics"
 	"viddl.me/backend/internal/models"
+	"viddl.me/backend/internal/policy"
+	"viddl.me/backend/internal/storage"
+	"viddl.me/backend/internal/tracing"
 )
 
 type Handler struct {
-	cfg        *config.Config
+	cfg        atomic.Pointer[config.Config]
 	downloader *downloader.Downloader
+	store      storage.Storage
+	jobs       *jobs.Store
+	scheduler  *cleanup.Scheduler
+	keys       *apikeys.Store
+	links      *links.Signer
+
+	runningMu sync.Mutex
+	running   map[string]*runningJob
+	idle      chan struct{} // closed while no job is running
+}
+
+// runningJob is a download in progress that can be canceled.
+type runningJob struct {
+	job    jobs.Job
+	cancel context.CancelFunc
 }
 
-func New(cfg *config.Config) *Handler {
-	dl := downloader.New(cfg.TmpDir, cfg.CookiesFile, cfg.MaxDownloadSize)
-	return &Handler{
-		cfg:        cfg,
+func New(cfg *config.Config, dl *downloader.Downloader, store storage.Storage, jobStore *jobs.Store, scheduler *cleanup.Scheduler, keys *apikeys.Store) *Handler {
+	h := &Handler{
 		downloader: dl,
+		store:      store,
+		jobs:       jobStore,
+		scheduler:  scheduler,
+		keys:       keys,
+		links:      links.NewSigner(cfg.LinkSecret),
+		running:    make(map[string]*runningJob),
+		idle:       closedChan(),
 	}
+	h.cfg.Store(cfg)
+	return h
+}
+
+// SetConfig switches to a reloaded configuration. Requests in progress
+// finish with the one they started with.
+func (h *Handler) SetConfig(cfg *config.Config) {
+	h.cfg.Store(cfg)
+}
+
+func (h *Handler) current() *config.Config {
+	return h.cfg.Load()
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
 }
 
 func (h *Handler) GetVideoInfo(c *gin.Context) {
@@ -35,15 +90,15 @@ func (h *Handler) GetVideoInfo(c *gin.Context) {
 		return
 	}
 
-	sanitizedURL, err := downloader.SanitizeURL(req.URL, h.cfg.AllowedDomains)
+	sanitizedURL, err := h.sanitizeURL(c, req.URL, policy.ModeInfo)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondURLError(c, err)
 		return
 	}
 
-	info, err := h.downloader.GetVideoInfo(sanitizedURL)
+	info, err := h.downloader.GetVideoInfo(c.Request.Context(), sanitizedURL)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondDownloadError(c, err)
 		return
 	}
 
@@ -57,30 +112,44 @@ func (h *Handler) DownloadVideo(c *gin.Context) {
 		return
 	}
 
-	sanitizedURL, err := downloader.SanitizeURL(req.URL, h.cfg.AllowedDomains)
+	sanitizedURL, err := h.sanitizeURL(c, req.URL, policy.ModeVideo)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondURLError(c, err)
 		return
 	}
 
-	format := downloader.SanitizeFormat(req.Format)
-	log.Printf("INFO: Download request from %s for URL: %s, format: %s",
-		c.ClientIP(), sanitizedURL, format)
+	videoID, err := downloader.SanitizeVideoID(req.VideoID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	result, err := h.downloader.Download(sanitizedURL, format, req.VideoIndex)
+	live, err := downloader.SanitizeLiveOptions(req.LiveMode, req.LiveMinutes, sanitizedURL)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("INFO: Serving file: %s to client: %s", result.FileName, c.ClientIP())
-	cleanup.ScheduleFileRemoval(result.FilePath, 60*time.Second)
+	format := downloader.SanitizeFormat(req.Format)
+	slog.InfoContext(c.Request.Context(), "Download request",
+		"client_ip", c.ClientIP(), "url", logging.URL(sanitizedURL), "format", format)
 
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", "attachment; filename="+result.FileName)
-	c.Header("Content-Type", result.ContentType)
-	c.Header("Content-Length", fmt.Sprintf("%d", result.FileSize))
-	c.File(result.FilePath)
+	item := downloader.PlaylistItem{Index: req.VideoIndex, ID: videoID}
+	job, ctx, err := h.startJob(c, "video", sanitizedURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start download"})
+		return
+	}
+	defer h.endJob(job.ID)
+	result, err := h.downloader.Download(ctx, sanitizedURL, format, item, live)
+	if err != nil {
+		h.failJob(job, err)
+		respondDownloadError(c, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "Issuing link", "file", result.FileName)
+	h.issueLink(c, job, result)
 }
 
 func (h *Handler) ExtractAudio(c *gin.Context) {
@@ -90,52 +159,517 @@ func (h *Handler) ExtractAudio(c *gin.Context) {
 		return
 	}
 
-	sanitizedURL, err := downloader.SanitizeURL(req.URL, h.cfg.AllowedDomains)
+	sanitizedURL, err := h.sanitizeURL(c, req.URL, policy.ModeAudio)
+	if err != nil {
+		respondURLError(c, err)
+		return
+	}
+
+	videoID, err := downloader.SanitizeVideoID(req.VideoID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("INFO: Audio extraction request from %s for URL: %s, format: %s",
-		c.ClientIP(), sanitizedURL, req.AudioFormat)
+	slog.InfoContext(c.Request.Context(), "Audio extraction request",
+		"client_ip", c.ClientIP(), "url", logging.URL(sanitizedURL), "format", req.AudioFormat)
+
+	item := downloader.PlaylistItem{Index: req.VideoIndex, ID: videoID}
+	job, ctx, err := h.startJob(c, "audio", sanitizedURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start download"})
+		return
+	}
+	defer h.endJob(job.ID)
+	result, err := h.downloader.ExtractAudio(ctx, sanitizedURL, req.AudioFormat, item)
+	if err != nil {
+		h.failJob(job, err)
+		respondDownloadError(c, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "Issuing link", "file", result.FileName)
+	h.issueLink(c, job, result)
+}
+
+func (h *Handler) DownloadImages(c *gin.Context) {
+	var req models.ImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	sanitizedURL, err := h.sanitizeURL(c, req.URL, policy.ModeImage)
+	if err != nil {
+		respondURLError(c, err)
+		return
+	}
 
-	result, err := h.downloader.ExtractAudio(sanitizedURL, req.AudioFormat, req.VideoIndex)
+	videoID, err := downloader.SanitizeVideoID(req.VideoID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("INFO: Serving audio file: %s to client: %s", result.FileName, c.ClientIP())
-	cleanup.ScheduleFileRemoval(result.FilePath, 60*time.Second)
+	if key := apikeys.FromContext(c); key != nil && req.All && !key.Allows(apikeys.ScopeBatch) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is not allowed to download whole posts"})
+		return
+	}
 
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", "attachment; filename="+result.FileName)
-	c.Header("Content-Type", result.ContentType)
-	c.Header("Content-Length", fmt.Sprintf("%d", result.FileSize))
-	c.File(result.FilePath)
+	slog.InfoContext(c.Request.Context(), "Image request",
+		"client_ip", c.ClientIP(), "url", logging.URL(sanitizedURL), "all", req.All)
+
+	item := downloader.PlaylistItem{Index: req.VideoIndex, ID: videoID}
+	job, ctx, err := h.startJob(c, "image", sanitizedURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start download"})
+		return
+	}
+	defer h.endJob(job.ID)
+	result, err := h.downloader.DownloadImages(ctx, sanitizedURL, item, req.All)
+	if err != nil {
+		h.failJob(job, err)
+		respondDownloadError(c, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "Issuing link", "file", result.FileName)
+	h.issueLink(c, job, result)
 }
 
-func (h *Handler) HealthCheck(c *gin.Context) {
-	if err := h.downloader.CheckHealth(); err != nil {
-		c.JSON(http.StatusServiceUnavailable, models.HealthResponse{
-			Status: "unhealthy",
-			Error:  "yt-dlp not available",
-		})
+// errModeNotAllowed is returned by sanitizeURL for a domain whose policy
+// does not allow the request's mode.
+var errModeNotAllowed = errors.New("this platform does not allow this kind of download")
+
+// sanitizeURL validates the requested URL against the allowed domains and
+// the mode against the domain's policy.
+func (h *Handler) sanitizeURL(c *gin.Context, rawURL, mode string) (string, error) {
+	_, span := tracing.Start(c.Request.Context(), "SanitizeURL")
+	policies := h.current().AllowedDomains
+	sanitized, err := downloader.SanitizeURL(rawURL, policies.Domains())
+	if err == nil {
+		span.SetAttributes(attribute.String("platform", metrics.Platform(sanitized)))
+		if p, _ := policies.LookupURL(sanitized); !p.Allows(mode) {
+			err = errModeNotAllowed
+		}
+	}
+	tracing.End(span, err)
+	return sanitized, err
+}
+
+// respondURLError answers a request whose URL sanitizeURL refused.
+func respondURLError(c *gin.Context, err error) {
+	if errors.Is(err, errModeNotAllowed) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// RateWeight returns how many requests a request counts as against the
+// per-IP rate limit, set by the policy of the URL in its body. The body is
+// left for the handler to read.
+func (h *Handler) RateWeight(c *gin.Context) int {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64*1024))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+	if err != nil {
+		return 1
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return 1
+	}
+	p, _ := h.current().AllowedDomains.LookupURL(req.URL)
+	return p.Weight()
+}
+
+// startJob records a new download owned by the requesting client and
+// returns the context to run it in, canceled by CancelJob. endJob must be
+// called when the download is over.
+func (h *Handler) startJob(c *gin.Context, kind, url string) (*jobs.Job, context.Context, error) {
+	id, err := jobs.NewID()
+	if err != nil {
+		return nil, nil, err
+	}
+	job := &jobs.Job{
+		ID:     id,
+		Kind:   kind,
+		URL:    url,
+		Owner:  c.ClientIP(),
+		Status: jobs.StatusRunning,
+	}
+	if key := apikeys.FromContext(c); key != nil {
+		job.APIKey = key.Name
+	}
+	if err := h.jobs.Put(job); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to record job", "error", err)
+		return nil, nil, err
+	}
+
+	// Downloads run to completion even if the client goes away, but stay
+	// in the request's trace and logs
+	ctx := context.WithoutCancel(c.Request.Context())
+	ctx, cancel := context.WithCancel(downloader.WithJob(ctx, job.ID))
+	h.runningMu.Lock()
+	if len(h.running) == 0 {
+		h.idle = make(chan struct{})
+	}
+	h.running[job.ID] = &runningJob{job: *job, cancel: cancel}
+	h.runningMu.Unlock()
+	return job, ctx, nil
+}
+
+func (h *Handler) endJob(id string) {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+	if r, ok := h.running[id]; ok {
+		r.cancel()
+		delete(h.running, id)
+		if len(h.running) == 0 {
+			close(h.idle)
+		}
+	}
+}
+
+// CancelJob stops a running download. It reports false if the job is not
+// running.
+func (h *Handler) CancelJob(id string) bool {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+	r, ok := h.running[id]
+	if ok {
+		slog.Warn("Canceling job", "job_id", id, "url", logging.URL(r.job.URL))
+		r.cancel()
+	}
+	return ok
+}
+
+// CancelAll stops every running download and returns how many there were.
+func (h *Handler) CancelAll() int {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+	for _, r := range h.running {
+		r.cancel()
+	}
+	return len(h.running)
+}
+
+// WaitIdle waits until no download is running or ctx is done.
+func (h *Handler) WaitIdle(ctx context.Context) error {
+	h.runningMu.Lock()
+	idle := h.idle
+	h.runningMu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RunningJobs returns the downloads in progress, oldest first.
+func (h *Handler) RunningJobs() []jobs.Job {
+	h.runningMu.Lock()
+	defer h.runningMu.Unlock()
+	list := make([]jobs.Job, 0, len(h.running))
+	for _, r := range h.running {
+		list = append(list, r.job)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// failJob marks a job failed. The record is kept as long as a link would
+// have been, then removed by the scheduler.
+func (h *Handler) failJob(job *jobs.Job, cause error) {
+	job.Status = jobs.StatusFailed
+	job.Error = cause.Error()
+	job.ErrorCode = downloader.AsError(cause).Code
+	job.ExpiresAt = time.Now().Add(h.current().LinkTTL)
+	if err := h.jobs.Put(job); err != nil {
+		slog.Error("Failed to update job", "job_id", job.ID, "error", err)
+	}
+	h.scheduler.Schedule(job)
+}
+
+// issueLink answers a finished download with a signed link to the file.
+// The file is kept until the link expires.
+func (h *Handler) issueLink(c *gin.Context, job *jobs.Job, result *downloader.DownloadResult) {
+	cfg := h.current()
+	expires := time.Now().Add(cfg.LinkTTL)
+	claims := &links.Claims{
+		Key:         result.Key,
+		FileName:    result.FileName,
+		ContentType: result.ContentType,
+		Expires:     expires.Unix(),
+		MaxUses:     cfg.LinkMaxUses,
+	}
+	if cfg.LinkBindIP {
+		claims.IP = c.ClientIP()
+	}
+
+	token, err := h.links.Sign(claims)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to sign download link", "job_id", job.ID, "error", err)
+		h.store.Delete(c.Request.Context(), result.Key)
+		h.failJob(job, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create download link"})
+		return
+	}
+
+	job.Status = jobs.StatusDone
+	job.Key = result.Key
+	job.Size = result.FileSize
+	job.ExpiresAt = expires
+	if err := h.jobs.Put(job); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to update job", "job_id", job.ID, "error", err)
+	}
+	h.scheduler.Schedule(job)
+
+	if key := apikeys.FromContext(c); key != nil {
+		h.keys.Record(key, 1, result.FileSize)
+	}
+
+	path := "/dl/" + token
+	base := cfg.PublicURL
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+
+	c.JSON(http.StatusOK, models.DownloadLink{
+		URL:         base + path,
+		Path:        path,
+		FileName:    result.FileName,
+		FileSize:    result.FileSize,
+		ContentType: result.ContentType,
+		ExpiresAt:   expires.Unix(),
+		MaxUses:     cfg.LinkMaxUses,
+	})
+}
+
+// KeyUsage reports each API key's usage and quotas for the current month.
+func (h *Handler) KeyUsage(c *gin.Context) {
+	usage, err := h.keys.Usage()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to read API key usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read usage"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": usage})
+}
+
+// ServeLink sends the file behind a signed download link. Only complete
+// transfers of the whole file count as a use, so players and download
+// managers can fetch ranges. Whole-file requests take their use before
+// sending and give it back if the transfer ends short. The file is removed
+// once the last use has been served.
+func (h *Handler) ServeLink(c *gin.Context) {
+	claims, err := h.links.Verify(c.Param("token"), c.ClientIP())
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, links.ErrExpired) {
+			status = http.StatusGone
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Range requests only need a use left, they don't take one
+	whole := c.GetHeader("Range") == ""
+	left := -1
+	if whole {
+		left, err = h.links.Use(claims)
+	} else {
+		err = h.links.Check(claims)
+	}
+	if err != nil {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+	complete := false
+	if whole {
+		defer func() {
+			if !complete {
+				h.links.Release(claims)
+			}
+		}()
+	}
+
+	r, obj, err := h.store.Open(c.Request.Context(), claims.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusGone, gin.H{"error": "file is no longer available"})
 		return
 	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to open stored file", "key", claims.Key, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read downloaded file"})
+		return
+	}
+	defer r.Close()
+
+	slog.InfoContext(c.Request.Context(), "Serving file",
+		"file", claims.FileName, "client_ip", c.ClientIP(), "range", c.GetHeader("Range"))
+
+	_, span := tracing.Start(c.Request.Context(), "send file",
+		attribute.String("content_type", claims.ContentType),
+		attribute.Int64("file_size", obj.Size))
+
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename="+claims.FileName)
+	c.Header("Content-Type", claims.ContentType)
+
+	http.ServeContent(c.Writer, c.Request, claims.FileName, obj.ModTime, r)
+	if n := c.Writer.Size(); n > 0 {
+		metrics.BytesServed.Add(float64(n))
+		span.SetAttributes(attribute.Int("bytes", n))
+	}
+	span.End()
+
+	complete = c.Writer.Status() == http.StatusOK && int64(c.Writer.Size()) == obj.Size
+	if whole && complete && left == 0 {
+		h.scheduler.Expire(claims.Key)
+	}
+}
+
+// errorStatus is the HTTP status of each downloader error code. Codes not
+// listed, failures of yt-dlp or the platform nothing more is known about,
+// are 502.
+var errorStatus = map[string]int{
+	downloader.CodePrivate:             http.StatusForbidden,
+	downloader.CodeAgeRestricted:       http.StatusForbidden,
+	downloader.CodeLoginRequired:       http.StatusForbidden,
+	downloader.CodeGeoBlocked:          http.StatusUnavailableForLegalReasons,
+	downloader.CodeRemoved:             http.StatusNotFound,
+	downloader.CodeRateLimited:         http.StatusServiceUnavailable,
+	downloader.CodeTooLarge:            http.StatusRequestEntityTooLarge,
+	downloader.CodeTooLong:             http.StatusUnprocessableEntity,
+	downloader.CodeUnsupportedURL:      http.StatusUnprocessableEntity,
+	downloader.CodeFormatUnavailable:   http.StatusUnprocessableEntity,
+	downloader.CodeInvalidItem:         http.StatusBadRequest,
+	downloader.CodeTimeout:             http.StatusGatewayTimeout,
+	downloader.CodeUpstream:            http.StatusBadGateway,
+	downloader.CodePlatformUnavailable: http.StatusServiceUnavailable,
+	downloader.CodeDiskFull:            http.StatusInsufficientStorage,
+	downloader.CodeDiskBusy:            http.StatusServiceUnavailable,
+	downloader.CodeCanceled:            http.StatusConflict,
+	downloader.CodeUpcoming:            http.StatusConflict,
+	downloader.CodeNotStarted:          http.StatusConflict,
+	downloader.CodeLiveStream:          http.StatusConflict,
+	downloader.CodeNotLive:             http.StatusConflict,
+}
+
+// liveStates are the states the frontend acts on for live stream errors.
+var liveStates = map[string]string{
+	downloader.CodeUpcoming:   "scheduled",
+	downloader.CodeNotStarted: "offline",
+	downloader.CodeLiveStream: "live",
+	downloader.CodeNotLive:    "ended",
+}
+
+// respondDownloadError answers with the error's code, whether retrying may
+// help and after how many seconds. "error" repeats the message for clients
+// predating the codes.
+func respondDownloadError(c *gin.Context, err error) {
+	e := downloader.AsError(err)
+	status, ok := errorStatus[e.Code]
+	if !ok {
+		status = http.StatusBadGateway
+	}
+	retryAfter := int(e.RetryAfter.Seconds())
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+	}
+	body := gin.H{
+		"error":       e.Message,
+		"code":        e.Code,
+		"message":     e.Message,
+		"retryable":   e.Retryable,
+		"retry_after": retryAfter,
+	}
+	if state, ok := liveStates[e.Code]; ok {
+		body["state"] = state
+	}
+	c.JSON(status, body)
+}
+
+// Livez reports that the process is up and serving requests.
+func (h *Handler) Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, models.HealthResponse{Status: "ok"})
+}
 
-	testFile := filepath.Join(h.cfg.TmpDir, ".health_check")
-	if err := os.WriteFile(testFile, []byte("ok"), 0644); err != nil {
-		c.JSON(http.StatusServiceUnavailable, models.HealthResponse{
-			Status: "unhealthy",
-			Error:  "tmp directory not writable",
-		})
+// Readyz reports whether downloads can run: yt-dlp works and the tmp
+// directory is writable. A full disk does not make the server unready,
+// info lookups and links keep working.
+func (h *Handler) Readyz(c *gin.Context) {
+	if ytdlp := h.downloader.YtDlpStatus(); !ytdlp.Available {
+		c.JSON(http.StatusServiceUnavailable, models.HealthResponse{Status: "unavailable", Error: "yt-dlp not available"})
+		return
+	}
+	if tmp := h.downloader.TmpDirStatus(); !tmp.Writable {
+		c.JSON(http.StatusServiceUnavailable, models.HealthResponse{Status: "unavailable", Error: tmp.Error})
 		return
 	}
-	os.Remove(testFile)
+	c.JSON(http.StatusOK, models.HealthResponse{Status: "ready"})
+}
 
-	c.JSON(http.StatusOK, models.HealthResponse{
+// unusableJar describes the first cookie jar that is stale or has no valid
+// file, or returns "".
+func unusableJar(jars []models.CookieJarStatus) string {
+	for _, j := range jars {
+		switch {
+		case j.Stale:
+			return fmt.Sprintf("cookie jar %s is stale: %s", j.Name, j.StaleReason)
+		case !j.File.Valid:
+			return fmt.Sprintf("cookie jar %s: %s", j.Name, j.File.Error)
+		}
+	}
+	return ""
+}
+
+// HealthCheck reports the state of every dependency. The server is
+// unhealthy without yt-dlp or a writable tmp directory, and degraded
+// without ffmpeg, with an unusable cookies file or jar or with a full disk.
+func (h *Handler) HealthCheck(c *gin.Context) {
+	checks := &models.HealthChecks{
+		YtDlp:      h.downloader.YtDlpStatus(),
+		FFmpeg:     h.downloader.FFmpegStatus(),
+		TmpDir:     h.downloader.TmpDirStatus(),
+		Cookies:    h.downloader.CookiesStatus(),
+		CookieJars: h.downloader.CookieJars(),
+	}
+	build := buildinfo.Get()
+	resp := models.HealthResponse{
 		Status:  "healthy",
-		Version: "1.0.0",
-	})
+		Version: build.Version,
+		Build:   &build,
+		Uptime:  buildinfo.Uptime().Round(time.Second).String(),
+		Checks:  checks,
+		Queue: &models.QueueStatus{
+			RunningJobs: len(h.RunningJobs()),
+			Sessions:    len(h.downloader.ActiveSessions()),
+		},
+	}
+
+	status := http.StatusOK
+	switch {
+	case !checks.YtDlp.Available:
+		status, resp.Status, resp.Error = http.StatusServiceUnavailable, "unhealthy", "yt-dlp not available"
+	case !checks.TmpDir.Writable:
+		status, resp.Status, resp.Error = http.StatusServiceUnavailable, "unhealthy", checks.TmpDir.Error
+	case !checks.FFmpeg.Available:
+		resp.Status, resp.Error = "degraded", "ffmpeg not available"
+	case checks.Cookies != nil && !checks.Cookies.Valid:
+		resp.Status, resp.Error = "degraded", checks.Cookies.Error
+	case unusableJar(checks.CookieJars) != "":
+		resp.Status, resp.Error = "degraded", unusableJar(checks.CookieJars)
+	case checks.TmpDir.Full:
+		resp.Status, resp.Error = "degraded", "not enough disk space for new downloads"
+	}
+	c.JSON(status, resp)
 }
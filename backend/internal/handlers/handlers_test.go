@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/cleanup"
+	"viddl.me/backend/internal/config"
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/links"
+	"viddl.me/backend/internal/storage"
+)
+
+// slowStore holds up opening files, so that concurrent transfers overlap.
+type slowStore struct {
+	storage.Storage
+}
+
+func (s slowStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, *storage.Object, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.Storage.Open(ctx, key)
+}
+
+func TestServeLinkUses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	content := strings.Repeat("video", 1<<16)
+	if err := os.WriteFile(filepath.Join(dir, "abc_video.mp4"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jobStore, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobStore.Close()
+	store := slowStore{storage.NewLocal(dir)}
+	h := New(&config.Config{LinkSecret: "test-secret"}, nil, store, jobStore, cleanup.NewScheduler(jobStore, store), nil)
+
+	token, err := h.links.Sign(&links.Claims{
+		Key:         "abc_video.mp4",
+		FileName:    "video.mp4",
+		ContentType: "video/mp4",
+		Expires:     time.Now().Add(10 * time.Minute).Unix(),
+		MaxUses:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.GET("/dl/:token", h.ServeLink)
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/dl/"+token, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Neither ranges nor transfers that send nothing use the link up
+	if w := get("Range", "bytes=0-99"); w.Code != http.StatusPartialContent {
+		t.Fatalf("range request = %d, want 206", w.Code)
+	}
+	if w := get("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); w.Code != http.StatusNotModified {
+		t.Fatalf("conditional request = %d, want 304", w.Code)
+	}
+
+	// Concurrent downloads of a single-use link serve it once
+	const n = 8
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := get("", "")
+			if w.Code == http.StatusOK && w.Body.Len() != len(content) {
+				t.Errorf("download %d sent %d bytes, want %d", i, w.Body.Len(), len(content))
+			}
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	served := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			served++
+		case http.StatusGone:
+		default:
+			t.Errorf("download = %d, want 200 or 410", code)
+		}
+	}
+	if served != 1 {
+		t.Errorf("%d of %d concurrent downloads served, want 1", served, n)
+	}
+	if w := get("Range", "bytes=0-99"); w.Code != http.StatusGone {
+		t.Errorf("range request after the last use = %d, want 410", w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Status string
+
+const (
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+var ErrNotFound = errors.New("job not found")
+
+var (
+	jobsBucket  = []byte("jobs")
+	filesBucket = []byte("files")
+)
+
+// Job is one download request and the file it produced.
+type Job struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // video, audio or image
+	URL       string    `json:"url"`
+	Owner     string    `json:"owner"`             // client IP
+	APIKey    string    `json:"api_key,omitempty"` // name of the API key used, if any
+	Status    Status    `json:"status"`
+	Key       string    `json:"key,omitempty"` // storage key of the result
+	Size      int64     `json:"size,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Store persists jobs in a bbolt database so file expiry survives restarts.
+// Files are indexed by storage key to find the job that owns them.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening job store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, filesBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing job store: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Put creates or updates a job and its file index entry.
+func (s *Store) Put(job *Job) error {
+	job.UpdatedAt = time.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = job.UpdatedAt
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Put([]byte(job.ID), data); err != nil {
+			return err
+		}
+		if job.Key != "" {
+			return tx.Bucket(filesBucket).Put([]byte(job.Key), []byte(job.ID))
+		}
+		return nil
+	})
+}
+
+func (s *Store) Get(id string) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx, id)
+		return err
+	})
+	return job, err
+}
+
+// ByKey returns the job that produced the file stored under key.
+func (s *Store) ByKey(key string) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(filesBucket).Get([]byte(key))
+		if id == nil {
+			return ErrNotFound
+		}
+		var err error
+		job, err = getJob(tx, string(id))
+		return err
+	})
+	return job, err
+}
+
+func (s *Store) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		job, err := getJob(tx, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if job.Key != "" {
+			if err := tx.Bucket(filesBucket).Delete([]byte(job.Key)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *Store) List() ([]*Job, error) {
+	var list []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			list = append(list, &job)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func getJob(tx *bolt.Tx, id string) (*Job, error) {
+	data := tx.Bucket(jobsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{ID: "a", Kind: "video", Owner: "1.2.3.4", Status: StatusRunning}
+	if err := s.Put(job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ByKey("a_video.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ByKey before done: got %v, want ErrNotFound", err)
+	}
+
+	job.Status = StatusDone
+	job.Key = "a_video.mp4"
+	job.ExpiresAt = time.Now().Add(time.Minute)
+	if err := s.Put(job); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records must survive reopening the database
+	s.Close()
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got, err := s.ByKey("a_video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "a" || got.Status != StatusDone || got.Owner != "1.2.3.4" {
+		t.Errorf("ByKey = %+v", got)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ByKey("a_video.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByKey after delete: got %v, want ErrNotFound", err)
+	}
+	if list, _ := s.List(); len(list) != 0 {
+		t.Errorf("List after delete = %d jobs, want 0", len(list))
+	}
+}
@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var usageBucket = []byte("usage")
+
+// Usage counts the jobs and bytes delivered to one API key in one month.
+type Usage struct {
+	Jobs  int   `json:"jobs"`
+	Bytes int64 `json:"bytes"`
+}
+
+func usageKey(key, month string) []byte {
+	return []byte(month + "/" + key)
+}
+
+// AddUsage adds to the counters of key for month ("2006-01").
+func (s *Store) AddUsage(key, month string, jobs int, bytes int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		var u Usage
+		if data := b.Get(usageKey(key, month)); data != nil {
+			if err := json.Unmarshal(data, &u); err != nil {
+				return err
+			}
+		}
+		u.Jobs += jobs
+		u.Bytes += bytes
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		return b.Put(usageKey(key, month), data)
+	})
+}
+
+// Usage returns the counters of key for month, zero if nothing was used.
+func (s *Store) Usage(key, month string) (Usage, error) {
+	var u Usage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usageBucket).Get(usageKey(key, month))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &u)
+	})
+	return u, err
+}
+
+// MonthUsage returns the counters of every key that used something in
+// month, by key.
+func (s *Store) MonthUsage(month string) (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	prefix := usageKey("", month)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usageBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var u Usage
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			usage[string(k[len(prefix):])] = u
+		}
+		return nil
+	})
+	return usage, err
+}
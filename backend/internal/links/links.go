@@ -0,0 +1,165 @@
+package links
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalid   = errors.New("invalid download link")
+	ErrExpired   = errors.New("download link has expired")
+	ErrWrongIP   = errors.New("download link was issued to a different address")
+	ErrExhausted = errors.New("download link has been used up")
+)
+
+// Claims is the content of a signed download link.
+type Claims struct {
+	ID          string `json:"id"`
+	Key         string `json:"k"`
+	FileName    string `json:"n"`
+	ContentType string `json:"t"`
+	Expires     int64  `json:"e"`
+	IP          string `json:"ip,omitempty"`
+	MaxUses     int    `json:"u"`
+}
+
+// Signer issues and checks HMAC-signed download tokens. Use counts are
+// tracked in memory per token ID, so they reset on restart and every
+// instance counts separately.
+type Signer struct {
+	secret []byte
+	now    func() time.Time
+
+	mu   sync.Mutex
+	uses map[string]int
+	exp  map[string]time.Time
+}
+
+// NewSigner returns a signer for secret. Without a secret a random one is
+// generated, so links stop working on restart and across instances.
+func NewSigner(secret string) *Signer {
+	key := []byte(secret)
+	if secret == "" {
+		slog.Warn("LINK_SECRET not set, download links will not survive restarts")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			slog.Error("Failed to generate link secret", "error", err)
+			os.Exit(1)
+		}
+	}
+	return &Signer{
+		secret: key,
+		now:    time.Now,
+		uses:   make(map[string]int),
+		exp:    make(map[string]time.Time),
+	}
+}
+
+// Sign fills in the token ID and returns the encoded token.
+func (s *Signer) Sign(c *Claims) (string, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	c.ID = hex.EncodeToString(id)
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.mac(encoded), nil
+}
+
+// Verify checks the token's signature, expiry and IP binding.
+func (s *Signer) Verify(token, clientIP string) (*Claims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.mac(encoded))) {
+		return nil, ErrInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalid
+	}
+
+	if !s.now().Before(time.Unix(c.Expires, 0)) {
+		return nil, ErrExpired
+	}
+	if c.IP != "" && c.IP != clientIP {
+		return nil, ErrWrongIP
+	}
+	return &c, nil
+}
+
+// Check reports whether a verified link has uses left, without using one.
+func (s *Signer) Check(c *Claims) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	if c.MaxUses > 0 && s.uses[c.ID] >= c.MaxUses {
+		return ErrExhausted
+	}
+	return nil
+}
+
+// Use counts one use of a verified link and returns how many are left.
+// The use is taken when the transfer starts, so concurrent transfers can't
+// exceed the link's uses; Release gives it back if the transfer fails.
+func (s *Signer) Use(c *Claims) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+
+	if c.MaxUses > 0 && s.uses[c.ID] >= c.MaxUses {
+		return 0, ErrExhausted
+	}
+	s.uses[c.ID]++
+	s.exp[c.ID] = time.Unix(c.Expires, 0)
+
+	if c.MaxUses <= 0 {
+		return -1, nil
+	}
+	return c.MaxUses - s.uses[c.ID], nil
+}
+
+// Release gives back a use counted by Use for a transfer that did not
+// complete.
+func (s *Signer) Release(c *Claims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uses[c.ID] > 0 {
+		s.uses[c.ID]--
+	}
+}
+
+// prune forgets the counts of expired links.
+func (s *Signer) prune() {
+	now := s.now()
+	for id, exp := range s.exp {
+		if now.After(exp) {
+			delete(s.exp, id)
+			delete(s.uses, id)
+		}
+	}
+}
+
+func (s *Signer) mac(encoded string) string {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,88 @@
+package links
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(now time.Time) *Signer {
+	s := NewSigner("test-secret")
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestSigner(now)
+
+	claims := &Claims{
+		Key:      "abc_Video.mp4",
+		FileName: "Video.mp4",
+		Expires:  now.Add(10 * time.Minute).Unix(),
+		IP:       "203.0.113.7",
+		MaxUses:  2,
+	}
+	token, err := s.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		ip      string
+		at      time.Time
+		wantErr error
+	}{
+		{name: "valid", token: token, ip: "203.0.113.7", at: now},
+		{name: "other ip", token: token, ip: "198.51.100.1", at: now, wantErr: ErrWrongIP},
+		{name: "expired", token: token, ip: "203.0.113.7", at: now.Add(10 * time.Minute), wantErr: ErrExpired},
+		{name: "tampered payload", token: "x" + token, ip: "203.0.113.7", at: now, wantErr: ErrInvalid},
+		{name: "no signature", token: strings.Split(token, ".")[0], ip: "203.0.113.7", at: now, wantErr: ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.now = func() time.Time { return tt.at }
+			got, err := s.Verify(tt.token, tt.ip)
+			if err != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Key != claims.Key || got.ID != claims.ID) {
+				t.Errorf("Verify() = %+v, want %+v", got, claims)
+			}
+		})
+	}
+
+	other := NewSigner("other-secret")
+	if _, err := other.Verify(token, "203.0.113.7"); err != ErrInvalid {
+		t.Errorf("Verify() with another secret error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestUse(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestSigner(now)
+
+	claims := &Claims{Key: "abc_Video.mp4", Expires: now.Add(time.Minute).Unix(), MaxUses: 2}
+	if _, err := s.Sign(claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Check(claims); err != nil {
+		t.Fatalf("Check() before use error = %v", err)
+	}
+	for want := 1; want >= 0; want-- {
+		left, err := s.Use(claims)
+		if err != nil || left != want {
+			t.Fatalf("Use() = %d, %v, want %d, nil", left, err, want)
+		}
+	}
+	if err := s.Check(claims); err != ErrExhausted {
+		t.Errorf("Check() past max error = %v, want ErrExhausted", err)
+	}
+	if _, err := s.Use(claims); err != ErrExhausted {
+		t.Errorf("Use() past max error = %v, want ErrExhausted", err)
+	}
+}
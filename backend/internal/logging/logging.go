@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// level is the level of the logger made by Setup, changed by SetLevel.
+var level slog.LevelVar
+
+// Setup makes a logger writing to stderr at level ("debug", "info", "warn"
+// or "error") in format ("text" or "json") the default for slog and the
+// log package.
+func Setup(lvl, format string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	h, err := NewHandler(os.Stderr, &level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// SetLevel changes the level of the logger made by Setup.
+func SetLevel(lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid log level %q, want debug, info, warn or error", lvl)
+	}
+	level.Set(l)
+	return nil
+}
+
+// NewHandler returns a handler writing to w that adds the attributes
+// stored with With, and the trace ID, to records logged with a context.
+func NewHandler(w io.Writer, level slog.Leveler, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return contextHandler{slog.NewTextHandler(w, opts)}, nil
+	case "json":
+		return contextHandler{slog.NewJSONHandler(w, opts)}, nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, want text or json", format)
+	}
+}
+
+type attrsKey struct{}
+
+// With returns a context whose log records carry args, as key-value pairs,
+// in addition to those already stored in ctx.
+func With(ctx context.Context, args ...any) context.Context {
+	r := slog.Record{}
+	r.Add(args...)
+	// Clipped so contexts derived from the same parent never share
+	// appended attributes
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	attrs = slices.Clip(attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// RequestID returns the ID of the request ctx belongs to, if any.
+func RequestID(ctx context.Context) string {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	for _, a := range attrs {
+		if a.Key == "request_id" {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Truncate shortens long tool output kept in log records to its last n
+// bytes, where errors usually are.
+func Truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
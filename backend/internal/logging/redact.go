@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in logged values.
+const Redacted = "REDACTED"
+
+// sensitiveFlags are yt-dlp flags whose value is a credential or a path
+// that has no place in logs.
+var sensitiveFlags = map[string]bool{
+	"--cookies":        true,
+	"--username":       true,
+	"--password":       true,
+	"--video-password": true,
+	"--ap-username":    true,
+	"--ap-password":    true,
+	"--twofactor":      true,
+	"--proxy":          true,
+	"--add-header":     true,
+}
+
+// urlPattern matches URLs in text, without trailing punctuation.
+var urlPattern = regexp.MustCompile(`https?://[^\s'"<>]*[^\s'"<>:,.;)]`)
+
+// URL returns rawURL with credentials, query values, the fragment and
+// download link tokens redacted. Query keys are kept to tell URLs apart.
+func URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Redacted
+	}
+	if u.User != nil {
+		u.User = url.User(Redacted)
+	}
+	if u.RawQuery != "" {
+		q, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			u.RawQuery = Redacted
+		} else {
+			for k := range q {
+				q[k] = []string{Redacted}
+			}
+			u.RawQuery = q.Encode()
+		}
+	}
+	u.Fragment, u.RawFragment = "", ""
+	if strings.HasPrefix(u.Path, "/dl/") {
+		u.Path, u.RawPath = "/dl/"+Redacted, ""
+	}
+	return u.String()
+}
+
+// Args returns a copy of command line args with the values of sensitive
+// flags and URLs redacted.
+func Args(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		flag, _, hasValue := strings.Cut(arg, "=")
+		switch {
+		case i > 0 && sensitiveFlags[args[i-1]]:
+			out[i] = Redacted
+		case hasValue && sensitiveFlags[flag]:
+			out[i] = flag + "=" + Redacted
+		case strings.Contains(arg, "://"):
+			out[i] = URL(arg)
+		default:
+			out[i] = arg
+		}
+	}
+	return out
+}
+
+// Text redacts the URLs in free text such as tool output.
+func Text(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, URL)
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Labels are kept to small fixed sets: routes are gin's route patterns and
+// URLs are reduced to the allowed domain they belong to, never the URL
+// itself.
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "viddl_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"route", "method"})
+
+	YtdlpRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_ytdlp_runs_total",
+		Help: "yt-dlp invocations by platform, kind and outcome.",
+	}, []string{"platform", "kind", "outcome"})
+
+	YtdlpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "viddl_ytdlp_duration_seconds",
+		Help:    "yt-dlp run time by platform, kind and outcome.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"platform", "kind", "outcome"})
+
+	DownloadRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_download_retries_total",
+		Help: "yt-dlp runs retried after transient errors.",
+	}, []string{"platform"})
+
+	FormatFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_format_fallbacks_total",
+		Help: "Downloads retried with the best format after the requested one failed.",
+	}, []string{"platform"})
+
+	BytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "viddl_bytes_served_total",
+		Help: "Bytes of downloaded files sent to clients.",
+	})
+
+	Rejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_limit_rejections_total",
+		Help: "Requests turned away by rate, concurrency and quota limits, bans and maintenance mode.",
+	}, []string{"limit"})
+
+	CleanupSweeps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "viddl_cleanup_sweeps_total",
+		Help: "Cleanup sweeps run.",
+	})
+
+	CleanupRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_cleanup_removed_total",
+		Help: "Files and session directories removed by cleanup, by type.",
+	}, []string{"type"})
+
+	CleanupFreedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "viddl_cleanup_freed_bytes_total",
+		Help: "Bytes freed by cleanup sweeps.",
+	})
+
+	CleanupErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "viddl_cleanup_errors_total",
+		Help: "Errors during cleanup sweeps.",
+	})
+
+	// Proxies are labeled with their scheme and host, without credentials
+	ProxyRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_proxy_runs_total",
+		Help: "yt-dlp runs through each outbound proxy by outcome.",
+	}, []string{"proxy", "outcome"})
+
+	ProxyQuarantined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "viddl_proxy_quarantined",
+		Help: "Whether an outbound proxy is in quarantine.",
+	}, []string{"proxy"})
+
+	CookieJarStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "viddl_cookie_jar_stale",
+		Help: "Whether a cookie jar was taken out of rotation for failing to log in.",
+	}, []string{"jar"})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "viddl_breaker_state",
+		Help: "Circuit breaker state per platform: 0 closed, 1 half-open, 2 open.",
+	}, []string{"platform"})
+
+	BreakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viddl_breaker_trips_total",
+		Help: "Times a platform's circuit breaker opened.",
+	}, []string{"platform"})
+)
+
+// Limits counted in Rejections.
+const (
+	LimitIPRate        = "ip_rate"
+	LimitIPConcurrent  = "ip_concurrent"
+	LimitKeyRate       = "key_rate"
+	LimitKeyConcurrent = "key_concurrent"
+	LimitKeyQuota      = "key_quota"
+	LimitBanned        = "banned"
+	LimitMaintenance   = "maintenance"
+)
+
+// Gauge registers a gauge read from f at scrape time.
+func Gauge(name, help string, f func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+}
+
+var (
+	platformsMu sync.RWMutex
+	platforms   []string
+)
+
+// SetPlatforms sets the domains URLs are attributed to in platform labels.
+func SetPlatforms(domains []string) {
+	platformsMu.Lock()
+	defer platformsMu.Unlock()
+	platforms = append([]string(nil), domains...)
+}
+
+// Platform returns the configured domain rawURL belongs to, or "other".
+func Platform(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "other"
+	}
+	host := strings.ToLower(u.Hostname())
+
+	platformsMu.RLock()
+	defer platformsMu.RUnlock()
+	for _, domain := range platforms {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain
+		}
+	}
+	return "other"
+}
+
+// ObserveYtdlp records one yt-dlp run that started at start and ended with
+// err, classifying cancellations and timeouts by ctx.
+func ObserveYtdlp(ctx context.Context, platform, kind string, start time.Time, err error) {
+	outcome := "success"
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.Canceled):
+		outcome = "canceled"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		outcome = "timeout"
+	default:
+		outcome = "error"
+	}
+	YtdlpRuns.WithLabelValues(platform, kind, outcome).Inc()
+	YtdlpDuration.WithLabelValues(platform, kind, outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPlatform(t *testing.T) {
+	SetPlatforms([]string{"youtube.com", "youtu.be", "x.com"})
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://www.youtube.com/watch?v=abc", want: "youtube.com"},
+		{url: "https://m.youtube.com/shorts/abc", want: "youtube.com"},
+		{url: "https://youtu.be/abc", want: "youtu.be"},
+		{url: "https://X.com/user/status/1", want: "x.com"},
+		{url: "https://notyoutube.com/watch", want: "other"},
+		{url: "://bad", want: "other"},
+	}
+	for _, tt := range tests {
+		if got := Platform(tt.url); got != tt.want {
+			t.Errorf("Platform(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestObserveYtdlp(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := errors.New("exit status 1")
+
+	ObserveYtdlp(context.Background(), "x.com", "download", time.Now(), nil)
+	ObserveYtdlp(context.Background(), "x.com", "download", time.Now(), failed)
+	ObserveYtdlp(canceled, "x.com", "download", time.Now(), failed)
+
+	for _, outcome := range []string{"success", "error", "canceled"} {
+		if got := testutil.ToFloat64(YtdlpRuns.WithLabelValues("x.com", "download", outcome)); got != 1 {
+			t.Errorf("runs with outcome %s = %v, want 1", outcome, got)
+		}
+	}
+}
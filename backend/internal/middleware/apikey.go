@@ -1,31 +1,79 @@
 package middleware
 
 import (
-	"crypto/subtle"
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/apikeys"
+	"viddl.me/backend/internal/metrics"
 )
 
-func APIKeyAuth(apiKey string) gin.HandlerFunc {
+// APIKeyAuth authenticates requests with the X-API-Key header and checks
+// that the key has scope and is within its limits. Keys are only accepted
+// in the header, never in the query string where they end up in access
+// logs. Unless required, requests without a key pass through to the
+// per-IP limits. Requests already authenticated by BearerAuth are passed
+// on.
+func APIKeyAuth(keys *apikeys.Store, scope string, required bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if apiKey == "" {
+		if apikeys.FromContext(c) != nil {
+			c.Next()
+			return
+		}
+
+		if required && keys.Len() == 0 {
 			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "API key not configured"})
 			c.Abort()
 			return
 		}
 
+		if c.Query("api_key") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API keys must be sent in the X-API-Key header"})
+			c.Abort()
+			return
+		}
+
 		providedKey := c.GetHeader("X-API-Key")
-		if providedKey == "" {
-			providedKey = c.Query("api_key")
+		if providedKey == "" && !required {
+			c.Next()
+			return
 		}
 
-		if subtle.ConstantTimeCompare([]byte(providedKey), []byte(apiKey)) != 1 {
+		key, ok := keys.Lookup(providedKey)
+		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing API key"})
 			c.Abort()
 			return
 		}
+		if !key.Allows(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key is not allowed to use this endpoint"})
+			c.Abort()
+			return
+		}
+
+		admit(c, keys, key)
+	}
+}
 
-		c.Next()
+// admit runs the rest of the chain as key if it is within its limits.
+func admit(c *gin.Context, keys *apikeys.Store, key *apikeys.Key) {
+	release, err := keys.Acquire(key)
+	if err != nil {
+		status, limit := http.StatusTooManyRequests, metrics.LimitKeyRate
+		switch {
+		case errors.Is(err, apikeys.ErrQuotaExceeded):
+			status, limit = http.StatusForbidden, metrics.LimitKeyQuota
+		case errors.Is(err, apikeys.ErrTooConcurrent):
+			limit = metrics.LimitKeyConcurrent
+		}
+		metrics.Rejections.WithLabelValues(limit).Inc()
+		c.JSON(status, gin.H{"error": err.Error()})
+		c.Abort()
+		return
 	}
+	defer release()
+
+	apikeys.SetContext(c, key)
+	c.Next()
 }
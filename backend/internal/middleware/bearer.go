@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/apikeys"
+	"viddl.me/backend/internal/oidc"
+)
+
+// BearerAuth authenticates requests carrying an OIDC bearer token and checks
+// that the token grants scope and its subject is within the token limits of
+// keys. Requests without a bearer token are left to APIKeyAuth; with a nil
+// verifier bearer tokens are not accepted.
+func BearerAuth(verifier *oidc.Verifier, keys *apikeys.Store, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if verifier == nil || len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			c.Next()
+			return
+		}
+
+		id, err := verifier.Verify(c.Request.Context(), strings.TrimSpace(auth[7:]))
+		if errors.Is(err, oidc.ErrUnavailable) {
+			slog.ErrorContext(c.Request.Context(), "Cannot verify bearer tokens", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": oidc.ErrUnavailable.Error()})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "Rejected bearer token", "client_ip", c.ClientIP(), "error", err)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		// Token holders share the API key code paths: per-IP limits are
+		// replaced by the token limits and usage is counted under their
+		// subject
+		key := keys.Token(id.Subject, id.Scopes)
+		if !key.Allows(scope) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			c.JSON(http.StatusForbidden, gin.H{"error": "token is not allowed to use this endpoint"})
+			c.Abort()
+			return
+		}
+
+		admit(c, keys, key)
+	}
+}
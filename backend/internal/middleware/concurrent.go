@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/apikeys"
+	"viddl.me/backend/internal/metrics"
 )
 
 type ConcurrentDownloadLimiter struct {
@@ -21,10 +23,19 @@ func NewConcurrentDownloadLimiter(maxPerIP int) *ConcurrentDownloadLimiter {
 }
 
 func (l *ConcurrentDownloadLimiter) Acquire(ip string) bool {
+	return l.AcquireUpTo(ip, 0)
+}
+
+// AcquireUpTo is Acquire with limit in place of the per-IP limit, unless
+// limit is 0.
+func (l *ConcurrentDownloadLimiter) AcquireUpTo(ip string, limit int) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.activeIPs[ip] >= l.maxPerIP {
+	if limit <= 0 {
+		limit = l.maxPerIP
+	}
+	if l.activeIPs[ip] >= limit {
 		return false
 	}
 	l.activeIPs[ip]++
@@ -43,11 +54,49 @@ func (l *ConcurrentDownloadLimiter) Release(ip string) {
 	}
 }
 
+// SetMax changes how many downloads an IP may run at once. Downloads
+// already running over the new limit are left to finish.
+func (l *ConcurrentDownloadLimiter) SetMax(maxPerIP int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxPerIP = maxPerIP
+}
+
+// Active returns the number of running downloads per IP.
+func (l *ConcurrentDownloadLimiter) Active() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := make(map[string]int, len(l.activeIPs))
+	for ip, n := range l.activeIPs {
+		active[ip] = n
+	}
+	return active
+}
+
+// Total returns the number of running downloads across all IPs.
+func (l *ConcurrentDownloadLimiter) Total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	for _, n := range l.activeIPs {
+		total += n
+	}
+	return total
+}
+
+// ConcurrentLimit holds each IP to the per-IP number of running downloads.
+// Requests with an API key or bearer token are counted per key instead,
+// across all its IPs, up to the key's max_concurrent or else the per-IP
+// limit.
 func ConcurrentLimit(limiter *ConcurrentDownloadLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
+		ip, limit, rejection := c.ClientIP(), 0, metrics.LimitIPConcurrent
+		if key := apikeys.FromContext(c); key != nil {
+			ip, limit, rejection = "key:"+key.Name, key.MaxConcurrent, metrics.LimitKeyConcurrent
+		}
 
-		if !limiter.Acquire(ip) {
+		if !limiter.AcquireUpTo(ip, limit) {
+			metrics.Rejections.WithLabelValues(rejection).Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "Too many concurrent downloads. Please wait for current download to finish.",
 			})
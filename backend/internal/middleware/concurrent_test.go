@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/apikeys"
+)
+
+func TestConcurrentLimitKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := NewConcurrentDownloadLimiter(1)
+
+	// A key is held to the per-IP limit across all its IPs while one of
+	// its downloads runs
+	key := &apikeys.Key{Name: "acme"}
+	limiter.AcquireUpTo("key:acme", 0)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { apikeys.SetContext(c, key) }, ConcurrentLimit(limiter), func(c *gin.Context) {})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("second download of a key without max_concurrent = %d, want 429", w.Code)
+	}
+
+	key.MaxConcurrent = 2
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("second download of a key with max_concurrent 2 = %d, want 200", w.Code)
+	}
+	if got := limiter.Total(); got != 1 {
+		t.Errorf("Total() = %d after the request, want 1", got)
+	}
+}
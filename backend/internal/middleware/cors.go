@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORS answers cross-origin requests from a set of origins that can be
+// changed while the server runs.
+type CORS struct {
+	handler atomic.Pointer[gin.HandlerFunc]
+}
+
+func NewCORS(origins []string) (*CORS, error) {
+	c := &CORS{}
+	if err := c.SetOrigins(origins); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetOrigins replaces the allowed origins. Invalid origins leave the
+// current ones in place.
+func (c *CORS) SetOrigins(origins []string) error {
+	config := cors.Config{
+		AllowOrigins:     origins,
+		AllowMethods:     []string{"GET", "POST"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Range", RequestIDHeader},
+		ExposeHeaders:    []string{RequestIDHeader},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}
+	// cors.New panics on an invalid config
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	handler := cors.New(config)
+	c.handler.Store(&handler)
+	return nil
+}
+
+func (c *CORS) Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		(*c.handler.Load())(ctx)
+	}
+}
@@ -22,7 +22,7 @@ func (g *gzipResponseWriter) WriteString(s string) (int, error) {
 
 func Gzip() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if strings.HasPrefix(c.Request.URL.Path, "/api/download") {
+		if strings.HasPrefix(c.Request.URL.Path, "/dl/") {
 			c.Next()
 			return
 		}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/metrics"
+)
+
+// Maintenance is a switch that turns away new downloads while running ones
+// finish.
+type Maintenance struct {
+	enabled atomic.Bool
+}
+
+func (m *Maintenance) Set(enabled bool) {
+	if m.enabled.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		slog.Warn("Maintenance mode enabled, new downloads are rejected")
+	} else {
+		slog.Info("Maintenance mode disabled")
+	}
+}
+
+func (m *Maintenance) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// RejectDuringMaintenance answers requests with 503 Service Unavailable
+// while maintenance mode is on.
+func RejectDuringMaintenance(m *Maintenance) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.Enabled() {
+			metrics.Rejections.WithLabelValues(metrics.LimitMaintenance).Inc()
+			c.Header("Retry-After", "300")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is under maintenance, please try again later"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
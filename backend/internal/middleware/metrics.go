@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"viddl.me/backend/internal/metrics"
+)
+
+// Metrics counts requests and their latency by route pattern. Requests that
+// match no route share one label so scanners can't blow up cardinality.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route, method := c.FullPath(), c.Request.Method
+		if route == "" {
+			route, method = "unmatched", "other"
+		}
+		metrics.HTTPRequests.WithLabelValues(route, method, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
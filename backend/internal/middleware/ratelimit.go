@@ -1,29 +1,51 @@
 package middleware
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
+	"viddl.me/backend/internal/apikeys"
+	"viddl.me/backend/internal/metrics"
 )
 
 type IPRateLimiter struct {
 	mu       sync.RWMutex
 	limiters map[string]*rate.Limiter
 	lastSeen map[string]time.Time
+	bans     map[string]time.Time // zero time bans until unblocked
 	rate     rate.Limit
 	burst    int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// RateLimitEntry is the state of one IP's limiter.
+type RateLimitEntry struct {
+	IP       string    `json:"ip"`
+	Tokens   float64   `json:"tokens"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Ban is a banned IP.
+type Ban struct {
+	IP    string     `json:"ip"`
+	Until *time.Time `json:"until,omitempty"`
 }
 
 func NewIPRateLimiter(r rate.Limit, burst int) *IPRateLimiter {
 	limiter := &IPRateLimiter{
 		limiters: make(map[string]*rate.Limiter),
 		lastSeen: make(map[string]time.Time),
+		bans:     make(map[string]time.Time),
 		rate:     r,
 		burst:    burst,
+		stop:     make(chan struct{}),
 	}
 	go limiter.cleanupOldLimiters()
 	return limiter
@@ -59,24 +81,138 @@ func (i *IPRateLimiter) cleanupOldLimiters() {
 	ticker := time.NewTicker(10 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-i.stop:
+			return
+		}
 		i.mu.Lock()
 		now := time.Now()
 		for ip, lastSeen := range i.lastSeen {
 			if now.Sub(lastSeen) > 30*time.Minute {
 				delete(i.limiters, ip)
 				delete(i.lastSeen, ip)
-				log.Printf("INFO: Cleaned up rate limiter for IP: %s", ip)
+				slog.Debug("Cleaned up rate limiter", "ip", ip)
+			}
+		}
+		for ip, until := range i.bans {
+			if !until.IsZero() && now.After(until) {
+				delete(i.bans, ip)
 			}
 		}
 		i.mu.Unlock()
 	}
 }
 
-func RateLimit(limiter *IPRateLimiter) gin.HandlerFunc {
+// SetLimit changes the rate and burst of every IP's limiter.
+func (i *IPRateLimiter) SetLimit(r rate.Limit, burst int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rate = r
+	i.burst = burst
+	for _, limiter := range i.limiters {
+		limiter.SetLimit(r)
+		limiter.SetBurst(burst)
+	}
+}
+
+// Stop ends the cleanup of idle limiters and expired bans.
+func (i *IPRateLimiter) Stop() {
+	i.stopOnce.Do(func() { close(i.stop) })
+}
+
+// Entries returns the limiters currently tracked, by IP.
+func (i *IPRateLimiter) Entries() []RateLimitEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	entries := make([]RateLimitEntry, 0, len(i.limiters))
+	for ip, limiter := range i.limiters {
+		entries = append(entries, RateLimitEntry{IP: ip, Tokens: limiter.Tokens(), LastSeen: i.lastSeen[ip]})
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].IP < entries[b].IP })
+	return entries
+}
+
+// Ban rejects all requests from ip for d, or until Unblock with d of 0.
+func (i *IPRateLimiter) Ban(ip string, d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	i.bans[ip] = until
+	slog.Warn("Banned IP", "ip", ip, "duration", d)
+}
+
+// Unblock lifts a ban on ip and gives it a fresh rate limit.
+func (i *IPRateLimiter) Unblock(ip string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.bans, ip)
+	delete(i.limiters, ip)
+	delete(i.lastSeen, ip)
+	slog.Info("Unblocked IP", "ip", ip)
+}
+
+// Banned reports whether ip is currently banned.
+func (i *IPRateLimiter) Banned(ip string) bool {
+	i.mu.RLock()
+	until, ok := i.bans[ip]
+	i.mu.RUnlock()
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+// Bans returns the active bans.
+func (i *IPRateLimiter) Bans() []Ban {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(i.bans))
+	for ip, until := range i.bans {
+		switch {
+		case until.IsZero():
+			bans = append(bans, Ban{IP: ip})
+		case now.Before(until):
+			until := until
+			bans = append(bans, Ban{IP: ip, Until: &until})
+		}
+	}
+	sort.Slice(bans, func(a, b int) bool { return bans[a].IP < bans[b].IP })
+	return bans
+}
+
+// RejectBanned answers requests from banned IPs with 403 Forbidden.
+func RejectBanned(limiter *IPRateLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if limiter.Banned(c.ClientIP()) {
+			metrics.Rejections.WithLabelValues(metrics.LimitBanned).Inc()
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RateLimit holds clients without an API key to the per-IP rate limit. A
+// request counts as weight requests, or one when weight is nil.
+func RateLimit(limiter *IPRateLimiter, weight func(*gin.Context) int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// API keys have their own limits
+		if apikeys.FromContext(c) != nil {
+			c.Next()
+			return
+		}
+
+		n := 1
+		if weight != nil {
+			n = weight(c)
+		}
 		ip := c.ClientIP()
-		if !limiter.GetLimiter(ip).Allow() {
+		if !limiter.GetLimiter(ip).AllowN(time.Now(), n) {
+			metrics.Rejections.WithLabelValues(metrics.LimitIPRate).Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "Too many requests, please try again later",
 			})
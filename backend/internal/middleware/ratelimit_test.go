@@ -39,3 +39,30 @@ func TestIPRateLimiter(t *testing.T) {
 		t.Error("4th request should be rate limited")
 	}
 }
+
+func TestBanUnblock(t *testing.T) {
+	limiter := NewIPRateLimiter(rate.Every(time.Minute/3), 1)
+	limiter.GetLimiter("10.0.0.1").Allow()
+
+	limiter.Ban("10.0.0.1", 0)
+	limiter.Ban("10.0.0.2", time.Hour)
+	limiter.Ban("10.0.0.3", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": false, "10.0.0.4": false} {
+		if got := limiter.Banned(ip); got != want {
+			t.Errorf("Banned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if bans := limiter.Bans(); len(bans) != 2 || bans[0].Until != nil || bans[1].Until == nil {
+		t.Errorf("Bans() = %+v", bans)
+	}
+
+	limiter.Unblock("10.0.0.1")
+	if limiter.Banned("10.0.0.1") {
+		t.Error("Banned() after Unblock = true")
+	}
+	if !limiter.GetLimiter("10.0.0.1").Allow() {
+		t.Error("Unblock should reset the rate limit")
+	}
+}
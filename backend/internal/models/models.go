@@ -1,20 +1,40 @@
 package models
 
+import (
+	"time"
+
+	"viddl.me/backend/internal/buildinfo"
+)
+
 type VideoInfo struct {
-	Title        string       `json:"title"`
-	Thumbnail    string       `json:"thumbnail"`
-	Duration     float64      `json:"duration"`
-	Uploader     string       `json:"uploader"`
-	Formats      []FormatInfo `json:"formats"`
-	MultiVideos  []VideoEntry `json:"multi_videos,omitempty"`
-	IsMultiVideo bool         `json:"is_multi_video"`
+	Title            string       `json:"title"`
+	Thumbnail        string       `json:"thumbnail"`
+	Duration         float64      `json:"duration"`
+	Uploader         string       `json:"uploader"`
+	Formats          []FormatInfo `json:"formats"`
+	MultiVideos      []VideoEntry `json:"multi_videos,omitempty"`
+	IsMultiVideo     bool         `json:"is_multi_video"`
+	IsLive           bool         `json:"is_live"`
+	LiveStatus       string       `json:"live_status,omitempty"`
+	ReleaseTimestamp int64        `json:"release_timestamp,omitempty"`
+	Scheduled        bool         `json:"scheduled,omitempty"`
+	LiveFromStart    bool         `json:"live_from_start,omitempty"`
+	MediaType        string       `json:"media_type,omitempty"`
+	Width            int          `json:"width,omitempty"`
+	Height           int          `json:"height,omitempty"`
 }
 
 type VideoEntry struct {
 	Index     int     `json:"index"`
+	ID        string  `json:"id,omitempty"`
+	URL       string  `json:"url,omitempty"`
 	Title     string  `json:"title"`
 	Thumbnail string  `json:"thumbnail"`
 	Duration  float64 `json:"duration"`
+	MediaType string  `json:"media_type"`
+	Ext       string  `json:"ext,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
 }
 
 type FormatInfo struct {
@@ -25,15 +45,26 @@ type FormatInfo struct {
 }
 
 type DownloadRequest struct {
-	URL        string `json:"url" binding:"required"`
-	Format     string `json:"format"`
-	VideoIndex int    `json:"video_index"`
+	URL         string `json:"url" binding:"required"`
+	Format      string `json:"format"`
+	VideoIndex  int    `json:"video_index"`
+	VideoID     string `json:"video_id"`
+	LiveMode    string `json:"live_mode"`
+	LiveMinutes int    `json:"live_minutes"`
 }
 
 type AudioRequest struct {
 	URL         string `json:"url" binding:"required"`
 	AudioFormat string `json:"audio_format"`
 	VideoIndex  int    `json:"video_index"`
+	VideoID     string `json:"video_id"`
+}
+
+type ImageRequest struct {
+	URL        string `json:"url" binding:"required"`
+	VideoIndex int    `json:"video_index"`
+	VideoID    string `json:"video_id"`
+	All        bool   `json:"all"`
 }
 
 type YtDlpFormat struct {
@@ -51,15 +82,111 @@ type YtDlpFormat struct {
 }
 
 type YtDlpInfo struct {
-	Title     string        `json:"title"`
-	Thumbnail string        `json:"thumbnail"`
-	Duration  float64       `json:"duration"`
-	Uploader  string        `json:"uploader"`
-	Formats   []YtDlpFormat `json:"formats"`
+	Title            string        `json:"title"`
+	Thumbnail        string        `json:"thumbnail"`
+	Duration         float64       `json:"duration"`
+	Uploader         string        `json:"uploader"`
+	Formats          []YtDlpFormat `json:"formats"`
+	IsLive           bool          `json:"is_live"`
+	LiveStatus       string        `json:"live_status"`
+	ReleaseTimestamp int64         `json:"release_timestamp"`
+	URL              string        `json:"url"`
+	Ext              string        `json:"ext"`
+	VCodec           string        `json:"vcodec"`
+	ACodec           string        `json:"acodec"`
+	Width            int           `json:"width"`
+	Height           int           `json:"height"`
+}
+
+// YtDlpEntry is a single line of `yt-dlp --flat-playlist --dump-json` output.
+type YtDlpEntry struct {
+	Type          string  `json:"_type"`
+	ID            string  `json:"id"`
+	URL           string  `json:"url"`
+	Title         string  `json:"title"`
+	Thumbnail     string  `json:"thumbnail"`
+	Duration      float64 `json:"duration"`
+	PlaylistIndex int     `json:"playlist_index"`
+	Ext           string  `json:"ext"`
+	VCodec        string  `json:"vcodec"`
+	ACodec        string  `json:"acodec"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+}
+
+// DownloadLink is returned by the download endpoints in place of the file.
+type DownloadLink struct {
+	URL         string `json:"url"`
+	Path        string `json:"path"`
+	FileName    string `json:"file_name"`
+	FileSize    int64  `json:"file_size"`
+	ContentType string `json:"content_type"`
+	ExpiresAt   int64  `json:"expires_at"`
+	MaxUses     int    `json:"max_uses"`
 }
 
+// HealthResponse answers /livez, /readyz and /health. Only the detailed
+// /health report fills in build info, checks and the queue.
 type HealthResponse struct {
-	Status  string `json:"status"`
-	Version string `json:"version,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Status  string          `json:"status"`
+	Version string          `json:"version,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Build   *buildinfo.Info `json:"build,omitempty"`
+	Uptime  string          `json:"uptime,omitempty"`
+	Checks  *HealthChecks   `json:"checks,omitempty"`
+	Queue   *QueueStatus    `json:"queue,omitempty"`
+}
+
+type HealthChecks struct {
+	YtDlp      ToolStatus        `json:"yt_dlp"`
+	FFmpeg     ToolStatus        `json:"ffmpeg"`
+	TmpDir     TmpDirStatus      `json:"tmp_dir"`
+	Cookies    *CookiesStatus    `json:"cookies,omitempty"`
+	CookieJars []CookieJarStatus `json:"cookie_jars,omitempty"`
+}
+
+// ToolStatus is the outcome of running a tool's version command.
+type ToolStatus struct {
+	Available bool      `json:"available"`
+	Version   string    `json:"version,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// TmpDirStatus reports whether downloads can be written and how much room
+// they have. Full means a new download would be turned away.
+type TmpDirStatus struct {
+	Writable bool   `json:"writable"`
+	Full     bool   `json:"full"`
+	Free     int64  `json:"free"`
+	Reserved int64  `json:"reserved"`
+	MinFree  int64  `json:"min_free"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CookiesStatus describes the yt-dlp cookies file.
+type CookiesStatus struct {
+	Valid      bool      `json:"valid"`
+	Entries    int       `json:"entries"`
+	Expired    int       `json:"expired"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Age        string    `json:"age"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CookieJarStatus describes a cookie jar. A stale jar is left out of
+// rotation until its file is replaced.
+type CookieJarStatus struct {
+	Name        string        `json:"name"`
+	Domains     []string      `json:"domains"`
+	Uses        int64         `json:"uses"`
+	Stale       bool          `json:"stale"`
+	StaleSince  *time.Time    `json:"stale_since,omitempty"`
+	StaleReason string        `json:"stale_reason,omitempty"`
+	File        CookiesStatus `json:"file"`
+}
+
+type QueueStatus struct {
+	RunningJobs int `json:"running_jobs"`
+	Sessions    int `json:"sessions"`
 }
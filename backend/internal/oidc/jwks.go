@@ -0,0 +1,300 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long fetched keys are used before they are refreshed
+	jwksMaxAge = time.Hour
+	// jwksMinInterval limits refetches caused by tokens with unknown key IDs
+	jwksMinInterval = time.Minute
+	jwksMaxBytes    = 1 << 20
+)
+
+// publicKey is a verification key. Keys from PEM files have no ID and are
+// tried for every token.
+type publicKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// keySet holds the static keys from a key file or the keys published at a
+// JWKS URL, refetched when they get old or a token names an unknown key.
+type keySet struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      []publicKey
+	fetched   time.Time
+	attempted time.Time
+	// Closed when the running fetch is done, nil while none runs
+	fetching chan struct{}
+	err      error
+}
+
+// loadKeyFile reads PEM public keys or certificates, or a JWKS document.
+func loadKeyFile(path string) ([]publicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading OIDC key file: %w", err)
+	}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		return parseJWKS([]byte(trimmed))
+	}
+
+	var keys []publicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing OIDC key file: %w", err)
+		}
+		keys = append(keys, publicKey{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in OIDC key file %s", path)
+	}
+	return keys, nil
+}
+
+// get returns the keys that may have signed a token with key ID kid.
+func (s *keySet) get(ctx context.Context, kid string) ([]publicKey, error) {
+	if s.url != "" {
+		s.refresh(ctx, kid)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.keys) == 0 {
+		if s.err == nil {
+			return nil, errors.New("no signing keys loaded yet")
+		}
+		return nil, s.err
+	}
+	var keys []publicKey
+	for _, k := range s.keys {
+		if kid == "" || k.id == "" || k.id == kid {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// refresh fetches the keys when they are old or lack kid. Only one fetch
+// runs at a time, outside the lock: requests that can't do without it wait
+// for it, the others go on with the keys at hand.
+func (s *keySet) refresh(ctx context.Context, kid string) {
+	s.mu.Lock()
+	now := s.now()
+	missing := len(s.keys) == 0 || (kid != "" && !hasKey(s.keys, kid))
+	stale := now.Sub(s.fetched) > jwksMaxAge
+	done := s.fetching
+	if done == nil && (stale || missing) && now.Sub(s.attempted) > jwksMinInterval {
+		s.attempted = now
+		done = make(chan struct{})
+		s.fetching = done
+		// The request that starts the fetch may go away before the
+		// others waiting for it
+		go s.fetch(context.WithoutCancel(ctx), now, done)
+	}
+	s.mu.Unlock()
+
+	if done != nil && missing {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *keySet) fetch(ctx context.Context, now time.Time, done chan struct{}) {
+	keys, err := s.download(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// Keep using the old keys while the provider is unreachable
+		slog.WarnContext(ctx, "Failed to fetch OIDC keys", "error", err)
+		s.err = err
+	} else {
+		s.keys, s.fetched, s.err = keys, now, nil
+		slog.InfoContext(ctx, "Loaded OIDC signing keys", "count", len(keys))
+	}
+	s.fetching = nil
+	close(done)
+}
+
+func (s *keySet) download(ctx context.Context) ([]publicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+func hasKey(keys []publicKey, kid string) bool {
+	for _, k := range keys {
+		if k.id == kid {
+			return true
+		}
+	}
+	return false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes the signing keys of a JWK set, skipping key types it
+// does not support.
+func parseJWKS(data []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	var keys []publicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, publicKey{id: k.Kid, key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
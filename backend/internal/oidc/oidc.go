@@ -0,0 +1,307 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"viddl.me/backend/internal/apikeys"
+)
+
+// clockSkew is the leeway allowed on exp, nbf and iat.
+const clockSkew = time.Minute
+
+var (
+	ErrInvalid  = errors.New("invalid bearer token")
+	ErrExpired  = errors.New("bearer token has expired")
+	ErrIssuer   = errors.New("bearer token has the wrong issuer")
+	ErrAudience = errors.New("bearer token is not meant for this service")
+	// ErrUnavailable means the provider's keys could not be loaded, the
+	// token may well be valid
+	ErrUnavailable = errors.New("bearer tokens cannot be verified right now")
+)
+
+// Identity is the caller a verified token belongs to.
+type Identity struct {
+	Subject string
+	Scopes  []string
+}
+
+// Verifier checks JWTs issued by an OIDC provider and maps a claim to
+// scopes.
+type Verifier struct {
+	issuer     string
+	audience   string
+	scopeClaim string
+	scopeMap   map[string][]string
+	keys       *keySet
+	now        func() time.Time
+}
+
+// NewVerifier returns a verifier for tokens from issuer meant for audience,
+// checked against the keys published at jwksURL or, if set, the keys in
+// keyFile (PEM or JWKS). Values of scopeClaim, which may be a dotted path
+// to a nested claim, are mapped to scopes with scopeMap; without a map
+// values that name a scope are used as is.
+func NewVerifier(issuer, audience, jwksURL, keyFile, scopeClaim string, scopeMap map[string][]string) (*Verifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, fmt.Errorf("OIDC issuer and audience must be set")
+	}
+	if scopeClaim == "" {
+		scopeClaim = "scope"
+	}
+
+	keys := &keySet{url: jwksURL, client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}
+	switch {
+	case keyFile != "":
+		static, err := loadKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys.url = ""
+		keys.keys = static
+	case jwksURL == "":
+		return nil, fmt.Errorf("OIDC needs a JWKS URL or a key file")
+	}
+
+	return &Verifier{
+		issuer:     issuer,
+		audience:   audience,
+		scopeClaim: scopeClaim,
+		scopeMap:   scopeMap,
+		keys:       keys,
+		now:        time.Now,
+	}, nil
+}
+
+// ParseScopeMap parses "value=scope,value=scope" pairs mapping claim values
+// to scopes. A value may be listed several times to grant more scopes.
+func ParseScopeMap(s string) (map[string][]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	m := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid OIDC scope mapping %q, want value=scope", pair)
+		}
+		value, scope := pair[:i], pair[i+1:]
+		if !apikeys.ValidScope(scope) {
+			return nil, fmt.Errorf("invalid OIDC scope mapping %q: unknown scope %q", pair, scope)
+		}
+		m[value] = append(m[value], scope)
+	}
+	return m, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expires   *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	IssuedAt  *float64 `json:"iat"`
+}
+
+// audience is a single string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Verify checks the token's signature, issuer, audience and lifetime and
+// returns who it was issued to.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalid
+	}
+
+	var h header
+	if err := decodePart(parts[0], &h); err != nil {
+		return nil, ErrInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	keys, err := v.keys.get(ctx, h.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if verifySignature(h.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalid
+	}
+
+	var c claims
+	if err := decodePart(parts[1], &c); err != nil {
+		return nil, ErrInvalid
+	}
+	var raw map[string]any
+	if err := decodePart(parts[1], &raw); err != nil {
+		return nil, ErrInvalid
+	}
+
+	now := v.now()
+	switch {
+	case c.Expires == nil || c.Subject == "":
+		return nil, ErrInvalid
+	case !now.Before(unixTime(*c.Expires).Add(clockSkew)):
+		return nil, ErrExpired
+	case c.NotBefore != nil && now.Add(clockSkew).Before(unixTime(*c.NotBefore)):
+		return nil, ErrInvalid
+	case c.IssuedAt != nil && now.Add(clockSkew).Before(unixTime(*c.IssuedAt)):
+		return nil, ErrInvalid
+	case c.Issuer != v.issuer:
+		return nil, ErrIssuer
+	case !contains(c.Audience, v.audience):
+		return nil, ErrAudience
+	}
+
+	return &Identity{Subject: c.Subject, Scopes: v.scopes(raw)}, nil
+}
+
+// scopes maps the values of the scope claim, a space separated string or a
+// list, to scopes.
+func (v *Verifier) scopes(raw map[string]any) []string {
+	var claim any = raw
+	for _, name := range strings.Split(v.scopeClaim, ".") {
+		obj, ok := claim.(map[string]any)
+		if !ok {
+			return nil
+		}
+		claim = obj[name]
+	}
+
+	var values []string
+	switch c := claim.(type) {
+	case string:
+		values = strings.Fields(c)
+	case []any:
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var scopes []string
+	for _, value := range values {
+		granted := v.scopeMap[value]
+		if v.scopeMap == nil && apikeys.ValidScope(value) {
+			granted = []string{value}
+		}
+		for _, scope := range granted {
+			if !contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// verifySignature checks sig over signed with key. Only asymmetric
+// algorithms are accepted, so "none" and HMAC tokens always fail.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	digest := func() []byte {
+		h := hash.New()
+		h.Write(signed)
+		return h.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case hash == 0:
+			return false
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(k, hash, digest(), sig) == nil
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(k, hash, digest(), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || hash == 0 || len(sig) != 2*size {
+			return false
+		}
+		// The hash must match the curve: ES256 on P-256 and so on
+		if want := map[int]crypto.Hash{256: crypto.SHA256, 384: crypto.SHA384, 521: crypto.SHA512}[k.Curve.Params().BitSize]; want != hash {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest(), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
+
+func decodePart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// mint signs claims with key as a compact JWT.
+func mint(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	p, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(p)
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   "https://id.example.com",
+		"sub":   "svc-archiver",
+		"aud":   []string{"other", "viddl"},
+		"exp":   testNow.Add(5 * time.Minute).Unix(),
+		"iat":   testNow.Unix(),
+		"scope": "openid viddl.download",
+		"realm_access": map[string]any{
+			"roles": []string{"viddl-admin"},
+		},
+	}
+}
+
+func with(key string, value any) map[string]any {
+	c := validClaims()
+	if value == nil {
+		delete(c, key)
+	} else {
+		c[key] = value
+	}
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(otherKey.N.Bytes()), "e": "AQAB"},
+	}})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	scopeMap, err := ParseScopeMap("viddl.download=info,viddl.download=download,viddl-admin=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier("https://id.example.com", "viddl", srv.URL, "", "scope", scopeMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+	v.keys.now = v.now
+
+	tests := []struct {
+		name       string
+		token      string
+		wantErr    error
+		wantScopes []string
+	}{
+		{name: "rsa", token: mint(t, "RS256", "rsa1", rsaKey, validClaims()), wantScopes: []string{"info", "download"}},
+		{name: "ecdsa", token: mint(t, "ES256", "ec1", ecKey, validClaims()), wantScopes: []string{"info", "download"}},
+		{name: "no scopes granted", token: mint(t, "RS256", "rsa1", rsaKey, with("scope", "openid email"))},
+		{name: "wrong issuer", token: mint(t, "RS256", "rsa1", rsaKey, with("iss", "https://evil.example.com")), wantErr: ErrIssuer},
+		{name: "wrong audience", token: mint(t, "RS256", "rsa1", rsaKey, with("aud", "other")), wantErr: ErrAudience},
+		{name: "expired", token: mint(t, "RS256", "rsa1", rsaKey, with("exp", testNow.Add(-2*time.Minute).Unix())), wantErr: ErrExpired},
+		{name: "expired within leeway", token: mint(t, "RS256", "rsa1", rsaKey, with("exp", testNow.Add(-30*time.Second).Unix())), wantScopes: []string{"info", "download"}},
+		{name: "not yet valid", token: mint(t, "RS256", "rsa1", rsaKey, with("nbf", testNow.Add(time.Hour).Unix())), wantErr: ErrInvalid},
+		{name: "no expiry", token: mint(t, "RS256", "rsa1", rsaKey, with("exp", nil)), wantErr: ErrInvalid},
+		{name: "signed by unknown key", token: mint(t, "RS256", "rsa1", otherKey, validClaims()), wantErr: ErrInvalid},
+		{name: "encryption key not used", token: mint(t, "RS256", "enc", otherKey, validClaims()), wantErr: ErrInvalid},
+		{name: "alg confusion", token: mint(t, "ES256", "rsa1", ecKey, validClaims()), wantErr: ErrInvalid},
+		{name: "alg none", token: b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"x"}`)) + ".", wantErr: ErrInvalid},
+		{name: "garbage", token: "not-a-token", wantErr: ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.Verify(context.Background(), tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (id.Subject != "svc-archiver" || !reflect.DeepEqual(id.Scopes, tt.wantScopes)) {
+				t.Errorf("Verify() = %+v, want scopes %v", id, tt.wantScopes)
+			}
+		})
+	}
+
+	// Keys are cached; a token with an unknown key ID refetches at most
+	// once a minute
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+	later := testNow.Add(2 * time.Minute)
+	v.now = func() time.Time { return later }
+	v.keys.now = v.now
+	v.Verify(context.Background(), mint(t, "RS256", "rotated", otherKey, validClaims()))
+	v.Verify(context.Background(), mint(t, "RS256", "rotated", otherKey, validClaims()))
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times after unknown key ID, want 2", n)
+	}
+
+	// Nested role claims
+	v.scopeClaim = "realm_access.roles"
+	id, err := v.Verify(context.Background(), mint(t, "RS256", "rsa1", rsaKey, validClaims()))
+	if err != nil || !reflect.DeepEqual(id.Scopes, []string{"admin"}) {
+		t.Errorf("Verify() with nested claim = %+v, %v", id, err)
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a scope map claim values naming a scope are used directly
+	v, err := NewVerifier("https://id.example.com", "viddl", "", path, "scope", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+
+	id, err := v.Verify(context.Background(), mint(t, "RS256", "any", key, with("scope", "openid info audio")))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if !reflect.DeepEqual(id.Scopes, []string{"info", "audio"}) {
+		t.Errorf("Scopes = %v, want [info audio]", id.Scopes)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier("https://id.example.com", "viddl", srv.URL, "", "scope", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+	v.keys.now = v.now
+
+	if _, err := v.Verify(context.Background(), mint(t, "RS256", "rsa1", key, validClaims())); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Verify() without keys error = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestParseScopeMap(t *testing.T) {
+	if _, err := ParseScopeMap("viddl=delete"); err == nil {
+		t.Error("ParseScopeMap() with unknown scope: want error")
+	}
+	if _, err := ParseScopeMap("download"); err == nil {
+		t.Error("ParseScopeMap() without =: want error")
+	}
+	m, err := ParseScopeMap("urn:viddl:role=admin, urn:viddl:role=audio")
+	if err != nil || !reflect.DeepEqual(m["urn:viddl:role"], []string{"admin", "audio"}) {
+		t.Errorf("ParseScopeMap() = %v, %v", m, err)
+	}
+}
@@ -0,0 +1,193 @@
+// Package policy describes how URLs on each allowed domain are handled.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"viddl.me/backend/internal/proxy"
+)
+
+// What a request does with a URL.
+const (
+	ModeInfo  = "info"
+	ModeVideo = "video"
+	ModeAudio = "audio"
+	ModeImage = "image"
+)
+
+var modes = []string{ModeInfo, ModeVideo, ModeAudio, ModeImage}
+
+// Policy applies to a domain and its subdomains. Unset limits fall back to
+// the global settings.
+type Policy struct {
+	Domain string `yaml:"domain"`
+
+	// At most the global max_download_size, which disk space is reserved for
+	MaxFileSize string        `yaml:"max_download_size"`
+	Timeout     time.Duration `yaml:"download_timeout"`
+	// Longest video that may be downloaded, 0 for no limit
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// Allowed modes, all when empty
+	Modes []string `yaml:"modes"`
+
+	CookiesFile string `yaml:"ytdlp_cookies"`
+	// Used instead of the outbound proxy pool
+	Proxy     string   `yaml:"proxy"`
+	YtDlpArgs []string `yaml:"ytdlp_args"`
+
+	// How many requests one request counts as against per-IP rate limits
+	RateWeight int `yaml:"rate_weight"`
+}
+
+// UnmarshalYAML accepts a bare domain as well as a full policy.
+func (p *Policy) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = Policy{Domain: value.Value}
+		return nil
+	}
+	type plain Policy
+	return value.Decode((*plain)(p))
+}
+
+// Allows reports whether the policy permits mode.
+func (p Policy) Allows(mode string) bool {
+	return len(p.Modes) == 0 || slices.Contains(p.Modes, mode)
+}
+
+// Weight returns the rate limit weight, at least 1.
+func (p Policy) Weight() int {
+	return max(p.RateWeight, 1)
+}
+
+// Validate checks the policy on its own. Limits relative to the global
+// settings are checked by the config package.
+func (p Policy) Validate() error {
+	var errs []error
+	if p.Domain == "" || strings.ContainsAny(p.Domain, "/: ") {
+		errs = append(errs, fmt.Errorf("%q is not a domain", p.Domain))
+	}
+	if p.Timeout < 0 || p.MaxDuration < 0 {
+		errs = append(errs, errors.New("download_timeout and max_duration must not be negative"))
+	}
+	if p.RateWeight < 0 {
+		errs = append(errs, errors.New("rate_weight must not be negative"))
+	}
+	for _, mode := range p.Modes {
+		if !slices.Contains(modes, mode) {
+			errs = append(errs, fmt.Errorf("mode %q is not one of %s", mode, strings.Join(modes, ", ")))
+		}
+	}
+	if p.Proxy != "" {
+		if err := proxy.CheckURL(p.Proxy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := checkArgs(p.YtDlpArgs); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// safeArgs are the yt-dlp options a policy may add, and whether they take
+// a value. Options that run commands, write files elsewhere or change the
+// output format are left out.
+var safeArgs = map[string]bool{
+	"--extractor-args":       true,
+	"--format-sort":          true,
+	"-S":                     true,
+	"--concurrent-fragments": true,
+	"-N":                     true,
+	"--limit-rate":           true,
+	"-r":                     true,
+	"--throttled-rate":       true,
+	"--http-chunk-size":      true,
+	"--sleep-requests":       true,
+	"--sleep-interval":       true,
+	"--max-sleep-interval":   true,
+	"--socket-timeout":       true,
+	"--retries":              true,
+	"--fragment-retries":     true,
+	"--geo-bypass-country":   true,
+	"--xff":                  true,
+	"--impersonate":          true,
+	"--referer":              true,
+	"--user-agent":           true,
+	"--force-ipv4":           false,
+	"-4":                     false,
+	"--force-ipv6":           false,
+	"-6":                     false,
+	"--hls-use-mpegts":       false,
+	"--no-part":              false,
+}
+
+func checkArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(args[i], "=")
+		takesValue, ok := safeArgs[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("ytdlp_args: %s is not allowed", name)
+		case takesValue && !hasValue:
+			// The value is the next argument
+			if i++; i == len(args) {
+				return fmt.Errorf("ytdlp_args: %s needs a value", name)
+			}
+		case !takesValue && hasValue:
+			return fmt.Errorf("ytdlp_args: %s takes no value", name)
+		}
+	}
+	return nil
+}
+
+// Set is the policies of all allowed domains.
+type Set []Policy
+
+// FromDomains returns default policies for domains.
+func FromDomains(domains []string) Set {
+	s := make(Set, len(domains))
+	for i, domain := range domains {
+		s[i] = Policy{Domain: domain}
+	}
+	return s
+}
+
+// Domains returns the domains of the set.
+func (s Set) Domains() []string {
+	domains := make([]string, len(s))
+	for i, p := range s {
+		domains[i] = p.Domain
+	}
+	return domains
+}
+
+// Lookup returns the policy of the most specific domain hostname belongs
+// to, so a policy for v3.fal.media wins over one for fal.media.
+func (s Set) Lookup(hostname string) (Policy, bool) {
+	hostname = strings.TrimPrefix(strings.ToLower(hostname), "www.")
+	var best Policy
+	found := false
+	for _, p := range s {
+		if hostname != p.Domain && !strings.HasSuffix(hostname, "."+p.Domain) {
+			continue
+		}
+		if !found || len(p.Domain) > len(best.Domain) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// LookupURL is Lookup for the host of rawURL.
+func (s Set) LookupURL(rawURL string) (Policy, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Policy{}, false
+	}
+	return s.Lookup(u.Hostname())
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestUnmarshal(t *testing.T) {
+	var s Set
+	err := yaml.Unmarshal([]byte(`
+- youtube.com
+- domain: twitch.tv
+  max_download_size: 4G
+  modes: [info, video]
+  rate_weight: 2
+`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[0].Domain != "youtube.com" || s[1].MaxFileSize != "4G" || s[1].Weight() != 2 {
+		t.Fatalf("Unmarshal() = %+v", s)
+	}
+	if s[1].Allows(ModeAudio) || !s[1].Allows(ModeVideo) || !s[0].Allows(ModeAudio) {
+		t.Errorf("Allows() does not follow modes: %+v", s)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := Set{{Domain: "fal.media", RateWeight: 1}, {Domain: "v3.fal.media", RateWeight: 3}, {Domain: "youtube.com"}}
+	tests := []struct {
+		host       string
+		wantDomain string
+	}{
+		{host: "fal.media", wantDomain: "fal.media"},
+		{host: "cdn.fal.media", wantDomain: "fal.media"},
+		{host: "v3.fal.media", wantDomain: "v3.fal.media"},
+		{host: "www.YouTube.com", wantDomain: "youtube.com"},
+		{host: "notyoutube.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			p, ok := s.Lookup(tt.host)
+			if ok != (tt.wantDomain != "") || p.Domain != tt.wantDomain {
+				t.Errorf("Lookup(%q) = %q, %v, want %q", tt.host, p.Domain, ok, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr string
+	}{
+		{name: "valid", policy: Policy{Domain: "instagram.com", Proxy: "socks5://127.0.0.1:1080", YtDlpArgs: []string{"--limit-rate", "5M", "-N=4", "--force-ipv4"}}},
+		{name: "unknown mode", policy: Policy{Domain: "x.com", Modes: []string{"stream"}}, wantErr: `mode "stream"`},
+		{name: "unsafe arg", policy: Policy{Domain: "x.com", YtDlpArgs: []string{"--exec", "rm -rf /"}}, wantErr: "--exec is not allowed"},
+		{name: "missing value", policy: Policy{Domain: "x.com", YtDlpArgs: []string{"--limit-rate"}}, wantErr: "needs a value"},
+		{name: "bad proxy", policy: Policy{Domain: "x.com", Proxy: "127.0.0.1:8080"}, wantErr: "proxy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
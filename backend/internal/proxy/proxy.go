@@ -0,0 +1,294 @@
+// Package proxy spreads yt-dlp's outbound traffic over a pool of proxies
+// and sets aside the ones platforms start blocking.
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"viddl.me/backend/internal/metrics"
+)
+
+// How Pick chooses among the proxies not in quarantine.
+const (
+	RoundRobin    = "round-robin"
+	LeastFailures = "least-failures"
+)
+
+// Strategies are the valid proxy strategies.
+var Strategies = []string{RoundRobin, LeastFailures}
+
+// Outcomes of a run through a proxy, see Classify.
+const (
+	OutcomeSuccess = "success"
+	// The platform rate-limited or bot-checked the proxy's address
+	OutcomeBlocked = "blocked"
+	// The proxy itself could not be used
+	OutcomeFailed = "failed"
+	// Errors that say nothing about the proxy, like a removed video
+	OutcomeError = "error"
+)
+
+// maxFailures is how many failed runs in a row put a proxy in quarantine.
+// A block does so right away.
+const maxFailures = 3
+
+// CheckURL reports whether rawURL is a proxy yt-dlp can use.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "socks4", "socks5", "socks5h"}, u.Scheme) {
+		return errors.New("proxy must be an http, https or socks URL")
+	}
+	return nil
+}
+
+// Name returns rawURL without credentials, for logs, stats and metric
+// labels.
+func Name(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+var (
+	// Messages of rate limits and bot checks. YouTube's "Sign in to confirm
+	// your age" is about the video, not the address, so only its bot check
+	// counts.
+	blockedMarkers = []string{
+		"HTTP Error 429",
+		"Too Many Requests",
+		"confirm you're not a bot",
+		"confirm you’re not a bot",
+		"rate-limit reached",
+		"Please wait a few minutes before you try again",
+	}
+	failedMarkers = []string{
+		"Unable to connect to proxy",
+		"ProxyError",
+		"Tunnel connection failed",
+		"Proxy Authentication Required",
+		"SOCKS",
+	}
+)
+
+// Classify returns the outcome of a yt-dlp run from its error and stderr.
+func Classify(output string, err error) string {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	if Blocked(output) {
+		return OutcomeBlocked
+	}
+	for _, m := range failedMarkers {
+		if strings.Contains(output, m) {
+			return OutcomeFailed
+		}
+	}
+	return OutcomeError
+}
+
+// Blocked reports whether yt-dlp's stderr says the platform rate-limited
+// or bot-checked the address it came from.
+func Blocked(output string) bool {
+	for _, m := range blockedMarkers {
+		if strings.Contains(output, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats describes one proxy of the pool.
+type Stats struct {
+	Proxy string `json:"proxy"`
+	// Times the proxy was picked
+	Requests int64 `json:"requests"`
+	// Failed runs, blocks included
+	Failures            int64      `json:"failures"`
+	Blocks              int64      `json:"blocks"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	QuarantinedUntil    *time.Time `json:"quarantined_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type entry struct {
+	url   string
+	stats Stats
+}
+
+func (e *entry) quarantined(now time.Time) bool {
+	return e.stats.QuarantinedUntil != nil && now.Before(*e.stats.QuarantinedUntil)
+}
+
+// Pool hands out proxies and tracks how they fare. A nil Pool has no
+// proxies.
+type Pool struct {
+	mu         sync.Mutex
+	proxies    []*entry
+	strategy   string
+	quarantine time.Duration
+	next       int
+	now        func() time.Time
+}
+
+func NewPool(urls []string, strategy string, quarantine time.Duration) *Pool {
+	p := &Pool{now: time.Now}
+	p.Set(urls, strategy, quarantine)
+	return p
+}
+
+// Set replaces the proxies and settings. Proxies still in the list keep
+// their stats and quarantine.
+func (p *Pool) Set(urls []string, strategy string, quarantine time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := make(map[string]*entry, len(p.proxies))
+	for _, e := range p.proxies {
+		old[e.url] = e
+	}
+	proxies := make([]*entry, 0, len(urls))
+	for _, u := range urls {
+		e, ok := old[u]
+		if !ok {
+			e = &entry{url: u, stats: Stats{Proxy: Name(u)}}
+			metrics.ProxyQuarantined.WithLabelValues(e.stats.Proxy).Set(0)
+		}
+		delete(old, u)
+		proxies = append(proxies, e)
+	}
+	for _, e := range old {
+		metrics.ProxyQuarantined.DeleteLabelValues(e.stats.Proxy)
+	}
+
+	p.proxies = proxies
+	p.strategy = strategy
+	p.quarantine = quarantine
+	p.next = 0
+}
+
+// Pick returns the proxy for the next request, or "" without proxies. When
+// every proxy is in quarantine, the one released first is used rather than
+// the server's own address.
+func (p *Pool) Pick() string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.proxies) == 0 {
+		return ""
+	}
+
+	now := p.now()
+	p.release(now)
+	var best *entry
+	for i := range p.proxies {
+		// Round-robin takes the first usable proxy after the last one
+		// picked, least-failures compares them all
+		idx := (p.next + i) % len(p.proxies)
+		e := p.proxies[idx]
+		if e.quarantined(now) {
+			continue
+		}
+		if p.strategy != LeastFailures {
+			p.next = idx + 1
+			best = e
+			break
+		}
+		if best == nil || e.stats.Failures < best.stats.Failures ||
+			(e.stats.Failures == best.stats.Failures && e.stats.Requests < best.stats.Requests) {
+			best = e
+		}
+	}
+	if best == nil {
+		for _, e := range p.proxies {
+			if best == nil || e.stats.QuarantinedUntil.Before(*best.stats.QuarantinedUntil) {
+				best = e
+			}
+		}
+	}
+	best.stats.Requests++
+	return best.url
+}
+
+// release lifts quarantines that have run out.
+func (p *Pool) release(now time.Time) {
+	for _, e := range p.proxies {
+		if e.stats.QuarantinedUntil != nil && !e.quarantined(now) {
+			e.stats.QuarantinedUntil = nil
+			e.stats.ConsecutiveFailures = 0
+			metrics.ProxyQuarantined.WithLabelValues(e.stats.Proxy).Set(0)
+			slog.Info("Proxy released from quarantine", "proxy", e.stats.Proxy)
+		}
+	}
+}
+
+// Report records the outcome of a run through proxyURL, with the error
+// message for failures. It returns whether the proxy went into quarantine.
+// Proxies not in the pool, such as those of domain policies, are ignored.
+func (p *Pool) Report(proxyURL, outcome, message string) bool {
+	if p == nil || proxyURL == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := slices.IndexFunc(p.proxies, func(e *entry) bool { return e.url == proxyURL })
+	if i < 0 {
+		return false
+	}
+	e := p.proxies[i]
+	metrics.ProxyRuns.WithLabelValues(e.stats.Proxy, outcome).Inc()
+
+	switch outcome {
+	case OutcomeSuccess:
+		e.stats.ConsecutiveFailures = 0
+		return false
+	case OutcomeError:
+		return false
+	}
+	e.stats.Failures++
+	e.stats.ConsecutiveFailures++
+	e.stats.LastError = message
+	if outcome == OutcomeBlocked {
+		e.stats.Blocks++
+	}
+
+	now := p.now()
+	if e.quarantined(now) || (outcome != OutcomeBlocked && e.stats.ConsecutiveFailures < maxFailures) {
+		return false
+	}
+	until := now.Add(p.quarantine)
+	e.stats.QuarantinedUntil = &until
+	metrics.ProxyQuarantined.WithLabelValues(e.stats.Proxy).Set(1)
+	slog.Warn("Proxy quarantined", "proxy", e.stats.Proxy, "outcome", outcome,
+		"until", until.Format(time.RFC3339), "error", message)
+	return true
+}
+
+// Strategy returns how proxies are picked.
+func (p *Pool) Strategy() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.strategy
+}
+
+// Stats returns the stats of every proxy, in configuration order.
+func (p *Pool) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.release(p.now())
+	stats := make([]Stats, len(p.proxies))
+	for i, e := range p.proxies {
+		stats[i] = e.stats
+	}
+	return stats
+}
@@ -0,0 +1,177 @@
+package retry
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"viddl.me/backend/internal/metrics"
+)
+
+// Breaker states. An open breaker turns runs away until its cooldown is
+// over, then lets one run through half-open to see if the platform is back.
+const (
+	Closed   = "closed"
+	HalfOpen = "half-open"
+	Open     = "open"
+)
+
+var stateValues = map[string]float64{Closed: 0, HalfOpen: 1, Open: 2}
+
+// Outcome is what a run says about its platform.
+type Outcome int
+
+const (
+	// The platform answered, even if only to say the video is private
+	Succeeded Outcome = iota
+	// The platform failed to answer, timed out or blocked the server
+	Failed
+	// The run says nothing about the platform, e.g. it was canceled
+	Ignored
+)
+
+// BreakerStats describes the breaker of one platform.
+type BreakerStats struct {
+	Platform            string     `json:"platform"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Trips               int64      `json:"trips"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type breaker struct {
+	stats BreakerStats
+	// When the half-open probe started, zero while none runs
+	probe time.Time
+}
+
+// Breakers keeps a circuit breaker per platform. Threshold failed runs in a
+// row open a platform's breaker for the cooldown. A nil Breakers, or one
+// with a threshold of 0, lets every run through.
+type Breakers struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	platforms map[string]*breaker
+	now       func() time.Time
+}
+
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	b := &Breakers{platforms: make(map[string]*breaker), now: time.Now}
+	b.Set(threshold, cooldown)
+	return b
+}
+
+// Set changes the threshold and cooldown. Open breakers stay open until
+// their current cooldown ends.
+func (b *Breakers) Set(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.cooldown = cooldown
+}
+
+// Allow reports whether a run for platform may start, or else how long
+// until the platform is tried again. Each Allow that returns true must be
+// followed by a Record.
+func (b *Breakers) Allow(platform string) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.platforms[platform]
+	if b.threshold <= 0 || br == nil {
+		return 0, true
+	}
+
+	now := b.now()
+	switch br.stats.State {
+	case Open:
+		if now.Before(*br.stats.OpenUntil) {
+			return br.stats.OpenUntil.Sub(now), false
+		}
+		br.stats.State, br.stats.OpenUntil = HalfOpen, nil
+		metrics.BreakerState.WithLabelValues(platform).Set(stateValues[HalfOpen])
+		slog.Info("Circuit breaker half-open, trying platform again", "platform", platform)
+	case HalfOpen:
+		// A probe that never reported back doesn't block the platform
+		// for good
+		if !br.probe.IsZero() && now.Sub(br.probe) < b.cooldown {
+			return b.cooldown - now.Sub(br.probe), false
+		}
+	default:
+		return 0, true
+	}
+	br.probe = now
+	return 0, true
+}
+
+// Record reports how a run for platform went, with the error message of
+// failures.
+func (b *Breakers) Record(platform string, outcome Outcome, message string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return
+	}
+	br := b.platforms[platform]
+	if br == nil {
+		if outcome != Failed {
+			return
+		}
+		br = &breaker{stats: BreakerStats{Platform: platform, State: Closed}}
+		b.platforms[platform] = br
+	}
+
+	switch outcome {
+	case Ignored:
+		br.probe = time.Time{}
+	case Succeeded:
+		br.stats.ConsecutiveFailures = 0
+		br.probe = time.Time{}
+		if br.stats.State != Closed {
+			br.stats.State, br.stats.OpenUntil = Closed, nil
+			metrics.BreakerState.WithLabelValues(platform).Set(stateValues[Closed])
+			slog.Info("Circuit breaker closed", "platform", platform)
+		}
+	case Failed:
+		br.stats.ConsecutiveFailures++
+		br.stats.LastError = message
+		if br.stats.State == HalfOpen || (br.stats.State == Closed && br.stats.ConsecutiveFailures >= b.threshold) {
+			b.trip(br)
+		}
+	}
+}
+
+func (b *Breakers) trip(br *breaker) {
+	until := b.now().Add(b.cooldown)
+	br.stats.State, br.stats.OpenUntil = Open, &until
+	br.stats.Trips++
+	br.probe = time.Time{}
+	metrics.BreakerState.WithLabelValues(br.stats.Platform).Set(stateValues[Open])
+	metrics.BreakerTrips.WithLabelValues(br.stats.Platform).Inc()
+	slog.Warn("Circuit breaker open, failing fast", "platform", br.stats.Platform,
+		"failures", br.stats.ConsecutiveFailures, "until", until.Format(time.RFC3339), "error", br.stats.LastError)
+}
+
+// Stats describes the breaker of every platform that has failed, by
+// platform.
+func (b *Breakers) Stats() []BreakerStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := make([]BreakerStats, 0, len(b.platforms))
+	for _, br := range b.platforms {
+		stats = append(stats, br.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Platform < stats[j].Platform })
+	return stats
+}
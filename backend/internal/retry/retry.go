@@ -0,0 +1,43 @@
+// Package retry decides when failed yt-dlp runs are tried again, and stops
+// sending runs to platforms that keep failing.
+package retry
+
+import (
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Policy says how often and after how long a failed run is tried again.
+type Policy struct {
+	// Runs in total, the first one included
+	Attempts int
+	// Wait before the second run, doubling for each further one up to
+	// MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Error codes worth another run
+	On []string
+}
+
+// Retries reports whether a run that failed with code is tried again.
+func (p Policy) Retries(code string) bool {
+	return slices.Contains(p.On, code)
+}
+
+// Delay returns the wait before run attempt, counted from 0. The wait is
+// jittered between half and all of the backoff, so runs failing together
+// don't come back together.
+func (p Policy) Delay(attempt int) time.Duration {
+	if attempt <= 0 || p.Backoff <= 0 {
+		return 0
+	}
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
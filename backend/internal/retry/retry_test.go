@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Attempts: 6, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{5, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := p.Delay(tt.attempt); got < tt.max/2 || got > tt.max {
+				t.Fatalf("Delay(%d) = %s, want between %s and %s", tt.attempt, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBreakers(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	fail := func() {
+		if _, ok := b.Allow("youtube.com"); !ok {
+			t.Fatal("Allow() = false, want the run let through")
+		}
+		b.Record("youtube.com", Failed, "HTTP Error 503")
+	}
+
+	// Answers about the video reset the count
+	fail()
+	fail()
+	b.Record("youtube.com", Succeeded, "")
+	fail()
+	fail()
+	fail()
+	if wait, ok := b.Allow("youtube.com"); ok || wait != time.Minute {
+		t.Fatalf("Allow() = %s, %v after %d failures, want open for a minute", wait, ok, 3)
+	}
+	if _, ok := b.Allow("vimeo.com"); !ok {
+		t.Error("other platform turned away")
+	}
+
+	// Half-open lets one probe through, a failed one opens the breaker again
+	now = now.Add(time.Minute)
+	if _, ok := b.Allow("youtube.com"); !ok {
+		t.Fatal("Allow() after the cooldown = false, want a probe")
+	}
+	if _, ok := b.Allow("youtube.com"); ok {
+		t.Error("second run let through while the probe runs")
+	}
+	b.Record("youtube.com", Failed, "HTTP Error 503")
+	if _, ok := b.Allow("youtube.com"); ok {
+		t.Error("Allow() after a failed probe = true, want open")
+	}
+
+	// A canceled probe frees the slot, a successful one closes the breaker
+	now = now.Add(time.Minute)
+	b.Allow("youtube.com")
+	b.Record("youtube.com", Ignored, "")
+	if _, ok := b.Allow("youtube.com"); !ok {
+		t.Fatal("Allow() after a canceled probe = false, want another probe")
+	}
+	b.Record("youtube.com", Succeeded, "")
+
+	stats := b.Stats()
+	if len(stats) != 1 || stats[0].State != Closed || stats[0].Trips != 2 || stats[0].LastError != "HTTP Error 503" {
+		t.Errorf("Stats() = %+v, want youtube.com closed after 2 trips", stats)
+	}
+}
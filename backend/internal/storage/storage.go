@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Object describes a stored download result.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage holds finished downloads. Keys are flat file names such as
+// "<session>_<title>.mp4".
+type Storage interface {
+	// Key returns the key a file named name is stored under by this
+	// server.
+	Key(name string) string
+	// Put moves the local file at path into storage under key. The local
+	// file is gone afterwards unless the backend stores it in place.
+	Put(ctx context.Context, key, path, contentType string) error
+	// Open returns the object's content. Seeking reads only from the new
+	// offset on, so ranges can be served without reading the whole object.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error)
+	Delete(ctx context.Context, key string) error
+	// ListOlderThan returns objects this server stored that were last
+	// modified more than age ago, oldest first.
+	ListOlderThan(ctx context.Context, age time.Duration) ([]Object, error)
+}
@@ -1,56 +1,312 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/time/rate"
 
+	"viddl.me/backend/internal/apikeys"
 	"viddl.me/backend/internal/cleanup"
 	"viddl.me/backend/internal/config"
+	"viddl.me/backend/internal/cookies"
+	"viddl.me/backend/internal/disk"
+	"viddl.me/backend/internal/downloader"
 	"viddl.me/backend/internal/handlers"
+	"viddl.me/backend/internal/jobs"
+	"viddl.me/backend/internal/logging"
+	"viddl.me/backend/internal/metrics"
 	"viddl.me/backend/internal/middleware"
+	"viddl.me/backend/internal/oidc"
+	"viddl.me/backend/internal/proxy"
+	"viddl.me/backend/internal/retry"
+	"viddl.me/backend/internal/storage"
+	"viddl.me/backend/internal/tracing"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetPrefix("[viddl.me] ")
+// fatal logs a startup error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	slog.Info("Configuration loaded", "file", cfg.File, "port", cfg.Port, "domains", cfg.AllowedDomains.Domains(), "storage", cfg.StorageBackend)
 
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingExporter)
+	if err != nil {
+		fatal("Invalid tracing configuration", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
 
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     cfg.AllowedOrigins,
-		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Origin", "Content-Type"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	// gin's own logger would write request paths, link tokens included
+	r := gin.New()
+	r.Use(middleware.Recover())
+	r.Use(middleware.RequestID())
+	r.Use(middleware.Tracing())
+	r.Use(middleware.AccessLog())
+	r.Use(middleware.Metrics())
+
+	origins, err := middleware.NewCORS(cfg.AllowedOrigins)
+	if err != nil {
+		fatal("Invalid allowed origins", err)
+	}
+	r.Use(origins.Handler())
 
 	r.Use(middleware.SecurityHeaders())
 	r.Use(middleware.Gzip())
 
-	limiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/3), 3)
-	concurrentLimiter := middleware.NewConcurrentDownloadLimiter(2) // Max 2 concurrent downloads per IP
+	limiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/time.Duration(cfg.RateLimit)), cfg.RateBurst)
+	concurrentLimiter := middleware.NewConcurrentDownloadLimiter(cfg.MaxConcurrentDownloads)
+
+	workDir := storage.NewLocal(cfg.TmpDir)
+	var store storage.Storage = workDir
+	if cfg.StorageBackend == "s3" {
+		s3, err := storage.NewS3(storage.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Prefix:    cfg.S3Prefix,
+			Instance:  cfg.InstanceID,
+			PathStyle: cfg.S3PathStyle,
+		})
+		if err != nil {
+			fatal("Invalid S3 storage configuration", err)
+		}
+		store = s3
+	}
+
+	if err := os.MkdirAll(cfg.TmpDir, 0755); err != nil {
+		fatal("Failed to create tmp directory", err)
+	}
+	jobStore, err := jobs.Open(cfg.StateDB)
+	if err != nil {
+		fatal("Failed to open job store", err)
+	}
+	defer jobStore.Close()
+
+	// Restore pending removals and drop files left behind by the last run.
+	// Only the working directory is this instance's alone, a bucket holds
+	// the results of every instance
+	scheduler := cleanup.NewScheduler(jobStore, store)
+	if err := scheduler.Reconcile(context.Background(), cfg.LinkTTL, workDir); err != nil {
+		fatal("Failed to reconcile job store", err)
+	}
+
+	keys, err := apikeys.Load(cfg.APIKeysFile, cfg.APIKey)
+	if err != nil {
+		fatal("Invalid API key configuration", err)
+	}
+	keyStore := apikeys.NewStore(keys, jobStore)
+	keyStore.SetTokenLimits(float64(cfg.OIDCRateLimit), cfg.OIDCRateBurst, cfg.OIDCMaxConcurrent)
+
+	var verifier *oidc.Verifier
+	if cfg.OIDCJWKSURL != "" || cfg.OIDCKeyFile != "" {
+		scopeMap, err := oidc.ParseScopeMap(cfg.OIDCScopeMap)
+		if err != nil {
+			fatal("Invalid OIDC configuration", err)
+		}
+		verifier, err = oidc.NewVerifier(cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OIDCJWKSURL, cfg.OIDCKeyFile, cfg.OIDCScopeClaim, scopeMap)
+		if err != nil {
+			fatal("Invalid OIDC configuration", err)
+		}
+		slog.Info("Accepting OIDC bearer tokens", "issuer", cfg.OIDCIssuer)
+	}
+
+	proxies := proxy.NewPool(cfg.Proxies, cfg.ProxyStrategy, cfg.ProxyQuarantine)
+	if len(cfg.Proxies) > 0 {
+		slog.Info("Sending yt-dlp through outbound proxies", "proxies", len(cfg.Proxies), "strategy", cfg.ProxyStrategy)
+	}
+	jars := cookies.NewPool(cfg.CookieJars)
+	breakers := retry.NewBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	dl := downloader.New(cfg.TmpDir, cfg.MaxDownloadSize, cfg.MinFreeDisk, store, proxies, jars, breakers)
+	dl.Configure(cfg.CookiesFile, cfg.DirectMediaDomains, cfg.AllowedDomains, cfg.DownloadTimeout, cfg.RetryPolicy())
+	h := handlers.New(cfg, dl, store, jobStore, scheduler, keyStore)
 
-	h := handlers.New(cfg)
+	// Requests with a bearer token or an API key are held to the key's
+	// limits instead of the per-IP ones
+	auth := func(scope string, required bool) []gin.HandlerFunc {
+		return []gin.HandlerFunc{
+			middleware.BearerAuth(verifier, keyStore, scope),
+			middleware.APIKeyAuth(keyStore, scope, required),
+		}
+	}
+	// Maintenance mode turns away new downloads, info lookups and links
+	// keep working
+	maintenance := &middleware.Maintenance{}
 
-	r.POST("/api/info", middleware.RateLimit(limiter), h.GetVideoInfo)
-	r.POST("/api/download", middleware.RateLimit(limiter), middleware.ConcurrentLimit(concurrentLimiter), h.DownloadVideo)
-	r.POST("/api/audio", middleware.APIKeyAuth(cfg.APIKey), middleware.ConcurrentLimit(concurrentLimiter), h.ExtractAudio)
+	api := r.Group("/api", middleware.RejectBanned(limiter))
+	api.POST("/info", append(auth(apikeys.ScopeInfo, false), middleware.RateLimit(limiter, h.RateWeight), h.GetVideoInfo)...)
+	downloads := api.Group("", middleware.RejectDuringMaintenance(maintenance))
+	downloads.POST("/download", append(auth(apikeys.ScopeDownload, false), middleware.RateLimit(limiter, h.RateWeight), middleware.ConcurrentLimit(concurrentLimiter), h.DownloadVideo)...)
+	downloads.POST("/image", append(auth(apikeys.ScopeDownload, false), middleware.RateLimit(limiter, h.RateWeight), middleware.ConcurrentLimit(concurrentLimiter), h.DownloadImages)...)
+	downloads.POST("/audio", append(auth(apikeys.ScopeAudio, true), middleware.ConcurrentLimit(concurrentLimiter), h.ExtractAudio)...)
+	r.GET("/dl/:token", middleware.RejectBanned(limiter), h.ServeLink)
 	r.GET("/health", h.HealthCheck)
+	r.GET("/livez", h.Livez)
+	r.GET("/readyz", h.Readyz)
 
-	cleaner := cleanup.New(cfg.TmpDir, 5*time.Minute, 5*time.Minute)
+	// The working directory always needs sweeping for leftovers of failed
+	// downloads; a remote store holds finished files separately
+	cleaner := cleanup.New(workDir, scheduler, cfg.CleanupInterval, cfg.CleanupMaxAge)
+	cleaner.TrackSessions(cfg.TmpDir, dl.SessionActive)
+	if store == workDir {
+		// Finished files share the disk with running downloads, evict
+		// them early when new downloads would be turned away
+		cleaner.EvictUnderPressure(dl.Shortfall)
+	}
 	cleaner.Start()
+	cleaners := []*cleanup.Cleaner{cleaner}
+	if store != workDir {
+		// Only this instance's results are swept, and only well after
+		// their links have expired: objects are uploaded before the link
+		// is issued and cleanup_max_age is at least the link TTL
+		storeCleaner := cleanup.New(store, scheduler, cfg.CleanupInterval, cfg.CleanupMaxAge+time.Minute)
+		storeCleaner.Start()
+		cleaners = append(cleaners, storeCleaner)
+	}
+
+	a := handlers.NewAdmin(h, limiter, concurrentLimiter, maintenance, cleaners...)
+	admin := r.Group("/admin", auth(apikeys.ScopeAdmin, true)...)
+	admin.GET("/usage", h.KeyUsage)
+	admin.GET("/jobs", a.Jobs)
+	admin.POST("/jobs/:id/cancel", a.CancelJob)
+	admin.GET("/limits", a.Limits)
+	admin.POST("/ips/:ip/ban", a.BanIP)
+	admin.POST("/ips/:ip/unblock", a.UnblockIP)
+	admin.GET("/disk", a.Disk)
+	admin.GET("/proxies", a.Proxies)
+	admin.GET("/cookies", a.CookieJars)
+	admin.GET("/breakers", a.Breakers)
+	admin.PUT("/cookies/:name", a.UploadCookies)
+	admin.POST("/sweep", a.Sweep)
+	admin.GET("/maintenance", a.Maintenance)
+	admin.PUT("/maintenance", a.SetMaintenance)
+
+	metrics.SetPlatforms(cfg.AllowedDomains.Domains())
+	metrics.Gauge("viddl_running_jobs", "Downloads in progress.", func() float64 {
+		return float64(len(h.RunningJobs()))
+	})
+	metrics.Gauge("viddl_concurrent_downloads", "Downloads held by the per-IP and per-key concurrency limiter.", func() float64 {
+		return float64(concurrentLimiter.Total())
+	})
+	metrics.Gauge("viddl_tmp_dir_bytes", "Size of the tmp directory.", func() float64 {
+		used, _ := disk.Used(cfg.TmpDir)
+		return float64(used)
+	})
+	metrics.Gauge("viddl_disk_free_bytes", "Free space on the tmp directory's filesystem.", func() float64 {
+		usage, _ := dl.DiskUsage()
+		return float64(usage.Free)
+	})
+	metrics.Gauge("viddl_disk_reserved_bytes", "Disk space reserved by running downloads.", func() float64 {
+		usage, _ := dl.DiskUsage()
+		return float64(usage.Reserved)
+	})
+	// Metrics name proxies, cookie jars and limiter state, only scrapers
+	// and admins may see them
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsSrv = &http.Server{Addr: cfg.MetricsAddr, Handler: promhttp.Handler()}
+		go func() {
+			slog.Info("Metrics listener starting", "addr", cfg.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("Metrics listener failed", "error", err)
+			}
+		}()
+	} else {
+		r.GET("/metrics", append(auth(apikeys.ScopeAdmin, true), gin.WrapH(promhttp.Handler()))...)
+	}
+
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "port", cfg.Port)
+		serveErr <- srv.ListenAndServe()
+	}()
+	// Allowlists, limits, API keys, proxies, cookies, retries and link
+	// settings change without a restart, the rest is kept until one
+	go config.Watch(ctx, cfg, func(cfg *config.Config) {
+		if err := origins.SetOrigins(cfg.AllowedOrigins); err != nil {
+			slog.Error("Invalid allowed origins, keeping the current ones", "error", err)
+		}
+		limiter.SetLimit(rate.Every(time.Minute/time.Duration(cfg.RateLimit)), cfg.RateBurst)
+		concurrentLimiter.SetMax(cfg.MaxConcurrentDownloads)
+		if keys, err := apikeys.Load(cfg.APIKeysFile, cfg.APIKey); err != nil {
+			slog.Error("Invalid API key configuration, keeping the current keys", "error", err)
+		} else {
+			keyStore.SetKeys(keys)
+		}
+		keyStore.SetTokenLimits(float64(cfg.OIDCRateLimit), cfg.OIDCRateBurst, cfg.OIDCMaxConcurrent)
+		proxies.Set(cfg.Proxies, cfg.ProxyStrategy, cfg.ProxyQuarantine)
+		jars.Set(cfg.CookieJars)
+		breakers.Set(cfg.BreakerThreshold, cfg.BreakerCooldown)
+		dl.Configure(cfg.CookiesFile, cfg.DirectMediaDomains, cfg.AllowedDomains, cfg.DownloadTimeout, cfg.RetryPolicy())
+		logging.SetLevel(cfg.LogLevel)
+		metrics.SetPlatforms(cfg.AllowedDomains.Domains())
+		h.SetConfig(cfg)
+	})
+
+	select {
+	case err := <-serveErr:
+		fatal("Server failed to start", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away
+	stop()
+
+	drain(srv, h, cfg.ShutdownTimeout)
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	for _, c := range cleaners {
+		c.Stop()
+	}
+	limiter.Stop()
+	scheduler.Stop()
+	slog.Info("Server stopped")
+}
+
+// drain stops srv from accepting connections and waits up to timeout for
+// running downloads and file transfers. Downloads still running then are
+// canceled, which kills their yt-dlp processes.
+func drain(srv *http.Server, h *handlers.Handler, timeout time.Duration) {
+	slog.Info("Shutting down, waiting for running downloads", "running", len(h.RunningJobs()), "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		return
+	}
 
-	log.Printf("INFO: Server starting on port %s", cfg.Port)
-	if err := r.Run(":" + cfg.Port); err != nil {
-		log.Fatalf("FATAL: Server failed to start: %v", err)
+	slog.Warn("Shutdown timed out, canceling downloads", "canceled", h.CancelAll())
+	// Canceled downloads still answer their clients and record the failure
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.WaitIdle(ctx); err != nil {
+		slog.Error("Downloads did not stop in time", "running", len(h.RunningJobs()))
 	}
+	srv.Close()
 }
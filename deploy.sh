@@ -33,7 +33,10 @@ echo -e "${GREEN}✓ Code updated${NC}"
 # Step 2: Build backend
 echo -e "\n${YELLOW}[2/6] Building Go backend...${NC}"
 cd "$BACKEND_DIR"
-go build -o viddl-server main.go
+BUILDINFO="viddl.me/backend/internal/buildinfo"
+go build -ldflags "-X $BUILDINFO.Version=$(git describe --tags --always --dirty) \
+    -X $BUILDINFO.Commit=$(git rev-parse HEAD) \
+    -X $BUILDINFO.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o viddl-server .
 echo -e "${GREEN}✓ Backend built successfully${NC}"
 
 # Step 3: Build frontend (only if changes detected)
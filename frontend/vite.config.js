@@ -9,6 +9,10 @@ export default defineConfig({
       '/api': {
         target: 'http://localhost:3001',
         changeOrigin: true
+      },
+      '/dl': {
+        target: 'http://localhost:3001',
+        changeOrigin: true
       }
     }
   }